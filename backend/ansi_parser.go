@@ -0,0 +1,200 @@
+package backend
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ConsoleSpan is a run of console text sharing the same style. Colors are
+// names of the 16 ANSI colors ("red", "bright-blue", ...) or "#rrggbb".
+type ConsoleSpan struct {
+	Text      string `json:"text"`
+	Fg        string `json:"fg,omitempty"`
+	Bg        string `json:"bg,omitempty"`
+	Bold      bool   `json:"bold,omitempty"`
+	Italic    bool   `json:"italic,omitempty"`
+	Underline bool   `json:"underline,omitempty"`
+}
+
+var ansiColorNames = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+type ansiStyle struct {
+	fg, bg                  string
+	bold, italic, underline bool
+}
+
+func (style ansiStyle) isPlain() bool {
+	return style == ansiStyle{}
+}
+
+// parseANSI strips escape sequences from a line of terminal output. It
+// returns the plain text and, when the line had any SGR styling, the styled
+// spans. Cursor movement, erase and OSC sequences are dropped.
+func parseANSI(line string) (string, []ConsoleSpan) {
+	if !strings.ContainsAny(line, "\x1b\r") {
+		return line, nil
+	}
+
+	var plain strings.Builder
+	var spans []ConsoleSpan
+	var current strings.Builder
+	style := ansiStyle{}
+	styled := false
+
+	flush := func() {
+		if current.Len() == 0 {
+			return
+		}
+		spans = append(spans, ConsoleSpan{
+			Text:      current.String(),
+			Fg:        style.fg,
+			Bg:        style.bg,
+			Bold:      style.bold,
+			Italic:    style.italic,
+			Underline: style.underline,
+		})
+		current.Reset()
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == '\r' {
+			continue
+		}
+		if c != '\x1b' || i+1 >= len(line) {
+			plain.WriteByte(c)
+			current.WriteByte(c)
+			continue
+		}
+
+		switch line[i+1] {
+		case '[':
+			// CSI: parameters, then a final byte in 0x40-0x7e.
+			end := i + 2
+			for end < len(line) && (line[end] < 0x40 || line[end] > 0x7e) {
+				end++
+			}
+			if end >= len(line) {
+				i = len(line)
+				continue
+			}
+			if line[end] == 'm' {
+				flush()
+				style = applySGR(style, line[i+2:end])
+				if !style.isPlain() {
+					styled = true
+				}
+			}
+			i = end
+		case ']':
+			// OSC: ends with BEL or ST (ESC \).
+			end := i + 2
+			for end < len(line) && line[end] != '\a' && !(line[end] == '\x1b' && end+1 < len(line) && line[end+1] == '\\') {
+				end++
+			}
+			if end < len(line) && line[end] == '\x1b' {
+				end++
+			}
+			i = end
+		default:
+			// Two byte escape such as ESC 7 / ESC 8.
+			i++
+		}
+	}
+	flush()
+
+	if !styled {
+		return plain.String(), nil
+	}
+	return plain.String(), spans
+}
+
+func applySGR(style ansiStyle, params string) ansiStyle {
+	if params == "" {
+		return ansiStyle{}
+	}
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		code, err := strconv.Atoi(codes[i])
+		if err != nil {
+			continue
+		}
+		switch {
+		case code == 0:
+			style = ansiStyle{}
+		case code == 1:
+			style.bold = true
+		case code == 3:
+			style.italic = true
+		case code == 4:
+			style.underline = true
+		case code == 22:
+			style.bold = false
+		case code == 23:
+			style.italic = false
+		case code == 24:
+			style.underline = false
+		case code >= 30 && code <= 37:
+			style.fg = ansiColorNames[code-30]
+		case code == 39:
+			style.fg = ""
+		case code >= 40 && code <= 47:
+			style.bg = ansiColorNames[code-40]
+		case code == 49:
+			style.bg = ""
+		case code >= 90 && code <= 97:
+			style.fg = "bright-" + ansiColorNames[code-90]
+		case code >= 100 && code <= 107:
+			style.bg = "bright-" + ansiColorNames[code-100]
+		case code == 38 || code == 48:
+			color, used := extendedColor(codes[i+1:])
+			i += used
+			if code == 38 {
+				style.fg = color
+			} else {
+				style.bg = color
+			}
+		}
+	}
+	return style
+}
+
+// extendedColor decodes "5;n" (256 colors) and "2;r;g;b" (true color). It
+// returns the color and how many parameters it consumed.
+func extendedColor(params []string) (string, int) {
+	if len(params) >= 2 && params[0] == "5" {
+		n, err := strconv.Atoi(params[1])
+		if err != nil || n < 0 || n > 255 {
+			return "", 2
+		}
+		return color256(n), 2
+	}
+	if len(params) >= 4 && params[0] == "2" {
+		rgb := [3]int{}
+		for j := range rgb {
+			value, err := strconv.Atoi(params[j+1])
+			if err != nil || value < 0 || value > 255 {
+				return "", 4
+			}
+			rgb[j] = value
+		}
+		return fmt.Sprintf("#%02x%02x%02x", rgb[0], rgb[1], rgb[2]), 4
+	}
+	return "", len(params)
+}
+
+func color256(n int) string {
+	switch {
+	case n < 8:
+		return ansiColorNames[n]
+	case n < 16:
+		return "bright-" + ansiColorNames[n-8]
+	case n < 232:
+		n -= 16
+		levels := []int{0, 95, 135, 175, 215, 255}
+		return fmt.Sprintf("#%02x%02x%02x", levels[n/36], levels[(n/6)%6], levels[n%6])
+	}
+	gray := 8 + (n-232)*10
+	return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray)
+}
@@ -0,0 +1,45 @@
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseANSIPlainLine(t *testing.T) {
+	text, spans := parseANSI("[Server thread/INFO]: Done (1.234s)!")
+	if text != "[Server thread/INFO]: Done (1.234s)!" || spans != nil {
+		t.Errorf("plain line changed: %q %v", text, spans)
+	}
+}
+
+func TestParseANSIColors(t *testing.T) {
+	text, spans := parseANSI("\x1b[0;31;1mError\x1b[0m: \x1b[38;2;255;170;0mgold\x1b[m\r")
+	if text != "Error: gold" {
+		t.Errorf("unexpected text %q", text)
+	}
+
+	expected := []ConsoleSpan{
+		{Text: "Error", Fg: "red", Bold: true},
+		{Text: ": "},
+		{Text: "gold", Fg: "#ffaa00"},
+	}
+	if !reflect.DeepEqual(spans, expected) {
+		t.Errorf("unexpected spans %+v", spans)
+	}
+}
+
+func TestParseANSIDropsCursorSequences(t *testing.T) {
+	text, spans := parseANSI("\r\x1b[K>\x1b[2D\x1b]0;title\aready")
+	if text != ">ready" || spans != nil {
+		t.Errorf("unexpected result %q %v", text, spans)
+	}
+}
+
+func TestColor256(t *testing.T) {
+	cases := map[int]string{1: "red", 9: "bright-red", 196: "#ff0000", 232: "#080808"}
+	for n, expected := range cases {
+		if color := color256(n); color != expected {
+			t.Errorf("color256(%d) = %s, expected %s", n, color, expected)
+		}
+	}
+}
@@ -12,12 +12,62 @@ import (
 type AppConfig struct {
 	MinecraftServerConfig MinecraftServerConfig
 	WebAppConfig          WebAppConfig
+	JavaConfig            JavaConfig
+	DownloadConfig        DownloadConfig
+	BackupConfig          BackupConfig
+	Instances             []InstanceConfig
 }
 
 type WebAppConfig struct {
 	Port string
 }
 
+// DownloadConfig overrides the base URLs of the server download APIs,
+// the official ones are used when empty. CacheDir is where API responses
+// and server jars are kept, "./cache" when empty.
+type DownloadConfig struct {
+	VanillaManifestUrl string
+	PaperApiUrl        string
+	FabricMetaUrl      string
+	CacheDir           string
+}
+
+// BackupConfig is where world backups are kept, "./backups" when empty,
+// and the archive format of new backups, "tar.zst", "zip" or "incremental".
+type BackupConfig struct {
+	BackupsDir string
+	Format     string
+	// Where backups are copied to once made, as [[BackupConfig.Targets]].
+	Targets []BackupTargetConfig
+}
+
+// BackupTargetConfig is a place backups are copied to. Type is "local",
+// "s3" or "sftp", each uses its own fields.
+type BackupTargetConfig struct {
+	Name string
+	Type string
+	// local: a folder, on another disk or a mount.
+	Path string
+	// s3: Endpoint is the URL of the service, like "https://s3.amazonaws.com"
+	// or "http://localhost:9000". Region is "us-east-1" when empty, keys are
+	// stored under Prefix in Bucket.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// sftp: Address is host:port, port 22 when missing. HostKey is the
+	// public key of the server as in known_hosts or authorized_keys, the
+	// user logs in with Password or the key in PrivateKeyPath. Backups go
+	// in the Path folder.
+	Address        string
+	User           string
+	Password       string
+	PrivateKeyPath string
+	HostKey        string
+}
+
 type MinecraftServerConfig struct {
 	PathToMcServers        string
 	MaxAllowedRam          string
@@ -52,8 +102,10 @@ func structToMap(s interface{}) map[string]map[string]string {
 }
 
 func DecodeConfig() {
-	_, err := toml.DecodeFile("./app_settings.toml", &SavedAppConfig)
+	var config AppConfig
+	_, err := toml.DecodeFile("./app_settings.toml", &config)
 	Check(err)
+	SavedAppConfig = config
 }
 
 func EncodeConfig() {
@@ -0,0 +1,19 @@
+package backend
+
+// BackupRetention decides which backups of an instance survive pruning:
+// the newest KeepLast, plus the newest of each of the last KeepDaily days,
+// KeepWeekly weeks and KeepMonthly months, while the total stays under
+// MaxTotalBytes. Zero disables a rule, a policy without rules keeps every
+// backup.
+type BackupRetention struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	// 0 for no limit.
+	MaxTotalBytes int64
+}
+
+func (retention BackupRetention) Enabled() bool {
+	return retention != BackupRetention{}
+}
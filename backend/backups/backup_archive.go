@@ -0,0 +1,246 @@
+package backups
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Held by the running server, restoring it would lock the world out.
+const sessionLockName = "session.lock"
+
+// writeArchive writes the worlds folders of directory to w in format,
+// with paths relative to directory.
+func writeArchive(w io.Writer, format string, directory string, worlds []string) error {
+	switch format {
+	case FormatTarZst:
+		return writeTarZst(w, directory, worlds)
+	case FormatZip:
+		return writeZip(w, directory, worlds)
+	}
+	return fmt.Errorf("unknown backup format %q", format)
+}
+
+// walkWorlds calls add for every directory and regular file of the worlds.
+func walkWorlds(directory string, worlds []string, add func(name string, path string, info fs.FileInfo) error) error {
+	for _, world := range worlds {
+		err := filepath.Walk(filepath.Join(directory, world), func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Name() == sessionLockName || !(info.IsDir() || info.Mode().IsRegular()) {
+				return nil
+			}
+			name, err := filepath.Rel(directory, path)
+			if err != nil {
+				return err
+			}
+			return add(filepath.ToSlash(name), path, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTarZst(w io.Writer, directory string, worlds []string) error {
+	compressor, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	archive := tar.NewWriter(compressor)
+
+	err = walkWorlds(directory, worlds, func(name string, path string, info fs.FileInfo) error {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return copyFileTo(archive, path, info.Size())
+	})
+	if err != nil {
+		compressor.Close()
+		return err
+	}
+	if err := archive.Close(); err != nil {
+		compressor.Close()
+		return err
+	}
+	return compressor.Close()
+}
+
+func writeZip(w io.Writer, directory string, worlds []string) error {
+	archive := zip.NewWriter(w)
+
+	err := walkWorlds(directory, worlds, func(name string, path string, info fs.FileInfo) error {
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+		}
+		entry, err := archive.CreateHeader(header)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		return copyFileTo(entry, path, info.Size())
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// copyFileTo copies the size bytes a file had when it was listed, a tar
+// header can't grow afterwards.
+func copyFileTo(w io.Writer, path string, size int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	copied, err := io.Copy(w, io.LimitReader(file, size))
+	if err != nil {
+		return err
+	}
+	if copied != size {
+		return fmt.Errorf("%s shrank while it was archived", path)
+	}
+	return nil
+}
+
+// extractArchive writes the entries of the archive at path for which keep
+// is true under destination. Entries that would land outside of it are
+// refused.
+func extractArchive(path string, format string, destination string, keep func(name string) bool) error {
+	switch format {
+	case FormatTarZst:
+		return extractTarZst(path, destination, keep)
+	case FormatZip:
+		return extractZip(path, destination, keep)
+	case FormatIncremental:
+		return extractSnapshot(path, destination, keep)
+	}
+	return fmt.Errorf("unknown backup format %q", format)
+}
+
+// entryPath is where an archive entry goes under destination.
+func entryPath(destination string, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if !filepath.IsLocal(clean) {
+		return "", fmt.Errorf("archive entry %q is outside of the world", name)
+	}
+	return filepath.Join(destination, clean), nil
+}
+
+func extractTarZst(path string, destination string, keep func(name string) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decompressor, err := zstd.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer decompressor.Close()
+
+	archive := tar.NewReader(decompressor)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(header.Name, "/")
+		if !keep(name) {
+			continue
+		}
+		target, err := entryPath(destination, name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = writeEntry(target, fs.FileMode(header.Mode).Perm(), archive)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(path string, destination string, keep func(name string) bool) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	for _, entry := range archive.File {
+		name := strings.TrimSuffix(entry.Name, "/")
+		if !keep(name) {
+			continue
+		}
+		target, err := entryPath(destination, name)
+		if err != nil {
+			return err
+		}
+		if entry.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		reader, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		err = writeEntry(target, entry.Mode().Perm(), reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeEntry(target string, mode fs.FileMode, content io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode|0200)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, content); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,208 @@
+package backups
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"time"
+)
+
+// How long a running server has to answer "save-all flush".
+const DEFAULT_SAVE_TIMEOUT = 2 * time.Minute
+
+// Printed once save-all has written every chunk.
+var savedLine = regexp.MustCompile(`Saved the game`)
+
+// ErrBackupRunning is returned while the instance is backed up, restored
+// or upgraded, the lock is shared with the upgrades of the server.
+var ErrBackupRunning = backend.ErrInstanceBusy
+
+// BackupOptions is how a backup is made. An empty Format is the one of
+// the app settings, an empty Trigger is TriggerManual.
+type BackupOptions struct {
+	Format  string
+	Trigger string
+	// Zero means DEFAULT_SAVE_TIMEOUT.
+	SaveTimeout time.Duration
+}
+
+// withDefaults fills the empty options and checks the format.
+func (options BackupOptions) withDefaults() (BackupOptions, error) {
+	if options.Format == "" {
+		options.Format = backend.SavedAppConfig.BackupConfig.Format
+	}
+	if options.Format == "" {
+		options.Format = FormatTarZst
+	}
+	if !validFormat(options.Format) {
+		return options, fmt.Errorf("unknown backup format %q, use %s, %s or %s", options.Format, FormatTarZst, FormatZip, FormatIncremental)
+	}
+	if options.Trigger == "" {
+		options.Trigger = TriggerManual
+	}
+	if options.SaveTimeout <= 0 {
+		options.SaveTimeout = DEFAULT_SAVE_TIMEOUT
+	}
+	return options, nil
+}
+
+// CreateBackup archives the worlds of an instance. A running server is
+// told to stop saving and to flush the world to disk first, and to save
+// again once the archive is written. A stopped server is archived as is.
+// The backups of the instance are then pruned by its retention policy, and
+// the new one is copied to the backup targets in the background, without
+// holding the instance.
+func CreateBackup(ctx context.Context, instanceID string, options BackupOptions) (Backup, error) {
+	mc, err := backend.Instances.Get(instanceID)
+	if err != nil {
+		return Backup{}, err
+	}
+	if !backend.LockInstance(instanceID) {
+		return Backup{}, ErrBackupRunning
+	}
+	defer backend.UnlockInstance(instanceID)
+
+	backup, err := createBackup(ctx, mc, options)
+	if err != nil {
+		return backup, err
+	}
+	if _, err := pruneBackups(instanceID); err != nil {
+		fmt.Printf("\nCannot prune the backups of %s: %v", instanceID, err)
+	}
+	if len(backend.SavedAppConfig.BackupConfig.Targets) > 0 {
+		targetCopies.Add(1)
+		go func() {
+			defer targetCopies.Done()
+			copyToTargets(context.WithoutCancel(ctx), backup)
+		}()
+	}
+	return backup, nil
+}
+
+// createBackup is CreateBackup for a locked instance.
+func createBackup(ctx context.Context, mc *backend.McServer, options BackupOptions) (Backup, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return Backup{}, err
+	}
+	instanceID := mc.ID()
+	config := mc.Config()
+	worlds := backend.WorldDirectories(config.Directory)
+	if len(worlds) == 0 {
+		return Backup{}, errors.New("the instance has no world to back up")
+	}
+
+	started := time.Now()
+	backup := Backup{
+		ID:            newBackupID(instanceID, started),
+		Instance:      instanceID,
+		Format:        options.Format,
+		Worlds:        worlds,
+		ServerType:    config.ServerType,
+		ServerVersion: config.MinecraftVersion,
+		Trigger:       options.Trigger,
+		CreatedAt:     started,
+	}
+	backup.File = backup.ID + "." + backup.Format
+	if backup.Format == FormatIncremental {
+		backup.File = backup.ID + ".snapshot"
+	}
+
+	switch state := mc.State(); {
+	case state == backend.StateRunning:
+		resume, err := pauseSaving(ctx, mc, options.SaveTimeout)
+		if err != nil {
+			return Backup{}, err
+		}
+		defer resume()
+		backup.Online = true
+	case state.IsAlive():
+		return Backup{}, fmt.Errorf("the server is %s, try again once it is running or stopped", state)
+	}
+
+	if err := os.MkdirAll(instanceBackupsDir(instanceID), 0755); err != nil {
+		return Backup{}, err
+	}
+	if backup.Format == FormatIncremental {
+		backup.Size, backup.SHA256, err = writeSnapshotFile(backup.Path(), instanceRepository(instanceID), config.Directory, worlds)
+	} else {
+		backup.Size, backup.SHA256, err = writeArchiveFile(backup.Path(), backup.Format, config.Directory, worlds)
+	}
+	if err != nil {
+		return Backup{}, fmt.Errorf("archiving the worlds: %w", err)
+	}
+	backup.DurationMs = time.Since(started).Milliseconds()
+	if err := writeBackupMetadata(backup); err != nil {
+		os.Remove(backup.Path())
+		return Backup{}, err
+	}
+
+	fmt.Printf("\nBackup %s of instance %s written, %d bytes in %dms", backup.ID, instanceID, backup.Size, backup.DurationMs)
+	return backup, nil
+}
+
+// pauseSaving sends save-off then save-all flush and waits for the server
+// to log that the game is saved, the world files then stay still. The
+// returned function turns saving back on.
+func pauseSaving(ctx context.Context, mc *backend.McServer, timeout time.Duration) (func(), error) {
+	seq := mc.ConsoleSeq()
+	if err := mc.SendCommand("save-off"); err != nil {
+		return nil, err
+	}
+	resume := func() {
+		if err := mc.SendCommand("save-on"); err != nil {
+			fmt.Printf("\nCannot turn saving back on for %s: %v", mc.ID(), err)
+		}
+	}
+	if err := mc.SendCommand("save-all flush"); err != nil {
+		resume()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if _, err := mc.WaitConsoleLine(ctx, seq, savedLine); err != nil {
+		resume()
+		return nil, fmt.Errorf("the server didn't save the world within %s", timeout)
+	}
+	return resume, nil
+}
+
+// writeArchiveFile writes the archive next to path and moves it there
+// once complete, and returns its size and SHA-256.
+func writeArchiveFile(path string, format string, directory string, worlds []string) (int64, string, error) {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, "", err
+	}
+	hash := sha256.New()
+	counter := &countingWriter{}
+	err = writeArchive(io.MultiWriter(file, hash, counter), format, directory, worlds)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return 0, "", err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return 0, "", err
+	}
+	return counter.n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
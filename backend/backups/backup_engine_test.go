@@ -0,0 +1,272 @@
+package backups
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"Skyfield1888/WebMine/backend/internal/fakeserver"
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestMain(m *testing.M) {
+	fakeserver.Main()
+	os.Exit(m.Run())
+}
+
+const steveUUID = "8667ba71-b85a-4004-af54-457a9734eed7"
+
+// fakeInstance registers an instance that runs a fakeserver with flags
+// instead of java, with properties in its server.properties when not nil.
+// The instance is killed and removed at the end of the test.
+func fakeInstance(t *testing.T, config backend.InstanceConfig, properties map[string]string, flags ...string) *backend.McServer {
+	previous := backend.LaunchCommandFor
+	backend.LaunchCommandFor = func(backend.InstanceConfig) (backend.LaunchCommand, error) {
+		path, args, env := fakeserver.Command(flags...)
+		return backend.LaunchCommand{Path: path, Args: args, Env: env}, nil
+	}
+	t.Cleanup(func() { backend.LaunchCommandFor = previous })
+
+	if config.Directory == "" {
+		config.Directory = t.TempDir()
+	}
+	if properties != nil {
+		fakeserver.WriteProperties(t, config.Directory, properties)
+	}
+	mc, err := backend.Instances.Create(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if mc.State().IsAlive() {
+			mc.Kill()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			mc.WaitState(ctx, backend.StateStopped, backend.StateCrashed)
+		}
+		backend.Instances.Delete(config.ID)
+	})
+	return mc
+}
+
+// backupInstance creates a stopped instance running a fakeserver, with a
+// world of a few files. It works in a temporary directory, backups go to
+// ./backups there.
+func backupInstance(t *testing.T, id string) *backend.McServer {
+	t.Chdir(t.TempDir())
+	directory := t.TempDir()
+	files := map[string]string{
+		"world/level.dat":                        "level",
+		"world/region/r.0.0.mca":                 "region 0 0",
+		"world/region/r.-1.0.mca":                "region -1 0",
+		"world/playerdata/" + steveUUID + ".dat": "steve",
+		"world/session.lock":                     "lock",
+		"world_nether/DIM-1/region/r.0.0.mca":    "nether",
+	}
+	for name, content := range files {
+		path := filepath.Join(directory, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return fakeInstance(t, backend.InstanceConfig{ID: id, Directory: directory, MinecraftVersion: "1.21.10", ServerType: "vanilla"}, nil)
+}
+
+func waitRunning(t *testing.T, mc *backend.McServer) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := mc.WaitState(ctx, backend.StateRunning); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// archiveFiles reads the files of a backup archive.
+func archiveFiles(t *testing.T, backup Backup) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	switch backup.Format {
+	case FormatTarZst:
+		file, err := os.Open(backup.Path())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		decompressor, err := zstd.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer decompressor.Close()
+		archive := tar.NewReader(decompressor)
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Typeflag == tar.TypeReg {
+				content, _ := io.ReadAll(archive)
+				files[header.Name] = string(content)
+			}
+		}
+	case FormatZip:
+		archive, err := zip.OpenReader(backup.Path())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer archive.Close()
+		for _, entry := range archive.File {
+			if entry.FileInfo().IsDir() {
+				continue
+			}
+			reader, _ := entry.Open()
+			content, _ := io.ReadAll(reader)
+			reader.Close()
+			files[entry.Name] = string(content)
+		}
+	}
+	return files
+}
+
+func TestBackupRunningServer(t *testing.T) {
+	mc := backupInstance(t, "backup-running")
+	mc.Start()
+	waitRunning(t, mc)
+	seq := mc.ConsoleSeq()
+
+	backup, err := CreateBackup(context.Background(), "backup-running", BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !backup.Online || backup.Format != FormatTarZst || backup.Trigger != TriggerManual || backup.ServerVersion != "1.21.10" {
+		t.Errorf("unexpected backup %+v", backup)
+	}
+	files := archiveFiles(t, backup)
+	if files["world/region/r.-1.0.mca"] != "region -1 0" || files["world_nether/DIM-1/region/r.0.0.mca"] != "nether" {
+		t.Errorf("worlds missing from the archive: %v", files)
+	}
+	if _, found := files["world/session.lock"]; found {
+		t.Error("session.lock was archived")
+	}
+	if info, _ := os.Stat(backup.Path()); info == nil || info.Size() != backup.Size {
+		t.Errorf("size %d recorded for %v", backup.Size, info)
+	}
+
+	// Saving was paused around the archive, in this order.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, text := range []string{"Automatic saving is now disabled", "Saved the game", "Automatic saving is now enabled"} {
+		line, err := mc.WaitConsoleLine(ctx, seq, regexp.MustCompile(regexp.QuoteMeta(text)))
+		if err != nil {
+			t.Fatalf("no %q in the console", text)
+		}
+		seq = line.Seq
+	}
+}
+
+func TestBackupStoppedServer(t *testing.T) {
+	mc := backupInstance(t, "backup-stopped")
+
+	first, err := CreateBackup(context.Background(), "backup-stopped", BackupOptions{Format: FormatZip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Online || mc.ConsoleSeq() != 0 {
+		t.Errorf("a stopped server was sent commands: %+v", first)
+	}
+	if files := archiveFiles(t, first); files["world/playerdata/"+steveUUID+".dat"] != "steve" || len(files) != 5 {
+		t.Errorf("unexpected archive %v", files)
+	}
+
+	second, err := CreateBackup(context.Background(), "backup-stopped", BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID == first.ID {
+		t.Errorf("two backups named %s", first.ID)
+	}
+	listed, err := ListBackups("backup-stopped")
+	if err != nil || len(listed) != 2 || listed[0].ID != second.ID {
+		t.Errorf("listed %+v, %v", listed, err)
+	}
+
+	if err := DeleteBackup("backup-stopped", first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(first.Path()); !os.IsNotExist(err) {
+		t.Error("the archive of a deleted backup is still there")
+	}
+	if _, err := GetBackup("backup-stopped", "../backup-stopped"); err != ErrBackupNotFound {
+		t.Errorf("got %v for an invalid id", err)
+	}
+}
+
+func TestBackupHandlers(t *testing.T) {
+	backupInstance(t, "backup-http")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/backups", BackupsHandler)
+	mux.HandleFunc("GET /backups/{id}/download", BackupDownloadHandler)
+	mux.HandleFunc("DELETE /backups/{id}", DeleteBackupHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	response, err := http.PostForm(server.URL+"/backups", map[string][]string{"instance": {"backup-http"}, "format": {"zip"}})
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("create answered %v, %v", response, err)
+	}
+	response.Body.Close()
+	listed, _ := ListBackups("backup-http")
+	if len(listed) != 1 {
+		t.Fatalf("listed %+v", listed)
+	}
+
+	response, err = http.Get(server.URL + "/backups/" + listed[0].ID + "/download?instance=backup-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if int64(len(downloaded)) != listed[0].Size {
+		t.Errorf("downloaded %d bytes of %d", len(downloaded), listed[0].Size)
+	}
+
+	if response, _ := http.Get(server.URL + "/backups/" + listed[0].ID + "/download?instance=missing"); response.StatusCode != http.StatusBadRequest {
+		t.Errorf("a download from a missing instance answered %d", response.StatusCode)
+	}
+	request, _ := http.NewRequest(http.MethodDelete, server.URL+"/backups/"+listed[0].ID+"?instance=missing", nil)
+	if response, _ := http.DefaultClient.Do(request); response.StatusCode != http.StatusBadRequest {
+		t.Errorf("a delete from a missing instance answered %d", response.StatusCode)
+	}
+
+	// Nothing is deleted while a backup, restore or prune runs.
+	backend.LockInstance("backup-http")
+	if err := DeleteBackup("backup-http", listed[0].ID); err != ErrBackupRunning {
+		t.Errorf("deleting during a backup gave %v", err)
+	}
+	backend.UnlockInstance("backup-http")
+
+	request, _ = http.NewRequest(http.MethodDelete, server.URL+"/backups/"+listed[0].ID+"?instance=backup-http", nil)
+	if response, err := http.DefaultClient.Do(request); err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("delete answered %v, %v", response, err)
+	}
+	if response, _ := http.Get(server.URL + "/backups/" + listed[0].ID + "/download?instance=backup-http"); response.StatusCode != http.StatusNotFound {
+		t.Errorf("a deleted backup answered %d", response.StatusCode)
+	}
+
+	if entries, _ := os.ReadDir(instanceBackupsDir("backup-http")); len(entries) != 0 {
+		t.Errorf("left behind %v", entries)
+	}
+}
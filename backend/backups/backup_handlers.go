@@ -0,0 +1,348 @@
+package backups
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// BackupsHandler lists the backups of an instance on GET, newest first,
+// and makes one on POST. Form values: instance and format, the one of the
+// app settings when empty.
+func BackupsHandler(w http.ResponseWriter, r *http.Request) {
+	instance := r.FormValue("instance")
+	if _, err := backend.Instances.Get(instance); err != nil {
+		backend.HtmlDetailedError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		backups, err := ListBackups(instance)
+		if err != nil {
+			backend.HtmlDetailedError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(backups)
+
+	case http.MethodPost:
+		fmt.Printf("\nBackup of %s requested from %s", instance, r.RemoteAddr)
+		// The backup goes on when the client gives up waiting.
+		backup, err := CreateBackup(context.WithoutCancel(r.Context()), instance, BackupOptions{Format: r.FormValue("format")})
+		if err != nil {
+			backend.HtmlDetailedError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(backup)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// BackupDownloadHandler sends the archive of backup {id} of instance.
+func BackupDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	instance := r.FormValue("instance")
+	if _, err := backend.Instances.Get(instance); err != nil {
+		backend.HtmlDetailedError(w, err)
+		return
+	}
+
+	backup, err := GetBackup(instance, r.PathValue("id"))
+	if err != nil {
+		backupError(w, err)
+		return
+	}
+	if backup.Format == FormatIncremental {
+		downloadSnapshot(w, backup)
+		return
+	}
+	file, err := os.Open(backup.Path())
+	if errors.Is(err, os.ErrNotExist) {
+		err = ErrBackupNotFound
+	}
+	if err != nil {
+		backupError(w, err)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s"`, backup.Instance, backup.File))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, backup.File, backup.CreatedAt, file)
+}
+
+// downloadSnapshot sends an incremental backup as a tar.zst archive, put
+// together from the repository as it is sent.
+func downloadSnapshot(w http.ResponseWriter, backup Backup) {
+	if _, err := os.Stat(backup.Path()); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = ErrBackupNotFound
+		}
+		backupError(w, err)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.%s"`, backup.Instance, backup.ID, FormatTarZst))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := writeSnapshotTarZst(w, backup); err != nil {
+		// Too late for an error status, the archive is left truncated.
+		fmt.Printf("\nDownload of backup %s of %s failed: %v", backup.ID, backup.Instance, err)
+	}
+}
+
+// DeleteBackupHandler removes backup {id} of instance.
+func DeleteBackupHandler(w http.ResponseWriter, r *http.Request) {
+	instance, id := r.FormValue("instance"), r.PathValue("id")
+	if _, err := backend.Instances.Get(instance); err != nil {
+		backend.HtmlDetailedError(w, err)
+		return
+	}
+
+	if err := DeleteBackup(instance, id); err != nil {
+		backupError(w, err)
+		return
+	}
+	fmt.Printf("\nBackup %s of %s deleted by %s", id, instance, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": "Backup " + id + " deleted",
+	})
+}
+
+// RestoreBackupHandler restores backup {id} into instance. Form values:
+// dimension (overworld, DIM-1 or DIM1) or player (a UUID) to restore only
+// that, restart=true to start the server afterwards and target to take the
+// backup from that backup target.
+func RestoreBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+
+	instance, id := r.FormValue("instance"), r.PathValue("id")
+	fmt.Printf("\nRestore of backup %s into %s requested from %s", id, instance, r.RemoteAddr)
+	result, err := RestoreBackup(context.WithoutCancel(r.Context()), instance, id, RestoreOptions{
+		Dimension: r.FormValue("dimension"),
+		Player:    r.FormValue("player"),
+		Restart:   r.FormValue("restart") == "true",
+		Target:    r.FormValue("target"),
+	})
+	if err != nil {
+		backupError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// UploadBackupHandler copies backup {id} of instance to the backup target
+// named target.
+func UploadBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+
+	instance, id, target := r.FormValue("instance"), r.PathValue("id"), r.FormValue("target")
+	fmt.Printf("\nUpload of backup %s of %s to %s requested from %s", id, instance, target, r.RemoteAddr)
+	backup, err := UploadBackup(context.WithoutCancel(r.Context()), instance, id, target)
+	if err != nil {
+		backupError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backup)
+}
+
+// TargetsHandler lists the backup targets of the app settings.
+func TargetsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ListTargets())
+}
+
+// RemoteBackupsHandler lists the backups of instance the backup target
+// named target has, newest first.
+func RemoteBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	backups, err := ListRemoteBackups(r.Context(), r.FormValue("instance"), r.FormValue("target"))
+	if err != nil {
+		backend.HtmlDetailedError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backups)
+}
+
+// PinBackupHandler pins backup {id} of instance, or unpins it with
+// pinned=false. Pinned backups are never pruned.
+func PinBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+
+	backup, err := SetPinned(r.FormValue("instance"), r.PathValue("id"), r.FormValue("pinned") != "false")
+	if err != nil {
+		backupError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backup)
+}
+
+// RetentionHandler returns the retention policy of an instance on GET and
+// changes it on POST. Form values: keep_last, keep_daily, keep_weekly,
+// keep_monthly and max_size, in bytes or with a K, M, G or T suffix. 0
+// disables a rule.
+func RetentionHandler(w http.ResponseWriter, r *http.Request) {
+	mc, err := backend.Instances.Get(r.FormValue("instance"))
+	if err != nil {
+		backend.HtmlDetailedError(w, err)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		err := backend.Instances.Update(mc.ID(), func(config *backend.InstanceConfig) error {
+			retention := config.BackupRetention
+			fields := map[string]*int{
+				"keep_last":    &retention.KeepLast,
+				"keep_daily":   &retention.KeepDaily,
+				"keep_weekly":  &retention.KeepWeekly,
+				"keep_monthly": &retention.KeepMonthly,
+			}
+			for name, field := range fields {
+				value := r.FormValue(name)
+				if value == "" {
+					continue
+				}
+				number, err := strconv.Atoi(value)
+				if err != nil || number < 0 {
+					return fmt.Errorf("%s should be a positive integer", name)
+				}
+				*field = number
+			}
+			if value := r.FormValue("max_size"); value != "" {
+				size, err := parseSize(value)
+				if err != nil {
+					return err
+				}
+				retention.MaxTotalBytes = size
+			}
+			config.BackupRetention = retention
+			return nil
+		})
+		if err != nil {
+			backend.HtmlDetailedError(w, err)
+			return
+		}
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mc.Config().BackupRetention)
+}
+
+// PruneHandler previews on GET what pruning the backups of instance would
+// remove and why, and prunes them on POST.
+func PruneHandler(w http.ResponseWriter, r *http.Request) {
+	instance := r.FormValue("instance")
+
+	switch r.Method {
+	case http.MethodGet:
+		decisions, err := PreviewPrune(instance)
+		if err != nil {
+			backend.HtmlDetailedError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(decisions)
+
+	case http.MethodPost:
+		pruned, err := PruneBackups(instance)
+		if err != nil {
+			backend.HtmlDetailedError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pruned)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// VerifyRepositoryHandler checks the chunks of the incremental backups of
+// instance.
+func VerifyRepositoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := VerifyRepository(r.FormValue("instance"))
+	if err != nil {
+		backend.HtmlDetailedError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// GarbageCollectHandler removes the chunks no incremental backup of
+// instance references.
+func GarbageCollectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+
+	report, err := CollectGarbage(r.FormValue("instance"))
+	if err != nil {
+		backend.HtmlDetailedError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// parseSize reads a size in bytes, "20G" or "512M" style suffixes are
+// powers of 1024.
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	if unit, found := units[strings.ToUpper(value[len(value)-1:])]; found {
+		multiplier = unit
+		value = value[:len(value)-1]
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("%q is not a size, use bytes or a K, M, G or T suffix", value)
+	}
+	return number * multiplier, nil
+}
+
+func backupError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrBackupNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": ErrBackupNotFound.Error()})
+		return
+	}
+	backend.HtmlDetailedError(w, err)
+}
@@ -0,0 +1,628 @@
+package backups
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content defined chunks of the files that aren't regions are cut after
+// minChunkSize bytes where the rolling hash matches chunkMask, about every
+// 512KiB, and at maxChunkSize at the latest.
+const (
+	minChunkSize = 64 << 10
+	maxChunkSize = 2 << 20
+	chunkMask    = uint64(1<<19-1) << (64 - 19)
+)
+
+// Region files are made of 4KiB sectors, the first two hold where each
+// Minecraft chunk is and when it was saved.
+const (
+	regionSectorSize = 4096
+	regionHeaderSize = 2 * regionSectorSize
+)
+
+const snapshotVersion = 1
+
+// The hex SHA-256 a chunk is named after.
+var chunkHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// gear is the table of the rolling hash, derived from SHA-256 so it never
+// changes and chunks made by different versions still match.
+var gear = func() (table [256]uint64) {
+	for i := range table {
+		sum := sha256.Sum256([]byte{byte(i)})
+		table[i] = binary.LittleEndian.Uint64(sum[:])
+	}
+	return table
+}()
+
+// EncodeAll and DecodeAll can be used concurrently.
+var (
+	chunkEncoder, _ = zstd.NewWriter(nil)
+	chunkDecoder, _ = zstd.NewReader(nil)
+)
+
+// snapshotManifest is what an incremental backup stores in its .snapshot
+// file, zstd compressed: every folder and file of the worlds, the files
+// as the SHA-256 of their chunks in the repository.
+type snapshotManifest struct {
+	Version int            `json:"version"`
+	Files   []snapshotFile `json:"files"`
+}
+
+type snapshotFile struct {
+	Name    string      `json:"name"`
+	Dir     bool        `json:"dir,omitempty"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	Size    int64       `json:"size"`
+	Chunks  []string    `json:"chunks,omitempty"`
+}
+
+// repository stores the chunks of the incremental backups of an instance
+// once each, zstd compressed and named after the SHA-256 of their content.
+type repository struct {
+	dir string
+}
+
+func instanceRepository(instance string) repository {
+	return repository{dir: filepath.Join(instanceBackupsDir(instance), "repository")}
+}
+
+func (repo repository) chunkPath(hash string) string {
+	return filepath.Join(repo.dir, "chunks", hash[:2], hash)
+}
+
+// putChunk stores data unless the repository has it, and returns its hash
+// and the bytes it added.
+func (repo repository) putChunk(data []byte) (string, int64, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	path := repo.chunkPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, 0, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", 0, err
+	}
+	compressed := chunkEncoder.EncodeAll(data, nil)
+	if err := os.WriteFile(path+".tmp", compressed, 0644); err != nil {
+		os.Remove(path + ".tmp")
+		return "", 0, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return "", 0, err
+	}
+	return hash, int64(len(compressed)), nil
+}
+
+// readChunk returns the content of a chunk, checked against its hash.
+func (repo repository) readChunk(hash string) ([]byte, error) {
+	compressed, err := os.ReadFile(repo.chunkPath(hash))
+	if err != nil {
+		return nil, err
+	}
+	return decodeChunk(compressed, hash)
+}
+
+// checkChunk tells whether the file at path holds chunk hash.
+func checkChunk(path string, hash string) error {
+	compressed, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	_, err = decodeChunk(compressed, hash)
+	return err
+}
+
+func decodeChunk(compressed []byte, hash string) ([]byte, error) {
+	data, err := chunkDecoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", hash, err)
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != hash {
+		return nil, fmt.Errorf("chunk %s is corrupted", hash)
+	}
+	return data, nil
+}
+
+// chunkHashes lists the chunks in the repository.
+func (repo repository) chunkHashes() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(repo.dir, "chunks", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	hashes := []string{}
+	for _, path := range paths {
+		if !strings.HasSuffix(path, ".tmp") {
+			hashes = append(hashes, filepath.Base(path))
+		}
+	}
+	return hashes, nil
+}
+
+// cutPoint returns the length of the next content defined chunk of data,
+// which is either full or the end of the file.
+func cutPoint(data []byte) int {
+	if len(data) <= minChunkSize {
+		return len(data)
+	}
+	limit := min(len(data), maxChunkSize)
+	var hash uint64
+	for i := minChunkSize; i < limit; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if hash&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return limit
+}
+
+// regionBoundaries returns where the Minecraft chunks of a region file of
+// size bytes start and end, from its header. Each of them becomes its own
+// chunk, so a region costs only the Minecraft chunks saved since the last
+// backup. It returns nil when header isn't the one of a region.
+func regionBoundaries(header []byte, size int64) []int64 {
+	if len(header) < regionHeaderSize || size < regionHeaderSize {
+		return nil
+	}
+	boundaries := []int64{0, regionHeaderSize}
+	for i := 0; i < 1024; i++ {
+		entry := binary.BigEndian.Uint32(header[i*4:])
+		offset, count := int64(entry>>8), int64(entry&0xff)
+		if offset == 0 && count == 0 {
+			continue
+		}
+		if offset < 2 {
+			return nil
+		}
+		for _, boundary := range []int64{offset * regionSectorSize, (offset + count) * regionSectorSize} {
+			if boundary < size {
+				boundaries = append(boundaries, boundary)
+			}
+		}
+	}
+	slices.Sort(boundaries)
+	return slices.Compact(boundaries)
+}
+
+// splitFile calls add with the chunks of the first size bytes of a file:
+// the Minecraft chunks of .mca regions, content defined chunks otherwise.
+func splitFile(path string, size int64, add func(chunk []byte) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var boundaries []int64
+	if strings.HasSuffix(path, ".mca") {
+		header := make([]byte, regionHeaderSize)
+		if _, err := file.ReadAt(header, 0); err == nil {
+			boundaries = regionBoundaries(header, size)
+		}
+	}
+
+	reader := bufio.NewReaderSize(io.LimitReader(file, size), maxChunkSize)
+	buffer := make([]byte, maxChunkSize)
+	var read int64
+	if boundaries != nil {
+		boundaries = append(boundaries, size)
+		for i := 1; i < len(boundaries); i++ {
+			// Oversized chunks live in .mcc files, a region has none over
+			// 255 sectors, but a damaged header could say otherwise.
+			for start := boundaries[i-1]; start < boundaries[i]; start += maxChunkSize {
+				length := min(boundaries[i]-start, maxChunkSize)
+				if _, err := io.ReadFull(reader, buffer[:length]); err != nil {
+					return fmt.Errorf("%s shrank while it was backed up", path)
+				}
+				if err := add(buffer[:length]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	filled := 0
+	for {
+		n, err := io.ReadFull(reader, buffer[filled:])
+		filled += n
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if filled == 0 {
+			break
+		}
+		cut := cutPoint(buffer[:filled])
+		if err := add(buffer[:cut]); err != nil {
+			return err
+		}
+		read += int64(cut)
+		filled = copy(buffer, buffer[cut:filled])
+	}
+	if read != size {
+		return fmt.Errorf("%s shrank while it was backed up", path)
+	}
+	return nil
+}
+
+// writeSnapshotFile stores the worlds of directory in the repository and
+// their manifest at path, and returns the bytes it added to the backups
+// and the SHA-256 of the manifest.
+func writeSnapshotFile(path string, repo repository, directory string, worlds []string) (int64, string, error) {
+	manifest := snapshotManifest{Version: snapshotVersion, Files: []snapshotFile{}}
+	var added int64
+	err := walkWorlds(directory, worlds, func(name string, path string, info fs.FileInfo) error {
+		entry := snapshotFile{Name: name, Dir: info.IsDir(), Mode: info.Mode().Perm(), ModTime: info.ModTime()}
+		if !info.IsDir() {
+			entry.Size = info.Size()
+			entry.Chunks = []string{}
+			err := splitFile(path, info.Size(), func(chunk []byte) error {
+				hash, stored, err := repo.putChunk(chunk)
+				entry.Chunks = append(entry.Chunks, hash)
+				added += stored
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		manifest.Files = append(manifest.Files, entry)
+		return nil
+	})
+	if err != nil {
+		return 0, "", err
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return 0, "", err
+	}
+	compressed := chunkEncoder.EncodeAll(data, nil)
+	if err := os.WriteFile(path+".tmp", compressed, 0644); err != nil {
+		os.Remove(path + ".tmp")
+		return 0, "", err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return 0, "", err
+	}
+	sum := sha256.Sum256(compressed)
+	return added + int64(len(compressed)), hex.EncodeToString(sum[:]), nil
+}
+
+func readSnapshot(path string) (snapshotManifest, error) {
+	var manifest snapshotManifest
+	compressed, err := os.ReadFile(path)
+	if err != nil {
+		return manifest, err
+	}
+	data, err := chunkDecoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return manifest, fmt.Errorf("snapshot %s: %w", filepath.Base(path), err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("snapshot %s: %w", filepath.Base(path), err)
+	}
+	if manifest.Version != snapshotVersion {
+		return manifest, fmt.Errorf("snapshot %s has unknown version %d", filepath.Base(path), manifest.Version)
+	}
+	// Hashes name files in the repository and on the targets, a snapshot
+	// fetched from a target can't point anywhere else.
+	for _, file := range manifest.Files {
+		for _, hash := range file.Chunks {
+			if !chunkHashPattern.MatchString(hash) {
+				return manifest, fmt.Errorf("snapshot %s has an invalid chunk hash %q", filepath.Base(path), hash)
+			}
+		}
+	}
+	return manifest, nil
+}
+
+// referencedSize returns the bytes an incremental backup takes with all
+// its chunks, the ones other backups share included: what its Size would
+// be if it was the only backup.
+func referencedSize(backup Backup) (int64, error) {
+	info, err := os.Stat(backup.Path())
+	if err != nil {
+		return 0, err
+	}
+	manifest, err := readSnapshot(backup.Path())
+	if err != nil {
+		return 0, err
+	}
+	repo := instanceRepository(backup.Instance)
+	size := info.Size()
+	counted := map[string]bool{}
+	for _, file := range manifest.Files {
+		for _, hash := range file.Chunks {
+			if counted[hash] {
+				continue
+			}
+			counted[hash] = true
+			chunk, err := os.Stat(repo.chunkPath(hash))
+			if err != nil {
+				return 0, err
+			}
+			size += chunk.Size()
+		}
+	}
+	return size, nil
+}
+
+// writeSnapshotContent writes the chunks of file to w.
+func writeSnapshotContent(w io.Writer, repo repository, file snapshotFile) error {
+	var written int64
+	for _, hash := range file.Chunks {
+		data, err := repo.readChunk(hash)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.Name, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		written += int64(len(data))
+	}
+	if written != file.Size {
+		return fmt.Errorf("%s: the chunks hold %d bytes of %d", file.Name, written, file.Size)
+	}
+	return nil
+}
+
+// extractSnapshot is extractArchive for incremental backups, whose
+// repository is next to the snapshot.
+func extractSnapshot(path string, destination string, keep func(name string) bool) error {
+	manifest, err := readSnapshot(path)
+	if err != nil {
+		return err
+	}
+	repo := repository{dir: filepath.Join(filepath.Dir(path), "repository")}
+	for _, file := range manifest.Files {
+		if !keep(file.Name) {
+			continue
+		}
+		target, err := entryPath(destination, file.Name)
+		if err != nil {
+			return err
+		}
+		if file.Dir {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(writeSnapshotContent(writer, repo, file))
+		}()
+		err = writeEntry(target, file.Mode, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSnapshotTarZst writes an incremental backup to w as a tar.zst
+// archive, like the ones of FormatTarZst.
+func writeSnapshotTarZst(w io.Writer, backup Backup) error {
+	manifest, err := readSnapshot(backup.Path())
+	if err != nil {
+		return err
+	}
+	repo := instanceRepository(backup.Instance)
+	compressor, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	archive := tar.NewWriter(compressor)
+	for _, file := range manifest.Files {
+		header := &tar.Header{Name: file.Name, Mode: int64(file.Mode), ModTime: file.ModTime, Size: file.Size, Typeflag: tar.TypeReg}
+		if file.Dir {
+			header.Name += "/"
+			header.Typeflag = tar.TypeDir
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			compressor.Close()
+			return err
+		}
+		if !file.Dir {
+			if err := writeSnapshotContent(archive, repo, file); err != nil {
+				compressor.Close()
+				return err
+			}
+		}
+	}
+	if err := archive.Close(); err != nil {
+		compressor.Close()
+		return err
+	}
+	return compressor.Close()
+}
+
+// snapshotChunks returns the chunks referenced by each snapshot of an
+// instance, by backup ID. The .snapshot files are read rather than the
+// list of backups, a backup whose metadata can't be read still holds its
+// chunks. A snapshot that can't be read fails it, its chunks would be
+// taken for garbage.
+func snapshotChunks(instance string) (map[string][]string, error) {
+	paths, err := filepath.Glob(filepath.Join(instanceBackupsDir(instance), "*.snapshot"))
+	if err != nil {
+		return nil, err
+	}
+	references := map[string][]string{}
+	for _, path := range paths {
+		manifest, err := readSnapshot(path)
+		if err != nil {
+			return nil, err
+		}
+		id := strings.TrimSuffix(filepath.Base(path), ".snapshot")
+		references[id] = []string{}
+		for _, file := range manifest.Files {
+			references[id] = append(references[id], file.Chunks...)
+		}
+	}
+	return references, nil
+}
+
+// RepositoryReport is what VerifyRepository found.
+type RepositoryReport struct {
+	Snapshots int   `json:"snapshots"`
+	Chunks    int   `json:"chunks"`
+	Bytes     int64 `json:"bytes"`
+	// Chunks referenced by a snapshot but not in the repository.
+	Missing []string `json:"missing"`
+	// Chunks whose content doesn't match their name.
+	Corrupted []string `json:"corrupted"`
+	// Chunks no snapshot references, CollectGarbage removes them.
+	Unreferenced int `json:"unreferenced"`
+	// Backups that can't be restored entirely.
+	Damaged []string `json:"damaged"`
+	OK      bool     `json:"ok"`
+}
+
+// VerifyRepository reads every chunk of the incremental backups of an
+// instance and checks it against its hash, and that every chunk the
+// snapshots reference is there.
+func VerifyRepository(instance string) (RepositoryReport, error) {
+	if !backend.LockInstance(instance) {
+		return RepositoryReport{}, ErrBackupRunning
+	}
+	defer backend.UnlockInstance(instance)
+
+	report := RepositoryReport{Missing: []string{}, Corrupted: []string{}, Damaged: []string{}}
+	references, err := snapshotChunks(instance)
+	if err != nil {
+		return report, err
+	}
+	report.Snapshots = len(references)
+	repo := instanceRepository(instance)
+	hashes, err := repo.chunkHashes()
+	if err != nil {
+		return report, err
+	}
+
+	present, healthy := map[string]bool{}, map[string]bool{}
+	for _, hash := range hashes {
+		present[hash] = true
+		report.Chunks++
+		if info, err := os.Stat(repo.chunkPath(hash)); err == nil {
+			report.Bytes += info.Size()
+		}
+		if _, err := repo.readChunk(hash); err != nil {
+			report.Corrupted = append(report.Corrupted, hash)
+			continue
+		}
+		healthy[hash] = true
+	}
+
+	referenced := map[string]bool{}
+	for id, chunks := range references {
+		damaged := false
+		for _, hash := range chunks {
+			if !referenced[hash] && !present[hash] {
+				report.Missing = append(report.Missing, hash)
+			}
+			referenced[hash] = true
+			damaged = damaged || !healthy[hash]
+		}
+		if damaged {
+			report.Damaged = append(report.Damaged, id)
+		}
+	}
+	for _, hash := range hashes {
+		if !referenced[hash] {
+			report.Unreferenced++
+		}
+	}
+	sort.Strings(report.Damaged)
+	report.OK = len(report.Missing) == 0 && len(report.Corrupted) == 0
+	return report, nil
+}
+
+// GarbageReport is what CollectGarbage removed.
+type GarbageReport struct {
+	Removed int   `json:"removed"`
+	Freed   int64 `json:"freed"`
+	Kept    int   `json:"kept"`
+}
+
+// CollectGarbage removes the chunks of the repository of an instance that
+// no incremental backup references anymore.
+func CollectGarbage(instance string) (GarbageReport, error) {
+	if !backend.LockInstance(instance) {
+		return GarbageReport{}, ErrBackupRunning
+	}
+	defer backend.UnlockInstance(instance)
+	return collectGarbage(instance)
+}
+
+// collectGarbage is CollectGarbage for a locked instance.
+func collectGarbage(instance string) (GarbageReport, error) {
+	report := GarbageReport{}
+	references, err := snapshotChunks(instance)
+	if err != nil {
+		return report, err
+	}
+	referenced := map[string]bool{}
+	for _, chunks := range references {
+		for _, hash := range chunks {
+			referenced[hash] = true
+		}
+	}
+
+	repo := instanceRepository(instance)
+	// Left by an interrupted backup, nothing writes while the instance is
+	// locked.
+	leftovers, _ := filepath.Glob(filepath.Join(repo.dir, "chunks", "*", "*.tmp"))
+	for _, path := range leftovers {
+		os.Remove(path)
+	}
+	hashes, err := repo.chunkHashes()
+	if err != nil {
+		return report, err
+	}
+	for _, hash := range hashes {
+		if referenced[hash] {
+			report.Kept++
+			continue
+		}
+		path := repo.chunkPath(hash)
+		info, err := os.Stat(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return report, err
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return report, err
+		}
+		report.Removed++
+		if info != nil {
+			report.Freed += info.Size()
+		}
+	}
+	if report.Removed > 0 {
+		fmt.Printf("\nRemoved %d unreferenced chunks of %s, %d bytes", report.Removed, instance, report.Freed)
+	}
+	return report, nil
+}
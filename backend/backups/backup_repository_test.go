@@ -0,0 +1,237 @@
+package backups
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// region builds a region file holding a Minecraft chunk of sectors
+// sectors at each of offsets, filled with random bytes.
+func region(random *rand.Rand, offsets map[int]int, sectors int) []byte {
+	data := make([]byte, (2+sectors)*regionSectorSize)
+	for i := range data[regionHeaderSize:] {
+		data[regionHeaderSize+i] = byte(random.Uint32())
+	}
+	index := 0
+	for offset, count := range offsets {
+		binary.BigEndian.PutUint32(data[index*4:], uint32(offset<<8|count))
+		index++
+	}
+	return data
+}
+
+func splitBytes(t *testing.T, name string, data []byte) [][]byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	chunks := [][]byte{}
+	err := splitFile(path, int64(len(data)), func(chunk []byte) error {
+		chunks = append(chunks, bytes.Clone(chunk))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatalf("the chunks of %s don't add up to it", name)
+	}
+	return chunks
+}
+
+func TestSplitFile(t *testing.T) {
+	random := rand.New(rand.NewPCG(1, 2))
+
+	// A chunk at sector 2, one of two sectors at 3 and one at 6 after a
+	// free sector.
+	data := region(random, map[int]int{2: 1, 3: 2, 6: 1}, 5)
+	lengths := []int{}
+	for _, chunk := range splitBytes(t, "r.0.0.mca", data) {
+		lengths = append(lengths, len(chunk))
+	}
+	if !slices.Equal(lengths, []int{regionHeaderSize, regionSectorSize, 2 * regionSectorSize, regionSectorSize, regionSectorSize}) {
+		t.Errorf("region split in %v", lengths)
+	}
+
+	// Inserting bytes at the start of a file only changes its first chunks.
+	data = make([]byte, 8<<20)
+	for i := range data {
+		data[i] = byte(random.Uint32())
+	}
+	before := map[string]bool{}
+	for _, chunk := range splitBytes(t, "level.dat", data) {
+		before[string(chunk)] = true
+	}
+	after := splitBytes(t, "level.dat", append([]byte("inserted"), data...))
+	shared := 0
+	for _, chunk := range after {
+		if before[string(chunk)] {
+			shared++
+		}
+	}
+	if len(after) < 4 || shared < len(after)-2 {
+		t.Errorf("%d of %d chunks left unchanged by an insertion", shared, len(after))
+	}
+}
+
+// snapshotFiles reads the tar.zst archive writeSnapshotTarZst makes of a
+// backup.
+func snapshotFiles(t *testing.T, backup Backup) map[string]string {
+	t.Helper()
+	var buffer bytes.Buffer
+	if err := writeSnapshotTarZst(&buffer, backup); err != nil {
+		t.Fatal(err)
+	}
+	decompressor, err := zstd.NewReader(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decompressor.Close()
+	files := map[string]string{}
+	archive := tar.NewReader(decompressor)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			content, _ := io.ReadAll(archive)
+			files[header.Name] = string(content)
+		}
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	mc := backupInstance(t, "backup-incremental")
+	regionPath := filepath.Join(mc.Config().Directory, "world", "region", "r.0.0.mca")
+	original := region(rand.New(rand.NewPCG(3, 4)), map[int]int{2: 1, 3: 1, 4: 1}, 3)
+	if err := os.WriteFile(regionPath, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+	repo := instanceRepository("backup-incremental")
+	options := BackupOptions{Format: FormatIncremental}
+
+	first, err := CreateBackup(context.Background(), "backup-incremental", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, _ := repo.chunkHashes()
+	// The header and 3 Minecraft chunks of the region, and 4 small files.
+	if len(chunks) != 8 {
+		t.Errorf("%d chunks stored", len(chunks))
+	}
+
+	second, err := CreateBackup(context.Background(), "backup-incremental", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(second.Path()); info == nil || second.Size != info.Size() {
+		t.Errorf("an unchanged world added %d bytes besides its snapshot", second.Size)
+	}
+
+	// A Minecraft chunk saved again.
+	changed := bytes.Clone(original)
+	copy(changed[3*regionSectorSize:], "saved again")
+	os.WriteFile(regionPath, changed, 0644)
+	third, err := CreateBackup(context.Background(), "backup-incremental", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks, _ := repo.chunkHashes(); len(chunks) != 9 {
+		t.Errorf("%d chunks stored after one Minecraft chunk changed", len(chunks))
+	}
+	if files := snapshotFiles(t, third); files["world/region/r.0.0.mca"] != string(changed) || files["world/playerdata/"+steveUUID+".dat"] != "steve" {
+		t.Error("the download of the last backup doesn't have the world")
+	}
+
+	if _, err := RestoreBackup(context.Background(), "backup-incremental", first.ID, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if restored, _ := os.ReadFile(regionPath); !bytes.Equal(restored, original) {
+		t.Error("the region wasn't restored")
+	}
+
+	report, err := VerifyRepository("backup-incremental")
+	if err != nil || !report.OK || report.Unreferenced != 0 || report.Snapshots != 3 {
+		t.Errorf("verify reported %+v, %v", report, err)
+	}
+
+	// The Minecraft chunk only the third backup has.
+	firstManifest, _ := readSnapshot(first.Path())
+	thirdManifest, _ := readSnapshot(third.Path())
+	var only string
+	for _, file := range thirdManifest.Files {
+		for _, hash := range file.Chunks {
+			found := false
+			for _, other := range firstManifest.Files {
+				found = found || slices.Contains(other.Chunks, hash)
+			}
+			if !found {
+				only = hash
+			}
+		}
+	}
+	if only == "" {
+		t.Fatal("the third backup shares every chunk with the first")
+	}
+
+	os.WriteFile(repo.chunkPath(only), []byte("garbage"), 0644)
+	report, _ = VerifyRepository("backup-incremental")
+	if report.OK || !slices.Equal(report.Corrupted, []string{only}) || !slices.Equal(report.Damaged, []string{third.ID}) {
+		t.Errorf("verify of a corrupted chunk reported %+v", report)
+	}
+
+	if err := DeleteBackup("backup-incremental", third.ID); err != nil {
+		t.Fatal(err)
+	}
+	garbage, err := CollectGarbage("backup-incremental")
+	if err != nil || garbage.Removed != 1 || garbage.Kept != 8 {
+		t.Errorf("garbage collection reported %+v, %v", garbage, err)
+	}
+	if _, err := os.Stat(repo.chunkPath(only)); !os.IsNotExist(err) {
+		t.Error("an unreferenced chunk is still there")
+	}
+	report, _ = VerifyRepository("backup-incremental")
+	if !report.OK || report.Unreferenced != 0 || len(report.Damaged) != 0 {
+		t.Errorf("verify after the garbage collection reported %+v", report)
+	}
+
+	// The second backup is the only one left, its chunks stay even when
+	// its metadata can't be read.
+	if err := DeleteBackup("backup-incremental", first.ID); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(metadataPath("backup-incremental", second.ID), []byte("{"), 0644)
+	garbage, err = CollectGarbage("backup-incremental")
+	if err != nil || garbage.Removed != 0 || garbage.Kept != 8 {
+		t.Errorf("garbage collection without metadata reported %+v, %v", garbage, err)
+	}
+}
+
+func TestReadSnapshotChecksHashes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "20260101-000000.snapshot")
+	for _, hash := range []string{"../../../../etc/passwd", "ab", strings.Repeat("A", 64), strings.Repeat("a", 64)} {
+		data, _ := json.Marshal(snapshotManifest{Version: snapshotVersion, Files: []snapshotFile{{Name: "world/level.dat", Chunks: []string{hash}}}})
+		os.WriteFile(path, chunkEncoder.EncodeAll(data, nil), 0644)
+		_, err := readSnapshot(path)
+		if valid := hash == strings.Repeat("a", 64); (err == nil) != valid {
+			t.Errorf("reading a snapshot with chunk %q: %v", hash, err)
+		}
+	}
+}
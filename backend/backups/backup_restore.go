@@ -0,0 +1,247 @@
+package backups
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Dimensions that can be restored on their own, named after their
+// folders.
+const (
+	DimensionOverworld = "overworld"
+	DimensionNether    = "DIM-1"
+	DimensionEnd       = "DIM1"
+)
+
+var playerUUIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// RestoreOptions narrows a restore down to a dimension or to a player,
+// every world of the backup is restored otherwise.
+type RestoreOptions struct {
+	// DimensionOverworld, DimensionNether or DimensionEnd.
+	Dimension string
+	// UUID whose playerdata file is restored.
+	Player string
+	// Start the server once restored.
+	Restart bool
+	// Backup target to take the backup from, when the backups directory
+	// lost it or its copy is damaged.
+	Target string
+}
+
+type RestoreResult struct {
+	Backup Backup `json:"backup"`
+	// The worlds as they were before the restore, nil when there were none.
+	SafetySnapshot *Backup `json:"safety_snapshot,omitempty"`
+	// Folders and files replaced, relative to the instance directory.
+	Restored  []string `json:"restored"`
+	Restarted bool     `json:"restarted"`
+}
+
+// RestoreBackup puts a backup back into its instance. The server is
+// stopped, the current worlds are saved in a TriggerPreRestore backup, the
+// archive is extracted next to the worlds and swapped in, so a failure
+// leaves them untouched. A server that was running is started again when
+// the restore fails, and on success when options.Restart is set.
+func RestoreBackup(ctx context.Context, instanceID string, id string, options RestoreOptions) (RestoreResult, error) {
+	mc, err := backend.Instances.Get(instanceID)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+	if !backend.LockInstance(instanceID) {
+		return RestoreResult{}, ErrBackupRunning
+	}
+	defer backend.UnlockInstance(instanceID)
+
+	if options.Target != "" {
+		if err := fetchBackup(ctx, options.Target, instanceID, id); err != nil {
+			return RestoreResult{}, fmt.Errorf("fetching the backup from %s: %w", options.Target, err)
+		}
+	}
+	backup, err := GetBackup(instanceID, id)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+	candidates, err := restoreCandidates(backup, options)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+
+	wasRunning := mc.State().IsAlive()
+	if wasRunning {
+		if err := mc.StopAndWait(); err != nil {
+			return RestoreResult{}, err
+		}
+	} else if state := mc.State(); state == backend.StateRestarting || state == backend.StateCrashLoop {
+		// Cancels the automatic restart.
+		mc.Stop()
+	}
+
+	result, err := restoreStopped(ctx, mc, backup, candidates, options)
+	if err != nil {
+		if wasRunning {
+			mc.Start()
+		}
+		return result, err
+	}
+
+	fmt.Printf("\nBackup %s restored into instance %s: %s", id, instanceID, strings.Join(result.Restored, ", "))
+	if options.Restart {
+		if err := mc.Start(); err != nil {
+			return result, fmt.Errorf("restored, but the server didn't start: %w", err)
+		}
+		result.Restarted = true
+	}
+	return result, nil
+}
+
+// restoreCandidates lists the paths a restore replaces, relative to the
+// instance directory. Dimensions are in the world folder on vanilla and
+// in their own world folder on Bukkit based servers, whichever the backup
+// has is restored.
+func restoreCandidates(backup Backup, options RestoreOptions) ([]string, error) {
+	if len(backup.Worlds) == 0 {
+		return nil, errors.New("the backup has no world")
+	}
+	level := backup.Worlds[0]
+
+	switch {
+	case options.Dimension != "" && options.Player != "":
+		return nil, errors.New("restore a dimension or a player, not both")
+	case options.Player != "":
+		if !playerUUIDPattern.MatchString(options.Player) {
+			return nil, fmt.Errorf("%q is not a player UUID", options.Player)
+		}
+		return []string{path.Join(level, "playerdata", strings.ToLower(options.Player)+".dat")}, nil
+	case options.Dimension == DimensionOverworld:
+		return []string{path.Join(level, "region"), path.Join(level, "entities"), path.Join(level, "poi")}, nil
+	case options.Dimension == DimensionNether:
+		return []string{path.Join(level, DimensionNether), path.Join(level+"_nether", DimensionNether)}, nil
+	case options.Dimension == DimensionEnd:
+		return []string{path.Join(level, DimensionEnd), path.Join(level+"_the_end", DimensionEnd)}, nil
+	case options.Dimension != "":
+		return nil, fmt.Errorf("unknown dimension %q, use %s, %s or %s", options.Dimension, DimensionOverworld, DimensionNether, DimensionEnd)
+	}
+	return backup.Worlds, nil
+}
+
+// restoreStopped takes the safety snapshot and swaps the candidates the
+// backup has into the stopped instance.
+func restoreStopped(ctx context.Context, mc *backend.McServer, backup Backup, candidates []string, options RestoreOptions) (RestoreResult, error) {
+	result := RestoreResult{Backup: backup}
+	directory := mc.Config().Directory
+	current := backend.WorldDirectories(directory)
+
+	if len(current) > 0 {
+		snapshot, err := createBackup(ctx, mc, BackupOptions{Trigger: TriggerPreRestore})
+		if err != nil {
+			return result, fmt.Errorf("safety snapshot before the restore: %w", err)
+		}
+		result.SafetySnapshot = &snapshot
+	}
+
+	// Next to the worlds, so they are swapped by renaming.
+	staging, err := os.MkdirTemp(directory, ".restore-")
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(staging)
+	err = extractArchive(backup.Path(), backup.Format, staging, func(name string) bool {
+		return slices.ContainsFunc(candidates, func(candidate string) bool {
+			return name == candidate || strings.HasPrefix(name, candidate+"/")
+		})
+	})
+	if err != nil {
+		return result, fmt.Errorf("extracting the backup: %w", err)
+	}
+
+	targets := []string{}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(filepath.Join(staging, filepath.FromSlash(candidate))); err == nil {
+			targets = append(targets, candidate)
+		}
+	}
+	if len(targets) == 0 {
+		what := "the worlds"
+		if options.Dimension != "" {
+			what = "dimension " + options.Dimension
+		} else if options.Player != "" {
+			what = "player " + options.Player
+		}
+		return result, fmt.Errorf("backup %s has no %s", backup.ID, what)
+	}
+
+	// A full restore also removes the worlds made since the backup, the
+	// safety snapshot has them.
+	removed := []string{}
+	if options.Dimension == "" && options.Player == "" {
+		for _, world := range current {
+			if !slices.Contains(targets, world) {
+				removed = append(removed, world)
+			}
+		}
+	}
+
+	if err := swapIn(directory, staging, targets, removed); err != nil {
+		return result, err
+	}
+	result.Restored = targets
+	return result, nil
+}
+
+// swapIn moves targets from staging into directory and removed out of
+// it. What they replace is moved aside first and put back if a rename
+// fails.
+func swapIn(directory string, staging string, targets []string, removed []string) error {
+	replaced, err := os.MkdirTemp(directory, ".replaced-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(replaced)
+
+	type move struct{ from, to string }
+	done := []move{}
+	rename := func(from string, to string) error {
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+		done = append(done, move{from, to})
+		return nil
+	}
+	undo := func() {
+		for i := len(done) - 1; i >= 0; i-- {
+			if err := os.Rename(done[i].to, done[i].from); err != nil {
+				fmt.Printf("\nCannot put %s back after a failed restore: %v", done[i].from, err)
+			}
+		}
+	}
+
+	for _, target := range append(append([]string{}, targets...), removed...) {
+		name := filepath.FromSlash(target)
+		if _, err := os.Lstat(filepath.Join(directory, name)); err == nil {
+			if err := rename(filepath.Join(directory, name), filepath.Join(replaced, name)); err != nil {
+				undo()
+				return err
+			}
+		}
+	}
+	for _, target := range targets {
+		name := filepath.FromSlash(target)
+		if err := rename(filepath.Join(staging, name), filepath.Join(directory, name)); err != nil {
+			undo()
+			return err
+		}
+	}
+	return nil
+}
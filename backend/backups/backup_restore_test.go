@@ -0,0 +1,113 @@
+package backups
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readWorldFile(t *testing.T, mc *backend.McServer, name string) string {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join(mc.Config().Directory, filepath.FromSlash(name)))
+	if err != nil {
+		return ""
+	}
+	return string(content)
+}
+
+func writeWorldFile(t *testing.T, mc *backend.McServer, name string, content string) {
+	t.Helper()
+	path := filepath.Join(mc.Config().Directory, filepath.FromSlash(name))
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	mc := backupInstance(t, "restore")
+	mc.Start()
+	waitRunning(t, mc)
+	backup, err := CreateBackup(context.Background(), "restore", BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeWorldFile(t, mc, "world/region/r.0.0.mca", "griefed")
+	writeWorldFile(t, mc, "world/region/r.5.5.mca", "explored since")
+	writeWorldFile(t, mc, "world_the_end/DIM1/region/r.0.0.mca", "end")
+
+	result, err := RestoreBackup(context.Background(), "restore", backup.ID, RestoreOptions{Restart: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitRunning(t, mc)
+	if !result.Restarted || strings.Join(result.Restored, " ") != "world world_nether" {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if content := readWorldFile(t, mc, "world/region/r.0.0.mca"); content != "region 0 0" {
+		t.Errorf("region restored as %q", content)
+	}
+	for _, name := range []string{"world/region/r.5.5.mca", "world_the_end"} {
+		if _, err := os.Stat(filepath.Join(mc.Config().Directory, name)); !os.IsNotExist(err) {
+			t.Errorf("%s is still there", name)
+		}
+	}
+
+	if result.SafetySnapshot == nil || result.SafetySnapshot.Trigger != TriggerPreRestore || result.SafetySnapshot.Online {
+		t.Fatalf("unexpected safety snapshot %+v", result.SafetySnapshot)
+	}
+	files := archiveFiles(t, *result.SafetySnapshot)
+	if files["world/region/r.0.0.mca"] != "griefed" || files["world_the_end/DIM1/region/r.0.0.mca"] != "end" {
+		t.Errorf("the safety snapshot missed the current world: %v", files)
+	}
+
+	leftovers, _ := filepath.Glob(filepath.Join(mc.Config().Directory, ".re*"))
+	if len(leftovers) != 0 {
+		t.Errorf("left behind %v", leftovers)
+	}
+}
+
+func TestRestorePart(t *testing.T) {
+	mc := backupInstance(t, "restore-part")
+	backup, err := CreateBackup(context.Background(), "restore-part", BackupOptions{Format: FormatZip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeWorldFile(t, mc, "world/region/r.0.0.mca", "overworld since")
+	writeWorldFile(t, mc, "world_nether/DIM-1/region/r.0.0.mca", "nether since")
+	writeWorldFile(t, mc, "world/playerdata/"+steveUUID+".dat", "steve since")
+
+	result, err := RestoreBackup(context.Background(), "restore-part", backup.ID, RestoreOptions{Dimension: DimensionNether})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(result.Restored, " ") != "world_nether/DIM-1" || result.Restarted {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if readWorldFile(t, mc, "world_nether/DIM-1/region/r.0.0.mca") != "nether" || readWorldFile(t, mc, "world/region/r.0.0.mca") != "overworld since" {
+		t.Error("the nether restore touched something else")
+	}
+
+	if _, err := RestoreBackup(context.Background(), "restore-part", backup.ID, RestoreOptions{Player: strings.ToUpper(steveUUID)}); err != nil {
+		t.Fatal(err)
+	}
+	if readWorldFile(t, mc, "world/playerdata/"+steveUUID+".dat") != "steve" || readWorldFile(t, mc, "world/region/r.0.0.mca") != "overworld since" {
+		t.Error("the player restore touched something else")
+	}
+
+	if _, err := RestoreBackup(context.Background(), "restore-part", backup.ID, RestoreOptions{Dimension: DimensionEnd}); err == nil || !strings.Contains(err.Error(), "no dimension DIM1") {
+		t.Errorf("restoring a missing dimension gave %v", err)
+	}
+	for _, options := range []RestoreOptions{{Dimension: "DIM2"}, {Player: "../../level"}, {Dimension: DimensionNether, Player: steveUUID}} {
+		if _, err := RestoreBackup(context.Background(), "restore-part", backup.ID, options); err == nil {
+			t.Errorf("%+v was accepted", options)
+		}
+	}
+	if readWorldFile(t, mc, "world/region/r.0.0.mca") != "overworld since" {
+		t.Error("a failed restore changed the world")
+	}
+}
@@ -0,0 +1,199 @@
+package backups
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"fmt"
+	"time"
+)
+
+// RetentionDecision tells whether pruning keeps a backup and why.
+type RetentionDecision struct {
+	Backup  Backup   `json:"backup"`
+	Keep    bool     `json:"keep"`
+	Reasons []string `json:"reasons"`
+}
+
+// protectedReason is why a backup is never pruned automatically, or "".
+func protectedReason(backup Backup) string {
+	switch {
+	case backup.Pinned:
+		return "pinned"
+	case backup.Trigger == TriggerPreRestore:
+		return "pre-restore snapshot"
+	}
+	return ""
+}
+
+// planRetention applies policy to backups, newest first. The newest
+// backup of each day, week and month is kept for as many of the most
+// recent of them as the policy says, then the oldest kept backups go
+// until the total size fits. A policy with only a size limit starts from
+// every backup. Pinned backups and pre-restore snapshots always stay, and
+// count in the total size. sizes replaces the Size of the backups it has
+// in the total, the size of an incremental backup is only what it added.
+func planRetention(backups []Backup, policy backend.BackupRetention, sizes map[string]int64) []RetentionDecision {
+	decisions := make([]RetentionDecision, len(backups))
+	for i, backup := range backups {
+		decisions[i] = RetentionDecision{Backup: backup, Reasons: []string{}}
+		if reason := protectedReason(backup); reason != "" {
+			decisions[i].Keep = true
+			decisions[i].Reasons = append(decisions[i].Reasons, reason)
+		}
+	}
+	if !policy.Enabled() {
+		for i := range decisions {
+			if !decisions[i].Keep {
+				decisions[i].Keep = true
+				decisions[i].Reasons = append(decisions[i].Reasons, "no retention policy")
+			}
+		}
+		return decisions
+	}
+
+	keep := func(i int, reason string) {
+		decisions[i].Keep = true
+		decisions[i].Reasons = append(decisions[i].Reasons, reason)
+	}
+	tiers := []struct {
+		name   string
+		count  int
+		bucket func(time.Time) string
+	}{
+		{"daily", policy.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", policy.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", policy.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+
+	if policy.KeepLast == 0 && policy.KeepDaily == 0 && policy.KeepWeekly == 0 && policy.KeepMonthly == 0 {
+		for i := range decisions {
+			if !decisions[i].Keep {
+				keep(i, "within the size limit")
+			}
+		}
+	}
+
+	last := 0
+	for i, decision := range decisions {
+		if protectedReason(decision.Backup) != "" {
+			continue
+		}
+		if last < policy.KeepLast {
+			last++
+			keep(i, fmt.Sprintf("last %d", policy.KeepLast))
+		}
+	}
+	for _, tier := range tiers {
+		seen := map[string]bool{}
+		for i, decision := range decisions {
+			if len(seen) == tier.count {
+				break
+			}
+			if protectedReason(decision.Backup) != "" {
+				continue
+			}
+			bucket := tier.bucket(decision.Backup.CreatedAt.Local())
+			if !seen[bucket] {
+				seen[bucket] = true
+				keep(i, tier.name+" "+bucket)
+			}
+		}
+	}
+
+	if policy.MaxTotalBytes > 0 {
+		size := func(backup Backup) int64 {
+			if size, found := sizes[backup.ID]; found {
+				return size
+			}
+			return backup.Size
+		}
+		var total int64
+		for _, decision := range decisions {
+			if decision.Keep {
+				total += size(decision.Backup)
+			}
+		}
+		// The newest backup stays, even alone over the limit.
+		for i := len(decisions) - 1; i > 0 && total > policy.MaxTotalBytes; i-- {
+			if decisions[i].Keep && protectedReason(decisions[i].Backup) == "" {
+				total -= size(decisions[i].Backup)
+				decisions[i].Keep = false
+				decisions[i].Reasons = []string{fmt.Sprintf("over the %d bytes limit", policy.MaxTotalBytes)}
+			}
+		}
+	}
+
+	for i := range decisions {
+		if !decisions[i].Keep && len(decisions[i].Reasons) == 0 {
+			decisions[i].Reasons = append(decisions[i].Reasons, "outside the retention policy")
+		}
+	}
+	return decisions
+}
+
+// PreviewPrune returns what pruning the backups of an instance would do,
+// without removing anything.
+func PreviewPrune(instanceID string) ([]RetentionDecision, error) {
+	mc, err := backend.Instances.Get(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	backups, err := ListBackups(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	policy := mc.Config().BackupRetention
+	// Dropping an incremental backup only frees the chunks no other
+	// backup references, it counts in the cap with all of them.
+	sizes := map[string]int64{}
+	for _, backup := range backups {
+		if policy.MaxTotalBytes > 0 && backup.Format == FormatIncremental {
+			if sizes[backup.ID], err = referencedSize(backup); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return planRetention(backups, policy, sizes), nil
+}
+
+// PruneBackups removes the backups of an instance its retention policy
+// doesn't keep, and returns them.
+func PruneBackups(instanceID string) ([]Backup, error) {
+	if !backend.LockInstance(instanceID) {
+		return nil, ErrBackupRunning
+	}
+	defer backend.UnlockInstance(instanceID)
+	return pruneBackups(instanceID)
+}
+
+// pruneBackups is PruneBackups for a locked instance.
+func pruneBackups(instanceID string) ([]Backup, error) {
+	decisions, err := PreviewPrune(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	pruned := []Backup{}
+	incremental := false
+	defer func() {
+		// The chunks of the pruned snapshots only they referenced.
+		if incremental {
+			if _, err := collectGarbage(instanceID); err != nil {
+				fmt.Printf("\nCannot collect the garbage of %s: %v", instanceID, err)
+			}
+		}
+	}()
+	for _, decision := range decisions {
+		if decision.Keep {
+			continue
+		}
+		if err := deleteBackup(instanceID, decision.Backup.ID); err != nil {
+			return pruned, err
+		}
+		fmt.Printf("\nPruned backup %s of %s: %s", decision.Backup.ID, instanceID, decision.Reasons[0])
+		pruned = append(pruned, decision.Backup)
+		incremental = incremental || decision.Backup.Format == FormatIncremental
+	}
+	return pruned, nil
+}
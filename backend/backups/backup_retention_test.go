@@ -0,0 +1,209 @@
+package backups
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// syntheticBackups returns one backup a day at noon for days days, newest
+// first, each size bytes.
+func syntheticBackups(days int, size int64) []Backup {
+	newest := time.Date(2026, time.March, 31, 12, 0, 0, 0, time.Local)
+	backups := []Backup{}
+	for i := range days {
+		created := newest.AddDate(0, 0, -i)
+		backups = append(backups, Backup{ID: created.Format("20060102-150405"), Trigger: TriggerManual, Size: size, CreatedAt: created})
+	}
+	return backups
+}
+
+func keptIDs(decisions []RetentionDecision) []string {
+	kept := []string{}
+	for _, decision := range decisions {
+		if decision.Keep {
+			kept = append(kept, decision.Backup.ID)
+		}
+	}
+	return kept
+}
+
+func TestPlanRetention(t *testing.T) {
+	backups := syntheticBackups(90, 10)
+	backups[5].Pinned = true
+	backups[80].Trigger = TriggerPreRestore
+
+	decisions := planRetention(backups, backend.BackupRetention{}, nil)
+	if len(keptIDs(decisions)) != 90 {
+		t.Errorf("a policy without rules pruned backups")
+	}
+
+	decisions = planRetention(backups, backend.BackupRetention{KeepLast: 2, KeepDaily: 4, KeepWeekly: 2, KeepMonthly: 3}, nil)
+	kept := map[string]bool{}
+	for _, id := range keptIDs(decisions) {
+		kept[id] = true
+	}
+	// March 31st is a Tuesday: the last 4 days, Sunday the 29th for the
+	// previous week, the last days of February and January, the pinned
+	// backup and the safety snapshot.
+	expected := []string{
+		"20260331-120000", "20260330-120000", "20260329-120000", "20260328-120000",
+		"20260228-120000", "20260131-120000",
+		backups[5].ID, backups[80].ID,
+	}
+	for _, id := range expected {
+		if !kept[id] {
+			t.Errorf("%s was pruned", id)
+		}
+	}
+	if len(kept) != len(expected) {
+		t.Errorf("kept %v, expected %v", keptIDs(decisions), expected)
+	}
+	if decisions[5].Reasons[0] != "pinned" || decisions[80].Reasons[0] != "pre-restore snapshot" {
+		t.Errorf("reasons %v and %v", decisions[5].Reasons, decisions[80].Reasons)
+	}
+	if decisions[10].Keep || decisions[10].Reasons[0] != "outside the retention policy" {
+		t.Errorf("unexpected decision %+v", decisions[10])
+	}
+
+	// The cap drops the oldest first but keeps the protected backups.
+	decisions = planRetention(backups, backend.BackupRetention{KeepLast: 10, MaxTotalBytes: 50}, nil)
+	kept = map[string]bool{}
+	for _, id := range keptIDs(decisions) {
+		kept[id] = true
+	}
+	if len(kept) != 5 || !kept[backups[0].ID] || !kept[backups[2].ID] || !kept[backups[5].ID] || !kept[backups[80].ID] {
+		t.Errorf("kept %v under a 50 bytes cap", keptIDs(decisions))
+	}
+
+	// Without count rules the cap alone decides.
+	decisions = planRetention(backups, backend.BackupRetention{MaxTotalBytes: 50}, nil)
+	kept = map[string]bool{}
+	for _, id := range keptIDs(decisions) {
+		kept[id] = true
+	}
+	if len(kept) != 5 || !kept[backups[0].ID] || !kept[backups[2].ID] || !kept[backups[5].ID] || !kept[backups[80].ID] {
+		t.Errorf("kept %v with only a 50 bytes cap", keptIDs(decisions))
+	}
+	if decisions[0].Reasons[0] != "within the size limit" || decisions[3].Reasons[0] != "over the 50 bytes limit" {
+		t.Errorf("reasons %v and %v", decisions[0].Reasons, decisions[3].Reasons)
+	}
+
+	// The newest backup stays even alone over the cap.
+	decisions = planRetention(syntheticBackups(3, 100), backend.BackupRetention{MaxTotalBytes: 50, KeepLast: 3}, nil)
+	if kept := keptIDs(decisions); len(kept) != 1 || kept[0] != "20260331-120000" {
+		t.Errorf("kept %v over the cap", kept)
+	}
+
+	// Incremental backups count with every chunk they reference, the oldest
+	// one going frees little when the others share its chunks.
+	backups = syntheticBackups(3, 5)
+	backups[2].Size = 100
+	sizes := map[string]int64{}
+	for _, backup := range backups {
+		sizes[backup.ID] = 100
+	}
+	decisions = planRetention(backups, backend.BackupRetention{MaxTotalBytes: 150}, sizes)
+	if kept := keptIDs(decisions); len(kept) != 1 || kept[0] != "20260331-120000" {
+		t.Errorf("kept %v of incremental backups over the cap", kept)
+	}
+}
+
+func TestPruneAfterBackup(t *testing.T) {
+	backupInstance(t, "backup-prune")
+	err := backend.Instances.Update("backup-prune", func(config *backend.InstanceConfig) error {
+		config.BackupRetention = backend.BackupRetention{KeepLast: 1}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := CreateBackup(context.Background(), "backup-prune", BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SetPinned("backup-prune", first.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	second, err := CreateBackup(context.Background(), "backup-prune", BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := RestoreBackup(context.Background(), "backup-prune", second.ID, RestoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := CreateBackup(context.Background(), "backup-prune", BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listed, _ := ListBackups("backup-prune")
+	ids := map[string]bool{}
+	for _, backup := range listed {
+		ids[backup.ID] = true
+	}
+	if len(ids) != 3 || !ids[first.ID] || !ids[result.SafetySnapshot.ID] || !ids[third.ID] {
+		t.Errorf("expected the pinned, the safety snapshot and the newest backup, got %+v", listed)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/backups/prune", PruneHandler)
+	mux.HandleFunc("/backups/retention", RetentionHandler)
+	mux.HandleFunc("POST /backups/{id}/pin", PinBackupHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	response, err := http.PostForm(server.URL+"/backups/"+first.ID+"/pin", map[string][]string{"instance": {"backup-prune"}, "pinned": {"false"}})
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("unpin answered %v, %v", response, err)
+	}
+	response.Body.Close()
+
+	response, err = http.PostForm(server.URL+"/backups/retention", map[string][]string{"instance": {"backup-prune"}, "keep_daily": {"7"}, "max_size": {"2G"}})
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("retention answered %v, %v", response, err)
+	}
+	response.Body.Close()
+	mc, _ := backend.Instances.Get("backup-prune")
+	retention := mc.Config().BackupRetention
+	if retention != (backend.BackupRetention{KeepLast: 1, KeepDaily: 7, MaxTotalBytes: 2 << 30}) {
+		t.Errorf("retention set to %+v", retention)
+	}
+
+	// The preview shows the unpinned backup going without removing it.
+	response, err = http.Get(server.URL + "/backups/prune?instance=backup-prune")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decisions []RetentionDecision
+	json.NewDecoder(response.Body).Decode(&decisions)
+	response.Body.Close()
+	if len(decisions) != 3 {
+		t.Fatalf("previewed %+v", decisions)
+	}
+	if _, err := GetBackup("backup-prune", first.ID); err != nil {
+		t.Errorf("the preview removed a backup: %v", err)
+	}
+
+	response, err = http.PostForm(server.URL+"/backups/prune", map[string][]string{"instance": {"backup-prune"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pruned []Backup
+	json.NewDecoder(response.Body).Decode(&pruned)
+	response.Body.Close()
+	for _, decision := range decisions {
+		if _, err := GetBackup("backup-prune", decision.Backup.ID); (err == nil) != decision.Keep {
+			t.Errorf("backup %s kept: %v, previewed %+v", decision.Backup.ID, err == nil, decision)
+		}
+	}
+	if len(pruned) != 1 || pruned[0].ID != first.ID {
+		t.Errorf("pruned %+v after previewing %+v", pruned, decisions)
+	}
+}
@@ -0,0 +1,191 @@
+// Package backups archives the worlds of instances, pausing the saves of
+// running servers while they are copied.
+package backups
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DEFAULT_BACKUPS_DIR = "./backups"
+
+const (
+	FormatTarZst = "tar.zst"
+	FormatZip    = "zip"
+	// Chunks in the repository of the instance, stored once across its
+	// incremental backups, and a .snapshot file listing them.
+	FormatIncremental = "incremental"
+)
+
+// What made a backup.
+const (
+	TriggerManual = "manual"
+	// The safety snapshot taken before a restore.
+	TriggerPreRestore = "pre-restore"
+)
+
+var ErrBackupNotFound = errors.New("backup not found")
+
+var backupIdPattern = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}(-[0-9]+)?$`)
+
+// Backup describes an archive of the worlds of an instance. The archive
+// and this description, as <id>.json, are kept in the instance's folder of
+// the backups directory.
+type Backup struct {
+	ID       string `json:"id"`
+	Instance string `json:"instance"`
+	Format   string `json:"format"`
+	File     string `json:"file"`
+	// What the backup added to the backups directory, for an incremental
+	// backup its snapshot and the chunks no other backup had.
+	Size   int64    `json:"size"`
+	SHA256 string   `json:"sha256"`
+	Worlds []string `json:"worlds"`
+	// The server the worlds were made with.
+	ServerType    string `json:"server_type,omitempty"`
+	ServerVersion string `json:"server_version,omitempty"`
+	Trigger       string `json:"trigger"`
+	// Pinned backups are never pruned.
+	Pinned bool `json:"pinned"`
+	// The targets with a verified copy of the backup.
+	Copies []string `json:"copies,omitempty"`
+	// The server was running, its saves were paused during the backup.
+	Online     bool      `json:"online"`
+	CreatedAt  time.Time `json:"created_at"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+func backupsDir() string {
+	dir := backend.SavedAppConfig.BackupConfig.BackupsDir
+	if dir == "" {
+		dir = DEFAULT_BACKUPS_DIR
+	}
+	return dir
+}
+
+func instanceBackupsDir(instance string) string {
+	return filepath.Join(backupsDir(), instance)
+}
+
+// Path is where the archive of the backup is.
+func (backup Backup) Path() string {
+	return filepath.Join(instanceBackupsDir(backup.Instance), backup.File)
+}
+
+func metadataPath(instance string, id string) string {
+	return filepath.Join(instanceBackupsDir(instance), id+".json")
+}
+
+func validFormat(format string) bool {
+	return format == FormatTarZst || format == FormatZip || format == FormatIncremental
+}
+
+// newBackupID names a backup after the time it was made, with a suffix
+// when another one was made in the same second.
+func newBackupID(instance string, now time.Time) string {
+	id := now.Format("20060102-150405")
+	for i := 2; ; i++ {
+		if _, err := os.Stat(metadataPath(instance, id)); errors.Is(err, os.ErrNotExist) {
+			return id
+		}
+		id = fmt.Sprintf("%s-%d", now.Format("20060102-150405"), i)
+	}
+}
+
+func writeBackupMetadata(backup Backup) error {
+	data, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := metadataPath(backup.Instance, backup.ID)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ListBackups returns the backups of an instance, newest first.
+func ListBackups(instance string) ([]Backup, error) {
+	paths, err := filepath.Glob(filepath.Join(instanceBackupsDir(instance), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	backups := []Backup{}
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".json")
+		backup, err := GetBackup(instance, id)
+		if err != nil {
+			fmt.Printf("\nSkipping backup %s of %s: %v", id, instance, err)
+			continue
+		}
+		backups = append(backups, backup)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
+	})
+	return backups, nil
+}
+
+func GetBackup(instance string, id string) (Backup, error) {
+	if !backupIdPattern.MatchString(id) {
+		return Backup{}, ErrBackupNotFound
+	}
+	data, err := os.ReadFile(metadataPath(instance, id))
+	if errors.Is(err, os.ErrNotExist) {
+		return Backup{}, ErrBackupNotFound
+	}
+	if err != nil {
+		return Backup{}, err
+	}
+	var backup Backup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return Backup{}, err
+	}
+	return backup, nil
+}
+
+// DeleteBackup removes the archive of a backup, then its description.
+// It fails with ErrBackupRunning while the instance is backed up,
+// restored, pruned or upgraded.
+func DeleteBackup(instance string, id string) error {
+	if !backend.LockInstance(instance) {
+		return ErrBackupRunning
+	}
+	defer backend.UnlockInstance(instance)
+	return deleteBackup(instance, id)
+}
+
+// deleteBackup is DeleteBackup for callers that hold the instance lock.
+func deleteBackup(instance string, id string) error {
+	backup, err := GetBackup(instance, id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(backup.Path()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Remove(metadataPath(instance, id))
+}
+
+// SetPinned pins or unpins a backup.
+func SetPinned(instance string, id string, pinned bool) (Backup, error) {
+	if !backend.LockInstance(instance) {
+		return Backup{}, ErrBackupRunning
+	}
+	defer backend.UnlockInstance(instance)
+
+	backup, err := GetBackup(instance, id)
+	if err != nil {
+		return Backup{}, err
+	}
+	backup.Pinned = pinned
+	return backup, writeBackupMetadata(backup)
+}
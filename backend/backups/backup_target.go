@@ -0,0 +1,426 @@
+package backups
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of backup targets.
+const (
+	TargetLocal = "local"
+	TargetS3    = "s3"
+	TargetSFTP  = "sftp"
+)
+
+// Tries of a transfer before giving up, waiting transferRetryDelay after
+// the first failure and twice as long after each next one.
+const DEFAULT_TRANSFER_ATTEMPTS = 4
+
+var transferRetryDelay = 2 * time.Second
+
+var ErrTargetNotFound = errors.New("backup target not found")
+
+// targetCopies counts the new backups being copied to the targets.
+var targetCopies sync.WaitGroup
+
+// BackupTarget keeps copies of backups away from the backups directory,
+// laid out like it: keys are slash separated paths such as
+// "<instance>/<id>.json" or "<instance>/repository/chunks/ab/<hash>".
+type BackupTarget interface {
+	Name() string
+	// Upload streams the file at path to key, then checks the copy of the
+	// target against sum, its hex SHA-256.
+	Upload(ctx context.Context, key string, path string, sum string) error
+	// Download writes the content of key to w, an error wrapping
+	// fs.ErrNotExist when the target doesn't have it.
+	Download(ctx context.Context, key string, w io.Writer) error
+	// List returns the keys starting with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+	Close() error
+}
+
+func newBackupTarget(config backend.BackupTargetConfig) (BackupTarget, error) {
+	if config.Name == "" {
+		return nil, errors.New("a backup target has no Name")
+	}
+	switch config.Type {
+	case TargetLocal:
+		if config.Path == "" {
+			return nil, fmt.Errorf("backup target %s has no Path", config.Name)
+		}
+		return localTarget{name: config.Name, root: config.Path}, nil
+	case TargetS3:
+		return newS3Target(config)
+	case TargetSFTP:
+		return newSFTPTarget(config)
+	}
+	return nil, fmt.Errorf("backup target %s has unknown type %q, use %s, %s or %s", config.Name, config.Type, TargetLocal, TargetS3, TargetSFTP)
+}
+
+// TargetInfo describes a configured target without its credentials.
+type TargetInfo struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+func ListTargets() []TargetInfo {
+	targets := []TargetInfo{}
+	for _, config := range backend.SavedAppConfig.BackupConfig.Targets {
+		targets = append(targets, TargetInfo{Name: config.Name, Type: config.Type})
+	}
+	return targets
+}
+
+func openTarget(name string) (BackupTarget, error) {
+	for _, config := range backend.SavedAppConfig.BackupConfig.Targets {
+		if config.Name == name {
+			return newBackupTarget(config)
+		}
+	}
+	return nil, ErrTargetNotFound
+}
+
+// withRetries runs transfer until it succeeds, up to
+// DEFAULT_TRANSFER_ATTEMPTS times. Missing files aren't retried.
+func withRetries(ctx context.Context, what string, transfer func() error) error {
+	delay := transferRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := transfer()
+		if err == nil || errors.Is(err, fs.ErrNotExist) || attempt == DEFAULT_TRANSFER_ATTEMPTS || ctx.Err() != nil {
+			return err
+		}
+		fmt.Printf("\n%s failed, attempt %d of %d: %v", what, attempt, DEFAULT_TRANSFER_ATTEMPTS, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func backupKey(instance string, name string) string {
+	return instance + "/" + name
+}
+
+func chunkKey(instance string, hash string) string {
+	return backupKey(instance, "repository/chunks/"+hash[:2]+"/"+hash)
+}
+
+// UploadBackup copies a backup to a target, and records it in the
+// Copies of the backup.
+func UploadBackup(ctx context.Context, instanceID string, id string, targetName string) (Backup, error) {
+	if !backend.LockInstance(instanceID) {
+		return Backup{}, ErrBackupRunning
+	}
+	defer backend.UnlockInstance(instanceID)
+
+	backup, err := GetBackup(instanceID, id)
+	if err != nil {
+		return Backup{}, err
+	}
+	target, err := openTarget(targetName)
+	if err != nil {
+		return backup, err
+	}
+	defer target.Close()
+	if err := uploadBackup(ctx, target, backup); err != nil {
+		return backup, err
+	}
+	return addCopy(instanceID, id, target.Name())
+}
+
+// copyToTargets uploads a new backup to every configured target without
+// holding the instance, which is only locked to record each copy. A
+// failed upload, or a backup deleted meanwhile, leaves the backup out of
+// that target.
+func copyToTargets(ctx context.Context, backup Backup) {
+	for _, config := range backend.SavedAppConfig.BackupConfig.Targets {
+		target, err := newBackupTarget(config)
+		if err == nil {
+			err = uploadBackup(ctx, target, backup)
+			target.Close()
+		}
+		if err == nil {
+			if err = backend.WaitLockInstance(ctx, backup.Instance); err == nil {
+				_, err = addCopy(backup.Instance, backup.ID, config.Name)
+				backend.UnlockInstance(backup.Instance)
+			}
+		}
+		if err != nil {
+			fmt.Printf("\nCannot copy backup %s of %s to %s: %v", backup.ID, backup.Instance, config.Name, err)
+		}
+	}
+}
+
+// addCopy records a copy of a backup on a target, for a locked instance.
+func addCopy(instanceID string, id string, targetName string) (Backup, error) {
+	backup, err := GetBackup(instanceID, id)
+	if err != nil {
+		return backup, err
+	}
+	if slices.Contains(backup.Copies, targetName) {
+		return backup, nil
+	}
+	backup.Copies = append(backup.Copies, targetName)
+	return backup, writeBackupMetadata(backup)
+}
+
+// uploadBackup copies the files of a backup to a target. The archive, or
+// the snapshot and the chunks the target doesn't have yet, go first and
+// the description last, so a target only lists complete backups.
+func uploadBackup(ctx context.Context, target BackupTarget, backup Backup) error {
+	started := time.Now()
+	upload := func(key string, path string, sum string) error {
+		return withRetries(ctx, "Upload of "+key+" to "+target.Name(), func() error {
+			return target.Upload(ctx, key, path, sum)
+		})
+	}
+
+	if backup.Format == FormatIncremental {
+		manifest, err := readSnapshot(backup.Path())
+		if err != nil {
+			return err
+		}
+		var uploaded []string
+		err = withRetries(ctx, "Listing the chunks of "+target.Name(), func() (err error) {
+			uploaded, err = target.List(ctx, backupKey(backup.Instance, "repository/chunks/"))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		present := map[string]bool{}
+		for _, key := range uploaded {
+			present[key] = true
+		}
+		repo := instanceRepository(backup.Instance)
+		for _, file := range manifest.Files {
+			for _, hash := range file.Chunks {
+				key := chunkKey(backup.Instance, hash)
+				if present[key] {
+					continue
+				}
+				sum, err := fileSHA256(repo.chunkPath(hash))
+				if err != nil {
+					return err
+				}
+				if err := upload(key, repo.chunkPath(hash), sum); err != nil {
+					return err
+				}
+				present[key] = true
+			}
+		}
+	}
+	if err := upload(backupKey(backup.Instance, backup.File), backup.Path(), backup.SHA256); err != nil {
+		return err
+	}
+
+	// The description as the target has it, without the copies of this
+	// instance.
+	description := backup
+	description.Copies = nil
+	data, err := json.MarshalIndent(description, "", "  ")
+	if err != nil {
+		return err
+	}
+	staged, err := os.CreateTemp(instanceBackupsDir(backup.Instance), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged.Name())
+	_, err = staged.Write(data)
+	if closeErr := staged.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if err := upload(backupKey(backup.Instance, backup.ID+".json"), staged.Name(), hex.EncodeToString(sum[:])); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nBackup %s of %s copied to %s in %dms", backup.ID, backup.Instance, target.Name(), time.Since(started).Milliseconds())
+	return nil
+}
+
+// ListRemoteBackups returns the backups of an instance a target has,
+// newest first.
+func ListRemoteBackups(ctx context.Context, instanceID string, targetName string) ([]Backup, error) {
+	target, err := openTarget(targetName)
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+
+	var keys []string
+	err = withRetries(ctx, "Listing the backups of "+targetName, func() (err error) {
+		keys, err = target.List(ctx, backupKey(instanceID, ""))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	backups := []Backup{}
+	for _, key := range keys {
+		id := strings.TrimSuffix(path.Base(key), ".json")
+		if key != backupKey(instanceID, id+".json") || !backupIdPattern.MatchString(id) {
+			continue
+		}
+		backup, err := downloadDescription(ctx, target, instanceID, id)
+		if err != nil {
+			fmt.Printf("\nSkipping backup %s of %s on %s: %v", id, instanceID, targetName, err)
+			continue
+		}
+		backups = append(backups, backup)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
+	})
+	return backups, nil
+}
+
+func downloadDescription(ctx context.Context, target BackupTarget, instanceID string, id string) (Backup, error) {
+	var data bytes.Buffer
+	err := withRetries(ctx, "Download of backup "+id+" from "+target.Name(), func() error {
+		data.Reset()
+		return target.Download(ctx, backupKey(instanceID, id+".json"), &data)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return Backup{}, ErrBackupNotFound
+	}
+	if err != nil {
+		return Backup{}, err
+	}
+	var backup Backup
+	if err := json.Unmarshal(data.Bytes(), &backup); err != nil {
+		return Backup{}, err
+	}
+	if backup.ID != id || backup.Instance != instanceID || !validFormat(backup.Format) || filepath.Base(backup.File) != backup.File {
+		return Backup{}, fmt.Errorf("backup %s of %s on %s has an invalid description", id, instanceID, target.Name())
+	}
+	return backup, nil
+}
+
+// downloadFile writes key to path once check accepts what was downloaded.
+func downloadFile(ctx context.Context, target BackupTarget, key string, path string, check func(path string) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	defer os.Remove(path + ".tmp")
+	return withRetries(ctx, "Download of "+key+" from "+target.Name(), func() error {
+		file, err := os.Create(path + ".tmp")
+		if err != nil {
+			return err
+		}
+		err = target.Download(ctx, key, file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		if err := check(path + ".tmp"); err != nil {
+			return err
+		}
+		return os.Rename(path+".tmp", path)
+	})
+}
+
+func checkSHA256(sum string) func(path string) error {
+	return func(path string) error {
+		got, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		if got != sum {
+			return fmt.Errorf("%s has SHA-256 %s instead of %s", filepath.Base(path), got, sum)
+		}
+		return nil
+	}
+}
+
+// fetchBackup downloads a backup from a target into the backups
+// directory, unless the copies there are intact. The description of the
+// backups directory is kept when it has one.
+func fetchBackup(ctx context.Context, targetName string, instanceID string, id string) error {
+	target, err := openTarget(targetName)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	backup, err := downloadDescription(ctx, target, instanceID, id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(instanceBackupsDir(instanceID), 0755); err != nil {
+		return err
+	}
+	if checkSHA256(backup.SHA256)(backup.Path()) != nil {
+		err := downloadFile(ctx, target, backupKey(instanceID, backup.File), backup.Path(), checkSHA256(backup.SHA256))
+		if err != nil {
+			return err
+		}
+	}
+
+	if backup.Format == FormatIncremental {
+		manifest, err := readSnapshot(backup.Path())
+		if err != nil {
+			return err
+		}
+		repo := instanceRepository(instanceID)
+		for _, file := range manifest.Files {
+			for _, hash := range file.Chunks {
+				if _, err := repo.readChunk(hash); err == nil {
+					continue
+				}
+				err := downloadFile(ctx, target, chunkKey(instanceID, hash), repo.chunkPath(hash), func(path string) error {
+					return checkChunk(path, hash)
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if _, err := GetBackup(instanceID, id); errors.Is(err, ErrBackupNotFound) {
+		backup.Copies = []string{targetName}
+		if err := writeBackupMetadata(backup); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("\nBackup %s of %s fetched from %s", id, instanceID, targetName)
+	return nil
+}
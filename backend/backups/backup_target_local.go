@@ -0,0 +1,109 @@
+package backups
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localTarget copies backups to a folder, meant to be on another disk.
+type localTarget struct {
+	name string
+	root string
+}
+
+func (target localTarget) Name() string {
+	return target.name
+}
+
+func (target localTarget) path(key string) (string, error) {
+	name := filepath.FromSlash(key)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(target.root, name), nil
+}
+
+func (target localTarget) Upload(ctx context.Context, key string, path string, sum string) error {
+	destination, err := target.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return err
+	}
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	file, err := os.Create(destination + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(destination + ".tmp")
+	_, err = io.Copy(file, source)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// Read back, what the disk has is checked rather than what was sent.
+	if err := checkSHA256(sum)(destination + ".tmp"); err != nil {
+		return err
+	}
+	return os.Rename(destination+".tmp", destination)
+}
+
+func (target localTarget) Download(ctx context.Context, key string, w io.Writer) error {
+	source, err := target.path(key)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+func (target localTarget) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	// Only the folder of the prefix is walked.
+	start := filepath.Join(target.root, filepath.FromSlash(prefix[:strings.LastIndex(prefix, "/")+1]))
+	err := filepath.WalkDir(start, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		name, err := filepath.Rel(target.root, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(name); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return keys, nil
+	}
+	return keys, err
+}
+
+func (target localTarget) Close() error {
+	return nil
+}
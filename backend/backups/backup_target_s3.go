@@ -0,0 +1,387 @@
+package backups
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DEFAULT_S3_REGION = "us-east-1"
+
+// Files over this size are sent in parts of this size, retried on their
+// own. S3 takes up to 10000 parts.
+const s3PartSize = 64 << 20
+
+// SHA-256 of an empty payload.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Target copies backups to a bucket of S3 or of a compatible service,
+// MinIO, Garage, R2..., addressed by path so any endpoint works. Uploads
+// are signed with the SHA-256 of each part, which the service checks
+// against what it received and refuses otherwise: unlike the ETag, which
+// isn't the MD5 of the content in buckets encrypted with SSE-KMS, this
+// holds for every bucket. The SHA-256 of the file is kept in its
+// x-amz-meta-sha256.
+type s3Target struct {
+	name      string
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	partSize  int64
+	client    *http.Client
+}
+
+func newS3Target(config backend.BackupTargetConfig) (*s3Target, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("backup target %s needs an Endpoint and a Bucket", config.Name)
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("backup target %s has an invalid Endpoint %q", config.Name, config.Endpoint)
+	}
+	region := config.Region
+	if region == "" {
+		region = DEFAULT_S3_REGION
+	}
+	prefix := strings.Trim(config.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Target{
+		name:      config.Name,
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    config.Bucket,
+		prefix:    prefix,
+		accessKey: config.AccessKey,
+		secretKey: config.SecretKey,
+		partSize:  s3PartSize,
+		client:    &http.Client{},
+	}, nil
+}
+
+func (target *s3Target) Name() string {
+	return target.name
+}
+
+// s3Escape encodes s the way signatures expect, every byte but the
+// unreserved characters and, unless it is a query, the slashes.
+func s3Escape(s string, query bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '.', b == '_', b == '~':
+			escaped.WriteByte(b)
+		case b == '/' && !query:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signS3 adds an AWS Signature Version 4 to request, over its host, its
+// headers and payloadHash.
+func signS3(request *http.Request, accessKey string, secretKey string, region string, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	request.Header.Set("x-amz-date", amzDate)
+	request.Header.Set("x-amz-content-sha256", payloadHash)
+
+	host := request.Host
+	if host == "" {
+		host = request.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range request.Header {
+		trimmed := []string{}
+		for _, value := range values {
+			trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := request.URL.Query()
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parameters := []string{}
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			parameters = append(parameters, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		s3Escape(request.URL.Path, false),
+		strings.Join(parameters, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), amzDate[:8])
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// s3Error is the body of the errors of S3.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request for key, or for the bucket when key is "",
+// and fails unless the service answers 200. body is read from the start
+// and its length sent.
+func (target *s3Target) do(ctx context.Context, method string, key string, query url.Values, header http.Header, body io.Reader, length int64, payloadHash string) (*http.Response, error) {
+	endpoint := *target.endpoint
+	endpoint.Path = endpoint.Path + "/" + target.bucket + "/"
+	if key != "" {
+		endpoint.Path += target.prefix + key
+	}
+	endpoint.RawPath = s3Escape(endpoint.Path, false)
+	endpoint.RawQuery = query.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, method, endpoint.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	if body != nil {
+		request.ContentLength = length
+	}
+	signS3(request, target.accessKey, target.secretKey, target.region, payloadHash, time.Now())
+
+	response, err := target.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusOK || response.StatusCode == http.StatusNoContent {
+		return response, nil
+	}
+	defer response.Body.Close()
+	var failure s3Error
+	xml.NewDecoder(io.LimitReader(response.Body, 64<<10)).Decode(&failure)
+	if response.StatusCode == http.StatusNotFound && (failure.Code == "NoSuchKey" || method == http.MethodHead) {
+		return nil, fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	if failure.Code == "" {
+		failure.Code = response.Status
+	}
+	return nil, fmt.Errorf("%s %s on %s: %s %s", method, key, target.name, failure.Code, failure.Message)
+}
+
+// sendPart streams length bytes of file from offset, signed with their
+// SHA-256, and returns the ETag of the service.
+func (target *s3Target) sendPart(ctx context.Context, key string, query url.Values, header http.Header, file *os.File, offset int64, length int64) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, offset, length)); err != nil {
+		return "", err
+	}
+	body := io.NewSectionReader(file, offset, length)
+	response, err := target.do(ctx, http.MethodPut, key, query, header, body, length, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	return response.Header.Get("ETag"), nil
+}
+
+func (target *s3Target) Upload(ctx context.Context, key string, path string, sum string) error {
+	// What is sent is checked part by part, the parts against the file
+	// here.
+	if got, err := fileSHA256(path); err != nil {
+		return err
+	} else if got != sum {
+		return fmt.Errorf("%s has SHA-256 %s instead of %s", filepath.Base(path), got, sum)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header := http.Header{"x-amz-meta-sha256": {sum}}
+	if info.Size() <= target.partSize {
+		_, err := target.sendPart(ctx, key, nil, header, file, 0, info.Size())
+		return err
+	}
+	return target.uploadParts(ctx, key, header, file, info.Size())
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// uploadParts sends a file of size bytes as a multipart upload. The
+// upload is aborted when a part fails for good.
+func (target *s3Target) uploadParts(ctx context.Context, key string, header http.Header, file *os.File, size int64) error {
+	response, err := target.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadId string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(response.Body).Decode(&initiated)
+	response.Body.Close()
+	if err != nil || initiated.UploadId == "" {
+		return fmt.Errorf("starting the upload of %s to %s: %v", key, target.name, err)
+	}
+	abort := func() {
+		response, err := target.do(context.WithoutCancel(ctx), http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadId}}, nil, nil, 0, emptyPayloadHash)
+		if err == nil {
+			response.Body.Close()
+		}
+	}
+
+	parts := []s3CompletedPart{}
+	for number, offset := 1, int64(0); offset < size; number, offset = number+1, offset+target.partSize {
+		query := url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {initiated.UploadId}}
+		var etag string
+		err := withRetries(ctx, fmt.Sprintf("Upload of part %d of %s to %s", number, key, target.name), func() (err error) {
+			etag, err = target.sendPart(ctx, key, query, nil, file, offset, min(target.partSize, size-offset))
+			return err
+		})
+		if err != nil {
+			abort()
+			return err
+		}
+		parts = append(parts, s3CompletedPart{PartNumber: number, ETag: etag})
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		abort()
+		return err
+	}
+	hashed := sha256.Sum256(body)
+	response, err = target.do(ctx, http.MethodPost, key, url.Values{"uploadId": {initiated.UploadId}}, nil, bytes.NewReader(body), int64(len(body)), hex.EncodeToString(hashed[:]))
+	if err != nil {
+		abort()
+		return err
+	}
+	defer response.Body.Close()
+	// Errors of the completion can come with a 200.
+	var completed struct {
+		XMLName xml.Name
+		s3Error
+	}
+	if err := xml.NewDecoder(response.Body).Decode(&completed); err != nil {
+		abort()
+		return err
+	}
+	if completed.XMLName.Local == "Error" {
+		abort()
+		return fmt.Errorf("completing the upload of %s to %s: %s %s", key, target.name, completed.Code, completed.Message)
+	}
+	return nil
+}
+
+func (target *s3Target) Download(ctx context.Context, key string, w io.Writer) error {
+	response, err := target.do(ctx, http.MethodGet, key, nil, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+func (target *s3Target) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {target.prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		response, err := target.do(ctx, http.MethodGet, "", query, nil, nil, 0, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(object.Key, target.prefix))
+		}
+		if !page.IsTruncated {
+			return keys, nil
+		}
+		if page.NextContinuationToken == "" {
+			return nil, errors.New("truncated listing without a continuation token")
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (target *s3Target) Close() error {
+	target.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,264 @@
+package backups
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const DEFAULT_SFTP_PORT = "22"
+
+// sftpTarget copies backups to a folder of an SSH server. SFTP has no
+// checksum command, a copy is checked by reading it back.
+type sftpTarget struct {
+	name    string
+	address string
+	root    string
+	config  *ssh.ClientConfig
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func newSFTPTarget(config backend.BackupTargetConfig) (*sftpTarget, error) {
+	if config.Address == "" || config.User == "" {
+		return nil, fmt.Errorf("backup target %s needs an Address and a User", config.Name)
+	}
+	if config.HostKey == "" {
+		return nil, fmt.Errorf("backup target %s needs the HostKey of the server", config.Name)
+	}
+	hostKey, err := parseHostKey(config.HostKey)
+	if err != nil {
+		return nil, fmt.Errorf("backup target %s: %w", config.Name, err)
+	}
+
+	auth := []ssh.AuthMethod{}
+	if config.PrivateKeyPath != "" {
+		pem, err := os.ReadFile(config.PrivateKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("backup target %s: %w", config.Name, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if config.Password != "" {
+		auth = append(auth, ssh.Password(config.Password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("backup target %s needs a Password or a PrivateKeyPath", config.Name)
+	}
+
+	address := config.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, DEFAULT_SFTP_PORT)
+	}
+	// Relative to the home folder of the user.
+	root := "."
+	if config.Path != "" {
+		root = path.Clean(config.Path)
+	}
+	return &sftpTarget{
+		name:    config.Name,
+		address: address,
+		root:    root,
+		config: &ssh.ClientConfig{
+			User:            config.User,
+			Auth:            auth,
+			HostKeyCallback: ssh.FixedHostKey(hostKey),
+			Timeout:         30 * time.Second,
+		},
+	}, nil
+}
+
+// parseHostKey reads a key as in authorized_keys, "ssh-ed25519 AAAA...",
+// or as in known_hosts, with the host first.
+func parseHostKey(line string) (ssh.PublicKey, error) {
+	if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err == nil {
+		return key, nil
+	}
+	_, _, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+	if err != nil {
+		return nil, errors.New("the HostKey isn't a public key")
+	}
+	return key, nil
+}
+
+func (target *sftpTarget) Name() string {
+	return target.name
+}
+
+// connect returns the SFTP session, opened on first use or after a
+// failure.
+func (target *sftpTarget) connect(ctx context.Context) (*sftp.Client, error) {
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	if target.client != nil {
+		return target.client, nil
+	}
+	dialer := net.Dialer{Timeout: target.config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", target.address)
+	if err != nil {
+		return nil, err
+	}
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, target.address, target.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	target.conn = ssh.NewClient(sshConn, channels, requests)
+	target.client, err = sftp.NewClient(target.conn)
+	if err != nil {
+		target.conn.Close()
+		target.conn = nil
+		return nil, err
+	}
+	return target.client, nil
+}
+
+// run runs operation on the session, dropped when it fails so a retry
+// starts a new one. Missing files aren't failures of the session.
+func (target *sftpTarget) run(ctx context.Context, operation func(client *sftp.Client) error) error {
+	client, err := target.connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = operation(client)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		target.Close()
+	}
+	return err
+}
+
+func (target *sftpTarget) path(key string) (string, error) {
+	clean := path.Clean(key)
+	if !fs.ValidPath(clean) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return path.Join(target.root, clean), nil
+}
+
+func (target *sftpTarget) Upload(ctx context.Context, key string, local string, sum string) error {
+	destination, err := target.path(key)
+	if err != nil {
+		return err
+	}
+	source, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	return target.run(ctx, func(client *sftp.Client) error {
+		if err := client.MkdirAll(path.Dir(destination)); err != nil {
+			return err
+		}
+		file, err := client.Create(destination + ".tmp")
+		if err != nil {
+			return err
+		}
+		_, err = file.ReadFrom(source)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = target.checkRemote(client, destination+".tmp", sum)
+		}
+		if err != nil {
+			client.Remove(destination + ".tmp")
+			return err
+		}
+		return client.PosixRename(destination+".tmp", destination)
+	})
+}
+
+// checkRemote reads a remote file back and compares its SHA-256 with sum.
+func (target *sftpTarget) checkRemote(client *sftp.Client, remote string, sum string) error {
+	file, err := client.Open(remote)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := file.WriteTo(hash); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != sum {
+		return fmt.Errorf("the copy of %s has SHA-256 %s instead of %s", path.Base(remote), got, sum)
+	}
+	return nil
+}
+
+func (target *sftpTarget) Download(ctx context.Context, key string, w io.Writer) error {
+	source, err := target.path(key)
+	if err != nil {
+		return err
+	}
+	return target.run(ctx, func(client *sftp.Client) error {
+		file, err := client.Open(source)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = file.WriteTo(w)
+		return err
+	})
+}
+
+func (target *sftpTarget) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	err := target.run(ctx, func(client *sftp.Client) error {
+		// Only the folder of the prefix is walked.
+		start := path.Join(target.root, prefix[:strings.LastIndex(prefix, "/")+1])
+		walker := client.Walk(start)
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				if errors.Is(err, fs.ErrNotExist) && walker.Path() == start {
+					return nil
+				}
+				return err
+			}
+			if walker.Stat().IsDir() || strings.HasSuffix(walker.Path(), ".tmp") {
+				continue
+			}
+			key := walker.Path()
+			if target.root != "." {
+				key = strings.TrimPrefix(strings.TrimPrefix(key, target.root), "/")
+			}
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (target *sftpTarget) Close() error {
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	if target.client == nil {
+		return nil
+	}
+	target.client.Close()
+	err := target.conn.Close()
+	target.client, target.conn = nil, nil
+	return err
+}
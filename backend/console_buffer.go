@@ -0,0 +1,116 @@
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	consoleBufferSize   = 1000
+	consoleHistoryLimit = 200
+)
+
+// ConsoleLine is one line of console output. Level is the message type
+// the frontend colors by: "log", "warn", "error", "player" or "stopped".
+type ConsoleLine struct {
+	Seq   uint64    `json:"seq"`
+	Level string    `json:"type"`
+	Text  string    `json:"text"`
+	Time  time.Time `json:"time"`
+	// Set when the server colored the line, Text is then the same text
+	// without escape sequences.
+	Spans []ConsoleSpan `json:"spans,omitempty"`
+}
+
+// consoleBuffer keeps the most recent console lines in a ring so clients
+// that connect late can be brought up to date. Sequence numbers start at 1
+// and never repeat for the lifetime of the instance.
+type consoleBuffer struct {
+	mu      sync.Mutex
+	lines   []ConsoleLine
+	start   int
+	count   int
+	nextSeq uint64
+	// Closed and replaced on every new line, see McServer.WaitConsoleLine.
+	changed chan struct{}
+}
+
+func newConsoleBuffer(size int) *consoleBuffer {
+	return &consoleBuffer{
+		lines:   make([]ConsoleLine, size),
+		nextSeq: 1,
+		changed: make(chan struct{}),
+	}
+}
+
+// append stores a line and returns it with its sequence number.
+// Callers hold buf.mu.
+func (buf *consoleBuffer) append(level string, text string, spans []ConsoleSpan) ConsoleLine {
+	line := ConsoleLine{
+		Seq:   buf.nextSeq,
+		Level: level,
+		Text:  text,
+		Time:  time.Now(),
+		Spans: spans,
+	}
+	buf.nextSeq++
+	close(buf.changed)
+	buf.changed = make(chan struct{})
+
+	if buf.count < len(buf.lines) {
+		buf.lines[(buf.start+buf.count)%len(buf.lines)] = line
+		buf.count++
+	} else {
+		buf.lines[buf.start] = line
+		buf.start = (buf.start + 1) % len(buf.lines)
+	}
+	return line
+}
+
+func (buf *consoleBuffer) at(i int) ConsoleLine {
+	return buf.lines[(buf.start+i)%len(buf.lines)]
+}
+
+// tail returns up to limit of the newest lines, oldest first.
+// Callers hold buf.mu.
+func (buf *consoleBuffer) tail(limit int) []ConsoleLine {
+	return buf.before(buf.nextSeq, limit)
+}
+
+// before returns up to limit lines whose sequence number is lower than seq,
+// oldest first. Callers hold buf.mu.
+func (buf *consoleBuffer) before(seq uint64, limit int) []ConsoleLine {
+	end := buf.count
+	for end > 0 && buf.at(end-1).Seq >= seq {
+		end--
+	}
+	begin := end - limit
+	if begin < 0 {
+		begin = 0
+	}
+
+	lines := make([]ConsoleLine, 0, end-begin)
+	for i := begin; i < end; i++ {
+		lines = append(lines, buf.at(i))
+	}
+	return lines
+}
+
+func (buf *consoleBuffer) Before(seq uint64, limit int) []ConsoleLine {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	return buf.before(seq, limit)
+}
+
+// after returns the lines newer than seq, oldest first. Callers hold buf.mu.
+func (buf *consoleBuffer) after(seq uint64) []ConsoleLine {
+	begin := buf.count
+	for begin > 0 && buf.at(begin-1).Seq > seq {
+		begin--
+	}
+	lines := make([]ConsoleLine, 0, buf.count-begin)
+	for i := begin; i < buf.count; i++ {
+		lines = append(lines, buf.at(i))
+	}
+	return lines
+}
@@ -0,0 +1,41 @@
+package backend
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestConsoleBufferKeepsNewestLines(t *testing.T) {
+	buf := newConsoleBuffer(3)
+	for i := 1; i <= 5; i++ {
+		buf.append("log", fmt.Sprintf("line %d", i), nil)
+	}
+
+	lines := buf.tail(10)
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %d", len(lines))
+	}
+	for i, line := range lines {
+		if line.Seq != uint64(i+3) || line.Text != fmt.Sprintf("line %d", i+3) {
+			t.Errorf("unexpected line %+v at %d", line, i)
+		}
+	}
+}
+
+func TestConsoleBufferBefore(t *testing.T) {
+	buf := newConsoleBuffer(10)
+	for i := 1; i <= 8; i++ {
+		buf.append("warn", fmt.Sprintf("line %d", i), nil)
+	}
+
+	lines := buf.Before(6, 2)
+	if len(lines) != 2 || lines[0].Seq != 4 || lines[1].Seq != 5 {
+		t.Fatalf("unexpected page %+v", lines)
+	}
+	if lines[0].Level != "warn" {
+		t.Errorf("level not kept: %s", lines[0].Level)
+	}
+	if lines := buf.Before(1, 5); len(lines) != 0 {
+		t.Errorf("expected no lines before the first one, got %+v", lines)
+	}
+}
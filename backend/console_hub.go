@@ -0,0 +1,126 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	subscriberBufferSize = 256
+	subscriberWriteWait  = 10 * time.Second
+)
+
+// consoleHub fans console output out to every WebSocket client of an
+// instance. Broadcast never blocks: a client that can't keep up is dropped.
+type consoleHub struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	ws   *websocket.Conn
+	send chan []byte
+}
+
+func newConsoleHub() *consoleHub {
+	return &consoleHub{subscribers: make(map[*subscriber]struct{})}
+}
+
+// Subscribe registers ws and starts the goroutine that owns its writes.
+// Nothing else may write to ws afterwards; use Send instead.
+func (hub *consoleHub) Subscribe(ws *websocket.Conn) *subscriber {
+	sub := &subscriber{
+		ws:   ws,
+		send: make(chan []byte, subscriberBufferSize),
+	}
+
+	hub.mu.Lock()
+	hub.subscribers[sub] = struct{}{}
+	hub.mu.Unlock()
+
+	go hub.writeLoop(sub)
+	return sub
+}
+
+func (hub *consoleHub) Unsubscribe(sub *subscriber) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if _, ok := hub.subscribers[sub]; ok {
+		delete(hub.subscribers, sub)
+		close(sub.send)
+	}
+}
+
+func (hub *consoleHub) writeLoop(sub *subscriber) {
+	for msg := range sub.send {
+		sub.ws.SetWriteDeadline(time.Now().Add(subscriberWriteWait))
+		if err := sub.ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+			fmt.Printf("\nDropping WebSocket client %s: %v", sub.ws.RemoteAddr(), err)
+			hub.Unsubscribe(sub)
+			sub.ws.Close()
+			break
+		}
+	}
+	// Drain whatever was queued before the channel was closed.
+	for range sub.send {
+	}
+}
+
+// Send queues msg for a single subscriber.
+func (hub *consoleHub) Send(sub *subscriber, msg []byte) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if _, ok := hub.subscribers[sub]; !ok {
+		return
+	}
+	select {
+	case sub.send <- msg:
+	default:
+		hub.drop(sub)
+	}
+}
+
+func (hub *consoleHub) Broadcast(msg []byte) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for sub := range hub.subscribers {
+		select {
+		case sub.send <- msg:
+		default:
+			hub.drop(sub)
+		}
+	}
+}
+
+// drop disconnects a subscriber whose buffer is full. Callers hold hub.mu.
+func (hub *consoleHub) drop(sub *subscriber) {
+	fmt.Printf("\nDropping slow WebSocket client %s", sub.ws.RemoteAddr())
+	delete(hub.subscribers, sub)
+	close(sub.send)
+	sub.ws.Close()
+}
+
+func (hub *consoleHub) BroadcastJSON(v interface{}) {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		fmt.Printf("\nError encoding console message: %v", err)
+		return
+	}
+	hub.Broadcast(msg)
+}
+
+func (hub *consoleHub) SendJSON(sub *subscriber, v interface{}) {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		fmt.Printf("\nError encoding console message: %v", err)
+		return
+	}
+	hub.Send(sub, msg)
+}
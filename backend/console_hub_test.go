@@ -0,0 +1,100 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newHubServer(t *testing.T, hub *consoleHub) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		sub := hub.Subscribe(ws)
+		defer hub.Unsubscribe(sub)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func dialHub(t *testing.T, server *httptest.Server) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func waitForSubscribers(t *testing.T, hub *consoleHub, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		hub.mu.Lock()
+		count := len(hub.subscribers)
+		hub.mu.Unlock()
+		if count == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d subscribers", n)
+}
+
+func TestConsoleHubBroadcastsToEveryClient(t *testing.T) {
+	hub := newConsoleHub()
+	server := newHubServer(t, hub)
+
+	first := dialHub(t, server)
+	second := dialHub(t, server)
+	waitForSubscribers(t, hub, 2)
+
+	hub.BroadcastJSON(map[string]string{"type": "log", "text": "Done (1.234s)! For help, type \"help\""})
+
+	for _, ws := range []*websocket.Conn{first, second} {
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(msg), "Done (1.234s)") {
+			t.Errorf("unexpected message %s", msg)
+		}
+	}
+}
+
+func TestConsoleHubDropsSlowClient(t *testing.T) {
+	hub := newConsoleHub()
+	server := newHubServer(t, hub)
+
+	// Never read from this client so its buffer fills up.
+	dialHub(t, server)
+	waitForSubscribers(t, hub, 1)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < subscriberBufferSize*64; i++ {
+			hub.BroadcastJSON(map[string]string{"type": "log", "text": strings.Repeat("x", 1024)})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Broadcast blocked on a slow client")
+	}
+	waitForSubscribers(t, hub, 0)
+}
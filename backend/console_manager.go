@@ -3,13 +3,18 @@ package backend
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
+	"os"
 	"os/exec"
 	"regexp"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-echarts/go-echarts/v2/charts"
@@ -26,198 +31,279 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-var mcServer = &McServer{}
-
 type McServer struct {
+	config    InstanceConfig
 	cmd       *exec.Cmd
+	process   *os.Process
 	stdin     *bufio.Writer
 	mu        sync.Mutex
-	active    bool
-	ws        *websocket.Conn
+	state     ServerState
+	startedAt time.Time
+	hub       *consoleHub
+	console   *consoleBuffer
 	lastStats Stats
 	players   Players
+
+	stopRequested bool
+	supervisor    supervisorState
+	exited        chan struct{}
+	forcedSignal  syscall.Signal
+	stopping      bool
+	lastExit      ExitInfo
+	eulaRequired  bool
+
+	// Closed once the process of the current start runs or failed to
+	// launch, Stop waits on it before writing "stop".
+	launched chan struct{}
+
+	// Closed and replaced on every state change, see WaitState.
+	stateChanged chan struct{}
+
+	// Held while talking to the server over RCON, rcon is connected on
+	// first use.
+	rconMu sync.Mutex
+	rcon   *RconClient
+}
+
+func NewMcServer(config InstanceConfig) *McServer {
+	exited := make(chan struct{})
+	close(exited)
+	launched := make(chan struct{})
+	close(launched)
+
+	return &McServer{
+		state:        StateStopped,
+		stateChanged: make(chan struct{}),
+		config:       config,
+		hub:          newConsoleHub(),
+		console:      newConsoleBuffer(consoleBufferSize),
+		exited:       exited,
+		launched:     launched,
+	}
+}
+
+func (mc *McServer) ID() string {
+	return mc.config.ID
+}
+
+func (mc *McServer) Config() InstanceConfig {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.config
+}
+
+func (mc *McServer) IsActive() bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.state.IsAlive()
 }
 
 type Stats struct {
+	// Written by sampleStats, read by the chart handlers.
+	mu  sync.Mutex
 	cpu []float64
 	ram []uint64
 }
 type Players struct {
-	playersNames   []string
+	mu           sync.Mutex
+	playersNames []string
+	// One count per poll, see pollPlayers.
 	playersNumbers []int
+	last           PlayersStatus
 }
 
 type HTMXMessage struct {
 	Command string            `json:"command"`
 	Headers map[string]string `json:"HEADERS"`
+
+	// Set by the client to page through scrollback older than a sequence
+	// number. HTMX sends form values as strings.
+	HistoryBefore uint64 `json:"history_before,string"`
+	Limit         int    `json:"limit,string"`
 }
 
-func logMessage(ws *websocket.Conn, msgType string, text string) {
-	if ws == nil {
-		return
+type consoleHistory struct {
+	Type  string        `json:"type"`
+	Lines []ConsoleLine `json:"lines"`
+}
+
+// logMessage records a console line in the scrollback and sends it to
+// every client.
+func (mc *McServer) logMessage(msgType string, text string) {
+	mc.logStyledMessage(msgType, text, nil)
+}
+
+// logStyledMessage is logMessage for a line that kept its terminal colors.
+func (mc *McServer) logStyledMessage(msgType string, text string, spans []ConsoleSpan) {
+	mc.console.mu.Lock()
+	defer mc.console.mu.Unlock()
+
+	line := mc.console.append(msgType, text, spans)
+	mc.hub.BroadcastJSON(line)
+}
+
+// ConsoleSeq returns the sequence number of the newest console line, 0
+// before the first one.
+func (mc *McServer) ConsoleSeq() uint64 {
+	mc.console.mu.Lock()
+	defer mc.console.mu.Unlock()
+	return mc.console.nextSeq - 1
+}
+
+// WaitConsoleLine blocks until a console line newer than seq matches
+// pattern and returns it, or until ctx ends.
+func (mc *McServer) WaitConsoleLine(ctx context.Context, seq uint64, pattern *regexp.Regexp) (ConsoleLine, error) {
+	for {
+		mc.console.mu.Lock()
+		lines, changed := mc.console.after(seq), mc.console.changed
+		mc.console.mu.Unlock()
+
+		for _, line := range lines {
+			if pattern.MatchString(line.Text) {
+				return line, nil
+			}
+			seq = line.Seq
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ConsoleLine{}, ctx.Err()
+		}
 	}
-	msg, _ := json.Marshal(map[string]string{
-		"type": msgType,
-		"text": text,
+}
+
+// attachClient subscribes ws to the console, replays the scrollback as a
+// single "history" message and sends the current state. Holding the locks
+// guarantees nothing is missed or sent twice before the live stream.
+func (mc *McServer) attachClient(ws *websocket.Conn) *subscriber {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.console.mu.Lock()
+	defer mc.console.mu.Unlock()
+
+	sub := mc.hub.Subscribe(ws)
+	mc.hub.SendJSON(sub, consoleHistory{
+		Type:  "history",
+		Lines: mc.console.tail(consoleBufferSize),
 	})
-	ws.WriteMessage(websocket.TextMessage, msg)
+	mc.hub.SendJSON(sub, mc.status())
+	return sub
 }
 
+// Start launches the server on behalf of the user, which also cancels any
+// automatic restart that is pending.
 func (mc *McServer) Start() error {
-	fmt.Println("\nAttempting to start Minecraft server")
 	mc.mu.Lock()
-	if mc.active {
-		mc.mu.Unlock()
+	mc.cancelRestart()
+	mc.mu.Unlock()
+
+	return mc.start()
+}
+
+func (mc *McServer) start() error {
+	fmt.Printf("\nAttempting to start Minecraft server %s", mc.ID())
+	alreadyRunning := func() error {
 		fmt.Println("Server start failed: already running")
-		if mc.ws != nil {
-			logMessage(mcServer.ws, "log", "Server already running!")
-		}
+		mc.logMessage("log", "Server already running!")
 		return fmt.Errorf("\nserver already running")
 	}
-	mc.active = true
+	mc.mu.Lock()
+	if mc.state.IsAlive() {
+		mc.mu.Unlock()
+		return alreadyRunning()
+	}
+	config := mc.config
 	mc.mu.Unlock()
 
-	command := "java"
-	arg1 := "-Xmx" + SavedAppConfig.MinecraftServerConfig.MaxAllowedRam
-	arg2 := "-Xms" + SavedAppConfig.MinecraftServerConfig.MinAllowedRam
-	arg3 := "-jar"
-	arg4 := SavedAppConfig.MinecraftServerConfig.ServerJarName
-	arg5 := SavedAppConfig.MinecraftServerConfig.OthersCommandArguments
+	// Probing java takes a while, it is done before the server is Starting
+	// so a stop in the meantime never waits on it.
+	launch, err := LaunchCommandFor(config)
 
-	cmd := exec.Command(command, arg1, arg2, arg3, arg4, arg5)
-	cmd.Dir = SavedAppConfig.MinecraftServerConfig.PathToMcServers
-	mc.cmd = cmd
+	mc.mu.Lock()
+	if mc.state.IsAlive() {
+		mc.mu.Unlock()
+		return alreadyRunning()
+	}
+	mc.setState(StateStarting)
+	mc.stopRequested = false
+	mc.stopping = false
+	mc.forcedSignal = 0
+	exited := make(chan struct{})
+	mc.exited = exited
+	mc.launched = make(chan struct{})
+	mc.mu.Unlock()
 
-	fmt.Printf("\nExecuting command: %s %s %s %s in directory %s", command, arg1, arg2, arg3, SavedAppConfig.MinecraftServerConfig.PathToMcServers)
+	if err != nil {
+		fmt.Printf("\nCannot start server: %v", err)
+		mc.logMessage("error", "Cannot start server: "+err.Error())
+		mc.startFailed(exited)
+		return err
+	}
+
+	fmt.Printf("\nExecuting command: %s in directory %s", launch, config.Directory)
+
+	if config.Detached {
+		return mc.startDetached(config, exited, launch)
+	}
+
+	cmd := exec.Command(launch.Path, launch.Args...)
+	cmd.Dir = config.Directory
+	cmd.Env = launch.Environ()
+
+	if config.Pty {
+		return mc.startPty(cmd, exited)
+	}
 
 	// Pipes from cmd
-	stdout, err := mc.cmd.StdoutPipe()
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		fmt.Printf("\nError getting stdout pipe: %v", err)
-		mc.active = false
+		mc.startFailed(exited)
 		return err
 	}
 
-	stderr, err := mc.cmd.StderrPipe()
+	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		fmt.Printf("\nError getting stderr pipe: %v", err)
-		mc.active = false
+		mc.startFailed(exited)
 		return err
 	}
 
-	stdin, err := mc.cmd.StdinPipe()
+	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		fmt.Printf("\nError getting stdin pipe: %v", err)
-		mc.active = false
+		mc.startFailed(exited)
 		return err
 	}
-	mc.stdin = bufio.NewWriter(stdin)
 
 	// Run the Command
-	if err := mc.cmd.Start(); err != nil {
+	if err := cmd.Start(); err != nil {
 		fmt.Printf("\nError starting server: %v", err)
-		mc.active = false
+		mc.startFailed(exited)
 		return err
 	}
-	pid := int32(cmd.Process.Pid)
+	mc.mu.Lock()
+	mc.cmd = cmd
+	mc.process = cmd.Process
+	mc.stdin = bufio.NewWriter(stdin)
+	mc.launchFinished()
+	mc.mu.Unlock()
 
 	fmt.Println("Minecraft server process started successfully")
 
-	go func() {
-		proc, _ := process.NewProcess(pid)
-		proc.CPUPercent()
-		time.Sleep(100 * time.Millisecond)
-		for {
-
-			memInfo, _ := proc.MemoryInfo()
-
-			cpuPercent, _ := proc.CPUPercent()
-			numCores, _ := cpu.Counts(true)
-			normalizedCpuPercent := cpuPercent / float64(numCores)
-			mbOfRam := memInfo.RSS / 1024 / 1024
-
-			if mc.ws != nil {
-				mc.lastStats.cpu = append(mc.lastStats.cpu, normalizedCpuPercent)
-				if len(mc.lastStats.cpu) > 30 {
-					mc.lastStats.cpu = mc.lastStats.cpu[1:]
-				}
-				mc.lastStats.ram = append(mc.lastStats.ram, mbOfRam)
-				if len(mc.lastStats.ram) > 30 {
-					mc.lastStats.ram = mc.lastStats.ram[1:]
-				}
-				stats, _ := json.Marshal(map[string]interface{}{
-					"type":   "stats",
-					"cpu":    normalizedCpuPercent,
-					"ram_mb": mbOfRam,
-				})
-				mc.ws.WriteMessage(websocket.TextMessage, stats)
-			}
+	go mc.sampleStats(int32(cmd.Process.Pid))
+	go mc.pollPlayers(exited)
 
-			time.Sleep(2 * time.Second)
-		}
-	}()
+	// Wait closes the pipes, the last lines before an exit are read first.
+	var output sync.WaitGroup
+	output.Add(2)
 
 	// Pipe stdout to websocket
 	go func() {
+		defer output.Done()
 		scanner := bufio.NewScanner(stdout)
 		for scanner.Scan() {
-			text := scanner.Text()
-			var logLevel = regexp.MustCompile(`\[Server thread/(\w+)\]`)
-
-			var playerJoin = regexp.MustCompile(`([\w\-.]+) joined the game`)
-			var playerLeave = regexp.MustCompile(`([\w\-.]+) left the game`)
-
-			if match := logLevel.FindStringSubmatch(text); match != nil {
-				switch match[1] {
-				case "ERROR":
-					logMessage(mc.ws, "error", text)
-				case "WARN":
-					logMessage(mc.ws, "warn", text)
-				default:
-					logMessage(mc.ws, "log", text)
-				}
-			} else {
-				logMessage(mc.ws, "log", text)
-			}
-
-			if match := playerJoin.FindStringSubmatch(text); match != nil {
-				player := match[1]
-				mc.players.playersNames = append(mc.players.playersNames, player)
-				playerNumber := len(mc.players.playersNames)
-				if len(mc.players.playersNames) >= 0 {
-					playerNumber += 1
-				} else {
-					playerNumber = 0
-				}
-				mc.players.playersNumbers = append(mc.players.playersNumbers, playerNumber)
-				stats, _ := json.Marshal(map[string]interface{}{
-					"type":   "player",
-					"name":   player,
-					"number": playerNumber,
-				})
-				mc.ws.WriteMessage(websocket.TextMessage, stats)
-				fmt.Println(mc.players)
-			}
-
-			if match := playerLeave.FindStringSubmatch(text); match != nil {
-				player := match[1]
-				for i, p := range mc.players.playersNames {
-					if p == player {
-						mc.players.playersNames = append(mc.players.playersNames[:i], mc.players.playersNames[i+1:]...)
-						playerNumber := len(mc.players.playersNames)
-						if len(mc.players.playersNames) >= 0 {
-							playerNumber += 1
-						} else {
-							playerNumber = 0
-						}
-						mc.players.playersNumbers = append(mc.players.playersNumbers, len(mc.players.playersNames))
-						break
-					}
-				}
-				logMessage(mc.ws, "player", player)
-				fmt.Println(mc.players)
-			}
-
+			mc.handleConsoleLine(scanner.Text())
 		}
 		if err := scanner.Err(); err != nil {
 			fmt.Printf("\nError reading stdout: %v", err)
@@ -226,11 +312,12 @@ func (mc *McServer) Start() error {
 
 	// Pipe stderr to websocket
 	go func() {
+		defer output.Done()
 		scanner := bufio.NewScanner(stderr)
 		for scanner.Scan() {
-			text := scanner.Text()
+			text, spans := parseANSI(scanner.Text())
 			fmt.Printf("\n[MC-STDERR] %s", text)
-			logMessage(mc.ws, "error", text) // "error" type so frontend can color it red
+			mc.logStyledMessage("error", text, spans) // "error" type so frontend can color it red
 		}
 		if err := scanner.Err(); err != nil {
 			fmt.Printf("\nError reading stderr: %v", err)
@@ -239,52 +326,241 @@ func (mc *McServer) Start() error {
 
 	// Wait for process to finish
 	go func() {
-		err := mc.cmd.Wait()
-		mc.mu.Lock()
-		mc.active = false
-		mc.mu.Unlock()
-
+		output.Wait()
+		err := cmd.Wait()
 		if err != nil {
 			fmt.Printf("\nServer process exited with error: %v", err)
-			logMessage(mc.ws, "stopped", "Server stopped with error: "+err.Error())
 		} else {
 			fmt.Println("Server process exited normally")
-			logMessage(mc.ws, "stopped", "Server stopped")
 		}
+		mc.processExited(cmd.ProcessState.ExitCode(), exited)
 	}()
 
 	return nil
 }
 
+// sampleStats records CPU and RAM usage of pid every two seconds until the
+// process is gone.
+func (mc *McServer) sampleStats(pid int32) {
+	proc, err := process.NewProcess(pid)
+	if err != nil {
+		return
+	}
+	proc.CPUPercent()
+	time.Sleep(100 * time.Millisecond)
+	for {
+
+		memInfo, err := proc.MemoryInfo()
+		if err != nil {
+			// The process is gone, stop sampling.
+			return
+		}
+
+		cpuPercent, _ := proc.CPUPercent()
+		numCores, _ := cpu.Counts(true)
+		normalizedCpuPercent := cpuPercent / float64(numCores)
+		mbOfRam := memInfo.RSS / 1024 / 1024
+
+		mc.lastStats.mu.Lock()
+		mc.lastStats.cpu = append(mc.lastStats.cpu, normalizedCpuPercent)
+		if len(mc.lastStats.cpu) > 30 {
+			mc.lastStats.cpu = mc.lastStats.cpu[1:]
+		}
+		mc.lastStats.ram = append(mc.lastStats.ram, mbOfRam)
+		if len(mc.lastStats.ram) > 30 {
+			mc.lastStats.ram = mc.lastStats.ram[1:]
+		}
+		mc.lastStats.mu.Unlock()
+		mc.hub.BroadcastJSON(map[string]interface{}{
+			"type":   "stats",
+			"cpu":    normalizedCpuPercent,
+			"ram_mb": mbOfRam,
+		})
+
+		time.Sleep(2 * time.Second)
+	}
+}
+
+var logLevel = regexp.MustCompile(`\[Server thread/(\w+)\]`)
+
+var playerJoin = regexp.MustCompile(`([\w\-.]+) joined the game`)
+var playerLeave = regexp.MustCompile(`([\w\-.]+) left the game`)
+
+// consoleLevel classifies a line of server output for the frontend.
+func consoleLevel(text string) string {
+	if match := logLevel.FindStringSubmatch(text); match != nil {
+		switch match[1] {
+		case "ERROR":
+			return "error"
+		case "WARN":
+			return "warn"
+		}
+	}
+	return "log"
+}
+
+// handleConsoleLine forwards one line of server output to the clients and
+// updates the state and player list from it. Escape sequences are stripped
+// before the line is matched, colors are kept as spans for the clients.
+func (mc *McServer) handleConsoleLine(raw string) {
+	text, spans := parseANSI(raw)
+	mc.logStyledMessage(consoleLevel(text), text, spans)
+
+	if doneLine.MatchString(text) {
+		mc.mu.Lock()
+		if mc.state == StateStarting {
+			mc.eulaRequired = false
+			mc.setState(StateRunning)
+		}
+		mc.mu.Unlock()
+	}
+
+	if eulaLine.MatchString(text) {
+		mc.markEulaRequired()
+	}
+
+	if match := playerJoin.FindStringSubmatch(text); match != nil {
+		mc.playerJoined(match[1])
+	}
+
+	if match := playerLeave.FindStringSubmatch(text); match != nil {
+		mc.playerLeft(match[1])
+	}
+}
+
+// playerJoined adds a player seen in the console to the list, until the
+// next poll replaces it with what the server reports.
+func (mc *McServer) playerJoined(player string) {
+	mc.players.mu.Lock()
+	mc.players.playersNames = append(mc.players.playersNames, player)
+	playerNumber := len(mc.players.playersNames)
+	mc.players.mu.Unlock()
+
+	mc.hub.BroadcastJSON(map[string]interface{}{
+		"type":   "player",
+		"name":   player,
+		"number": playerNumber,
+	})
+}
+
+func (mc *McServer) playerLeft(player string) {
+	mc.players.mu.Lock()
+	for i, p := range mc.players.playersNames {
+		if p == player {
+			mc.players.playersNames = append(mc.players.playersNames[:i], mc.players.playersNames[i+1:]...)
+			break
+		}
+	}
+	mc.players.mu.Unlock()
+
+	mc.logMessage("player", player)
+}
+
+// processExited records how the server process ended, tells the clients and
+// lets the supervisor decide whether to restart it.
+func (mc *McServer) processExited(code int, exited chan struct{}) {
+	mc.mu.Lock()
+	stopRequested := mc.stopRequested
+	exit := describeExit(code, mc.forcedSignal, stopRequested)
+	wasStarting := mc.state == StateStarting
+	mc.lastExit = exit
+	mc.process = nil
+	if exit.Reason == ExitCrashed {
+		mc.setState(StateCrashed)
+	} else {
+		mc.setState(StateStopped)
+	}
+	mc.mu.Unlock()
+	close(exited)
+
+	// Nobody is online anymore, the last poll and its history included.
+	mc.players.mu.Lock()
+	mc.players.playersNames = nil
+	mc.players.playersNumbers = nil
+	mc.players.last = PlayersStatus{}
+	mc.players.mu.Unlock()
+
+	mc.logMessage("stopped", exit.Text())
+	mc.hub.BroadcastJSON(map[string]interface{}{
+		"type":   "exit",
+		"reason": exit.Reason,
+		"code":   exit.Code,
+	})
+
+	mc.checkEulaAfterExit(exit, wasStarting)
+	mc.superviseExit(exit, stopRequested)
+}
+
+// startFailed records a process that could not be launched.
+func (mc *McServer) startFailed(exited chan struct{}) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.lastExit = ExitInfo{Reason: ExitCrashed, Code: -1, Time: time.Now()}
+	mc.setState(StateCrashed)
+	mc.launchFinished()
+	close(exited)
+}
+
+// launchFinished wakes a Stop waiting for the process to launch. mc.mu
+// must be held.
+func (mc *McServer) launchFinished() {
+	select {
+	case <-mc.launched:
+	default:
+		close(mc.launched)
+	}
+}
+
+// writeConsole writes line to the server's console input. mc.mu must be
+// held.
+func (mc *McServer) writeConsole(line string) error {
+	if mc.process == nil || mc.stdin == nil {
+		return errors.New("server is still launching")
+	}
+	if _, err := mc.stdin.WriteString(line + "\n"); err != nil {
+		return err
+	}
+	return mc.stdin.Flush()
+}
+
 func (mc *McServer) Stop() error {
+	mc.mu.Lock()
+	if mc.cancelRestart() && !mc.state.IsAlive() {
+		mc.mu.Unlock()
+		fmt.Println("Pending automatic restart cancelled")
+		mc.logMessage("stopped", "Automatic restart cancelled")
+		return nil
+	}
+	launched := mc.launched
+	mc.mu.Unlock()
+
+	// "stop" can only be written once the process runs, a server still
+	// being launched is stopped as soon as it is.
+	<-launched
+
 	mc.mu.Lock()
 	defer mc.mu.Unlock()
 
-	if !mc.active {
+	if !mc.state.IsAlive() {
 		fmt.Println("Cannot stop server: not running")
 		return fmt.Errorf("\nserver not running")
 	}
 
 	fmt.Println("Stopping Minecraft server...")
-
-	_, err := mc.stdin.WriteString("stop\n")
-	if err != nil {
-		fmt.Printf("\nError writing stop command: %v", err)
-		return err
-	}
-
-	if err := mc.stdin.Flush(); err != nil {
-		fmt.Printf("\nError flushing stop command: %v", err)
+	if err := mc.writeConsole("stop"); err != nil {
+		fmt.Printf("\nError sending stop command: %v", err)
 		return err
 	}
-
 	fmt.Println("Stop command sent successfully")
+
+	mc.markStopping()
 	return nil
 }
 
 func (mc *McServer) Restart() error {
 	mc.mu.Lock()
-	if !mc.active {
+	if !mc.state.IsAlive() {
 		mc.mu.Unlock()
 		fmt.Println("Server not running, starting ...")
 		return mc.Start()
@@ -293,15 +569,11 @@ func (mc *McServer) Restart() error {
 
 	fmt.Println("Restarting Minecraft server...")
 
-	if err := mc.Stop(); err != nil {
+	if err := mc.StopAndWait(); err != nil {
 		fmt.Printf("\nFailed to stop server: %v", err)
 		return err
 	}
-
-	if mc.cmd != nil && mc.cmd.Process != nil {
-		mc.cmd.Wait()
-		fmt.Println("Server process has fully stopped")
-	}
+	fmt.Println("Server process has fully stopped")
 
 	if err := mc.Start(); err != nil {
 		fmt.Printf("\nFailed to start server: %v", err)
@@ -316,51 +588,48 @@ func (mc *McServer) SendCommand(command string) error {
 	mc.mu.Lock()
 	defer mc.mu.Unlock()
 
-	if !mc.active {
+	if !mc.state.IsAlive() {
 		fmt.Printf("\nCannot send command '%s': server not running", command)
 		return fmt.Errorf("\nserver not running")
 	}
 
 	fmt.Printf("\nSending command to MC server: %s", command)
 
-	// write command for minecraft input
-	_, err := mc.stdin.WriteString(command + "\n")
-	if err != nil {
+	if err := mc.writeConsole(command); err != nil {
 		fmt.Printf("\nError writing command: %v", err)
 		return err
 	}
 
-	// send now
-	if err := mc.stdin.Flush(); err != nil {
-		fmt.Printf("\nError flushing command: %v", err)
-		return err
+	if strings.TrimSpace(command) == "stop" {
+		// Stopping from the console is as deliberate as the stop button.
+		mc.markStopping()
 	}
 
 	fmt.Printf("\nCommand sent successfully: %s", command)
 	return nil
 }
 
-func (mc *McServer) SetWebSocket(ws *websocket.Conn) {
-	mc.mu.Lock()
-	defer mc.mu.Unlock()
-	mc.ws = ws
-}
-
 func WsHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("\nNew WebSocket connection from %s", r.RemoteAddr)
 
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		fmt.Printf("\nWebSocket upgrade error from %s: %v", r.RemoteAddr, err)
 		return
 	}
+	sub := mcServer.attachClient(ws)
 	defer func() {
+		mcServer.hub.Unsubscribe(sub)
 		ws.Close()
 		fmt.Printf("\nWebSocket connection closed for %s", r.RemoteAddr)
 	}()
 
-	mcServer.SetWebSocket(ws)
-
 	for {
 		_, message, err := ws.ReadMessage()
 		if err != nil {
@@ -375,12 +644,24 @@ func WsHandler(w http.ResponseWriter, r *http.Request) {
 			continue // Skip this message and continue listening
 		}
 
+		if HTMXMessage.HistoryBefore != 0 {
+			limit := HTMXMessage.Limit
+			if limit <= 0 || limit > consoleHistoryLimit {
+				limit = consoleHistoryLimit
+			}
+			mcServer.hub.SendJSON(sub, consoleHistory{
+				Type:  "history",
+				Lines: mcServer.console.Before(HTMXMessage.HistoryBefore, limit),
+			})
+			continue
+		}
+
 		command := HTMXMessage.Command
 		fmt.Printf("\nReceived message from %s: %s", r.RemoteAddr, command)
 
 		if err := mcServer.SendCommand(command); err != nil {
 			fmt.Printf("\nFailed to send command: %v", err)
-			ws.WriteMessage(websocket.TextMessage, []byte("Error: "+err.Error()))
+			mcServer.hub.Send(sub, []byte("Error: "+err.Error()))
 		}
 	}
 }
@@ -393,6 +674,12 @@ func StartHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
 	if err := mcServer.Start(); err != nil {
 		fmt.Printf("\nFailed to start server: %v", err)
 		http.Error(w, fmt.Sprintf("Error: %s", err.Error()), http.StatusInternalServerError)
@@ -414,6 +701,13 @@ func StopHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
 	if err := mcServer.Stop(); err != nil {
 		fmt.Printf("\nFailed to stop server: %v", err)
 		http.Error(w, fmt.Sprintf("Error: %s", err.Error()), http.StatusBadRequest)
@@ -434,6 +728,13 @@ func RestartHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
 	if err := mcServer.Restart(); err != nil {
 		fmt.Printf("\nFailed to Restart server: %v", err)
 		http.Error(w, fmt.Sprintf("\nError: %s", err.Error()), http.StatusBadRequest)
@@ -449,8 +750,15 @@ func RestartHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func CpuLineHandler(w http.ResponseWriter, r *http.Request) {
-	history := make([]float64, len(mcServer.lastStats.cpu))
-	copy(history, mcServer.lastStats.cpu)
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	mcServer.lastStats.mu.Lock()
+	history := append([]float64{}, mcServer.lastStats.cpu...)
+	mcServer.lastStats.mu.Unlock()
 	items := make([]opts.LineData, 30)
 	xAxis := make([]string, 30)
 
@@ -508,8 +816,15 @@ func CpuLineHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func RamLineHandler(w http.ResponseWriter, r *http.Request) {
-	history := make([]uint64, len(mcServer.lastStats.ram))
-	copy(history, mcServer.lastStats.ram)
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	mcServer.lastStats.mu.Lock()
+	history := append([]uint64{}, mcServer.lastStats.ram...)
+	mcServer.lastStats.mu.Unlock()
 	items := make([]opts.LineData, 30)
 	xAxis := make([]string, 30)
 
@@ -563,8 +878,19 @@ func RamLineHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func PlayerLineHandler(w http.ResponseWriter, r *http.Request) {
-	history := make([]int, len(mcServer.players.playersNames))
-	copy(history, mcServer.players.playersNumbers)
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	mcServer.players.mu.Lock()
+	history := append([]int{}, mcServer.players.playersNumbers...)
+	maxPlayers := mcServer.players.last.Max
+	mcServer.players.mu.Unlock()
+	if maxPlayers == 0 {
+		maxPlayers = 100
+	}
 	items := make([]opts.LineData, 30)
 	xAxis := make([]string, 30)
 
@@ -585,7 +911,7 @@ func PlayerLineHandler(w http.ResponseWriter, r *http.Request) {
 		}),
 		charts.WithYAxisOpts(opts.YAxis{
 			Min:       "0",
-			Max:       "100",
+			Max:       fmt.Sprint(maxPlayers),
 			AxisLabel: &opts.AxisLabel{Show: opts.Bool(false)},
 		}),
 		charts.WithInitializationOpts(opts.Initialization{
@@ -624,5 +950,11 @@ func PlayerLineHandler(w http.ResponseWriter, r *http.Request) {
 func ConsoleHandler(w http.ResponseWriter, r *http.Request) {
 	var consoleTemplate = template.Must(template.New("console.html").ParseFiles("./frontend/templates/console.html"))
 
-	consoleTemplate.ExecuteTemplate(w, "console.html", nil)
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	consoleTemplate.ExecuteTemplate(w, "console.html", mcServer.Config())
 }
@@ -0,0 +1,244 @@
+package backend
+
+import (
+	"Skyfield1888/WebMine/backend/internal/fakeserver"
+	"context"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Detached instances run the test binary as their supervisor.
+	if len(os.Args) > 1 && os.Args[1] == SUPERVISE_COMMAND {
+		os.Exit(RunDetachedSupervisor(os.Args[2:]))
+	}
+	fakeserver.Main()
+	os.Exit(m.Run())
+}
+
+// fakeInstance returns an instance that runs a fakeserver with flags
+// instead of java, with properties in its server.properties when not nil.
+// It is killed at the end of the test if still running.
+func fakeInstance(t *testing.T, config InstanceConfig, properties map[string]string, flags ...string) *McServer {
+	previous := LaunchCommandFor
+	LaunchCommandFor = func(InstanceConfig) (LaunchCommand, error) {
+		path, args, env := fakeserver.Command(flags...)
+		return LaunchCommand{Path: path, Args: args, Env: env}, nil
+	}
+	t.Cleanup(func() { LaunchCommandFor = previous })
+
+	if config.ID == "" {
+		config.ID = "fake"
+	}
+	config.Directory = t.TempDir()
+	if properties != nil {
+		fakeserver.WriteProperties(t, config.Directory, properties)
+	}
+	mc := NewMcServer(config)
+	t.Cleanup(func() {
+		mc.mu.Lock()
+		exited := mc.exited
+		mc.mu.Unlock()
+		if mc.Kill() == nil {
+			<-exited
+		}
+	})
+	return mc
+}
+
+func waitState(t *testing.T, mc *McServer, states ...ServerState) ServerState {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	state, err := mc.WaitState(ctx, states...)
+	if err != nil {
+		t.Fatalf("instance still %s, expected %v", state, states)
+	}
+	return state
+}
+
+// waitConsoleLine waits for a console line containing text.
+func waitConsoleLine(t *testing.T, mc *McServer, text string) ConsoleLine {
+	t.Helper()
+	return waitConsoleLineAfter(t, mc, 0, text)
+}
+
+// waitConsoleLineAfter waits for a console line containing text newer
+// than the line numbered seq.
+func waitConsoleLineAfter(t *testing.T, mc *McServer, seq uint64, text string) ConsoleLine {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, line := range mc.console.Before(math.MaxUint64, consoleBufferSize) {
+			if line.Seq > seq && strings.Contains(line.Text, text) {
+				return line
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no console line with %q", text)
+	return ConsoleLine{}
+}
+
+func TestMcServerStartsAndStops(t *testing.T) {
+	mc := fakeInstance(t, InstanceConfig{}, nil)
+	if err := mc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, mc, StateRunning)
+	if status := mc.Status(); status.PID == 0 {
+		t.Errorf("running without a PID: %+v", status)
+	}
+	if err := mc.Start(); err == nil {
+		t.Error("starting twice should fail")
+	}
+
+	if err := mc.StopAndWait(); err != nil {
+		t.Fatal(err)
+	}
+	waitConsoleLine(t, mc, "Saving worlds")
+	status := mc.Status()
+	if status.State != StateStopped || status.LastExit == nil || status.LastExit.Reason != ExitStopped {
+		t.Errorf("unexpected status after stop: %+v", status)
+	}
+	if err := mc.SendCommand("list"); err == nil {
+		t.Error("commands to a stopped server should fail")
+	}
+}
+
+func TestMcServerStopWhileStarting(t *testing.T) {
+	mc := fakeInstance(t, InstanceConfig{}, nil, "-startup", "200ms")
+	go mc.Start()
+	waitState(t, mc, StateStarting)
+
+	// The process may not be launched yet, Stop waits for it.
+	if err := mc.StopAndWait(); err != nil {
+		t.Fatal(err)
+	}
+	if exit := mc.Status().LastExit; exit == nil || exit.Reason != ExitStopped {
+		t.Errorf("unexpected exit %+v", exit)
+	}
+}
+
+func TestMcServerResolvesJavaBeforeStarting(t *testing.T) {
+	mc := fakeInstance(t, InstanceConfig{}, nil)
+	fake := LaunchCommandFor
+	resolving, release := make(chan struct{}), make(chan struct{})
+	LaunchCommandFor = func(config InstanceConfig) (LaunchCommand, error) {
+		close(resolving)
+		<-release
+		return fake(config)
+	}
+	started := make(chan error)
+	go func() { started <- mc.Start() }()
+
+	<-resolving
+	if state := mc.State(); state != StateStopped {
+		t.Errorf("instance %s while java is probed", state)
+	}
+	if err := mc.Stop(); err == nil {
+		t.Error("stopping before the launch should fail")
+	}
+	close(release)
+	if err := <-started; err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, mc, StateRunning)
+}
+
+func TestMcServerConsoleLevels(t *testing.T) {
+	mc := fakeInstance(t, InstanceConfig{}, nil)
+	mc.Start()
+	waitState(t, mc, StateRunning)
+
+	mc.SendCommand("warn Can't keep up!")
+	mc.SendCommand("error Failed to save chunk")
+	mc.SendCommand("say hello")
+	cases := map[string]string{
+		"Can't keep up!":        "warn",
+		"Failed to save chunk":  "error",
+		"[Server] hello":        "log",
+		"OFFLINE/INSECURE MODE": "warn",
+	}
+	for text, level := range cases {
+		if line := waitConsoleLine(t, mc, text); line.Level != level {
+			t.Errorf("%q logged as %s, expected %s", text, line.Level, level)
+		}
+	}
+}
+
+func TestMcServerTracksPlayers(t *testing.T) {
+	mc := fakeInstance(t, InstanceConfig{}, nil)
+	mc.Start()
+	waitState(t, mc, StateRunning)
+
+	mc.SendCommand("join Alex")
+	mc.SendCommand("join Steve")
+	mc.SendCommand("leave Alex")
+	// Lines are handled in order, the leave is done once list answered.
+	mc.SendCommand("list")
+	waitConsoleLine(t, mc, "There are 1 of a max of 20 players online: Steve")
+
+	mc.players.mu.Lock()
+	players := append([]string{}, mc.players.playersNames...)
+	mc.players.mu.Unlock()
+	if !reflect.DeepEqual(players, []string{"Steve"}) {
+		t.Errorf("players %v, expected [Steve]", players)
+	}
+}
+
+func TestMcServerCrash(t *testing.T) {
+	mc := fakeInstance(t, InstanceConfig{}, nil)
+	mc.Start()
+	waitState(t, mc, StateRunning)
+
+	mc.SendCommand("crash")
+	waitState(t, mc, StateCrashed)
+	if exit := mc.Status().LastExit; exit == nil || exit.Reason != ExitCrashed || exit.Code != 1 {
+		t.Errorf("unexpected exit %+v", exit)
+	}
+	if line := waitConsoleLine(t, mc, "fake crash"); line.Level != "error" {
+		t.Errorf("stderr logged as %s", line.Level)
+	}
+}
+
+func TestMcServerRestartsAfterCrash(t *testing.T) {
+	config := InstanceConfig{}
+	config.Supervisor = SupervisorConfig{RestartPolicy: RestartOnFailure, BackoffSeconds: 1}
+	mc := fakeInstance(t, config, nil)
+	mc.Start()
+	waitState(t, mc, StateRunning)
+
+	mc.SendCommand("crash")
+	waitState(t, mc, StateRestarting)
+	waitState(t, mc, StateRunning)
+}
+
+func TestMcServerEulaFlow(t *testing.T) {
+	t.Chdir(t.TempDir())
+	config := InstanceConfig{}
+	config.Supervisor = SupervisorConfig{RestartPolicy: RestartAlways}
+	mc := fakeInstance(t, config, nil, "-eula")
+
+	mc.Start()
+	waitConsoleLine(t, mc, "You need to agree to the EULA")
+	waitState(t, mc, StateStopped)
+	if !mc.EulaRequired() {
+		t.Fatal("the EULA failure wasn't detected")
+	}
+	// Restarting can't help until the EULA is accepted.
+	time.Sleep(100 * time.Millisecond)
+	if state := mc.State(); state != StateStopped {
+		t.Errorf("instance %s while waiting for the EULA", state)
+	}
+
+	if _, err := mc.AcceptEula("admin", "127.0.0.1:1234"); err != nil {
+		t.Fatal(err)
+	}
+	mc.Start()
+	waitState(t, mc, StateRunning)
+}
@@ -0,0 +1,417 @@
+package backend
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// Detached instances run under "webmine supervise", a copy of the panel
+// binary that starts the server in its own session and outlives the panel.
+// The supervisor and the panel talk through files in <instance>/.webmine:
+//
+//	console.in   named pipe, read by the server as its stdin
+//	console.log  server stdout and stderr
+//	server.pid   PID of the java process while it runs
+//	server.exit  exit code written by the supervisor once it ends
+const RUNTIME_DIR_NAME = ".webmine"
+const SUPERVISE_COMMAND = "supervise"
+
+const (
+	consoleFifoName = "console.in"
+	consoleLogName  = "console.log"
+	serverPidName   = "server.pid"
+	serverExitName  = "server.exit"
+)
+
+const (
+	pidFileTimeout  = 10 * time.Second
+	exitFileTimeout = 2 * time.Second
+	// How much of console.log is replayed into the scrollback on re-attach.
+	reattachReplayBytes = 64 * 1024
+)
+
+func runtimeDir(config InstanceConfig) string {
+	return filepath.Join(config.Directory, RUNTIME_DIR_NAME)
+}
+
+// RunDetachedSupervisor is the entry point of "webmine supervise <runtime
+// dir> [--pty] -- <command> [args...]". It returns the supervisor's exit
+// code. With --pty the server runs on a pseudo-terminal the supervisor
+// copies to and from the console files.
+func RunDetachedSupervisor(args []string) int {
+	usePty := len(args) > 1 && args[1] == "--pty"
+	if usePty {
+		args = append(args[:1:1], args[2:]...)
+	}
+	if len(args) < 3 || args[1] != "--" {
+		fmt.Fprintln(os.Stderr, "usage: webmine supervise <runtime dir> [--pty] -- <command> [args...]")
+		return 2
+	}
+	dir := args[0]
+	command := args[2:]
+
+	logFile, err := os.OpenFile(filepath.Join(dir, consoleLogName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer logFile.Close()
+
+	fail := func(err error) int {
+		fmt.Fprintf(logFile, "[WebMine supervisor] %v\n", err)
+		writeFileAtomic(filepath.Join(dir, serverExitName), "-1")
+		return 1
+	}
+
+	fifoPath := filepath.Join(dir, consoleFifoName)
+	if err := makeFifo(fifoPath); err != nil {
+		return fail(err)
+	}
+	// Opened read-write so the server never sees EOF when the panel, the
+	// only writer, goes away.
+	stdin, err := os.OpenFile(fifoPath, os.O_RDWR, 0)
+	if err != nil {
+		return fail(err)
+	}
+	defer stdin.Close()
+
+	signal.Ignore(syscall.SIGHUP, syscall.SIGINT)
+
+	cmd := exec.Command(command[0], command[1:]...)
+	copied := make(chan struct{})
+	if usePty {
+		ptmx, err := startOnPty(cmd)
+		if err != nil {
+			return fail(err)
+		}
+		defer ptmx.Close()
+		go io.Copy(ptmx, stdin)
+		go func() {
+			io.Copy(logFile, ptmx)
+			close(copied)
+		}()
+	} else {
+		cmd.Stdin = stdin
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+		if err := cmd.Start(); err != nil {
+			return fail(err)
+		}
+		close(copied)
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, serverPidName), strconv.Itoa(cmd.Process.Pid)); err != nil {
+		fmt.Fprintf(logFile, "[WebMine supervisor] %v\n", err)
+	}
+
+	// Stopping the supervisor stops the server.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	cmd.Wait()
+	<-copied
+	writeFileAtomic(filepath.Join(dir, serverExitName), strconv.Itoa(cmd.ProcessState.ExitCode()))
+	os.Remove(filepath.Join(dir, serverPidName))
+	return 0
+}
+
+func writeFileAtomic(path string, content string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readIntFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// startDetached launches the server under the supervisor and attaches to it.
+func (mc *McServer) startDetached(config InstanceConfig, exited chan struct{}, launch LaunchCommand) error {
+	// The supervisor runs inside the instance directory, give it a path that
+	// doesn't depend on our working directory.
+	dir, err := filepath.Abs(runtimeDir(config))
+	if err != nil {
+		mc.startFailed(exited)
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		mc.startFailed(exited)
+		return err
+	}
+
+	logPath := filepath.Join(dir, consoleLogName)
+	if info, err := os.Stat(logPath); err == nil && info.Size() > 0 {
+		os.Rename(logPath, logPath+".old")
+	}
+	os.Remove(filepath.Join(dir, serverExitName))
+	os.Remove(filepath.Join(dir, serverPidName))
+
+	self, err := os.Executable()
+	if err != nil {
+		mc.startFailed(exited)
+		return err
+	}
+
+	supervisorArgs := []string{SUPERVISE_COMMAND, dir}
+	if config.Pty {
+		supervisorArgs = append(supervisorArgs, "--pty")
+	}
+	supervisorArgs = append(supervisorArgs, "--", launch.Path)
+	supervisorArgs = append(supervisorArgs, launch.Args...)
+	cmd := exec.Command(self, supervisorArgs...)
+	cmd.Dir = config.Directory
+	// The server inherits the supervisor's environment.
+	cmd.Env = launch.Environ()
+	detachProcess(cmd)
+
+	if err := cmd.Start(); err != nil {
+		fmt.Printf("\nError starting supervisor: %v", err)
+		mc.startFailed(exited)
+		return err
+	}
+	// Reap the supervisor if it exits while we are still its parent.
+	go cmd.Wait()
+	mc.mu.Lock()
+	mc.cmd = cmd
+	mc.mu.Unlock()
+
+	pid, err := waitForPidFile(dir)
+	if err != nil {
+		fmt.Printf("\nError starting detached server: %v", err)
+		mc.replayConsoleLog(logPath, 0)
+		mc.startFailed(exited)
+		return err
+	}
+
+	fmt.Println("Minecraft server process started successfully (detached)")
+	return mc.attachDetached(pid, 0, exited)
+}
+
+func waitForPidFile(dir string) (int, error) {
+	deadline := time.Now().Add(pidFileTimeout)
+	for time.Now().Before(deadline) {
+		if pid, err := readIntFile(filepath.Join(dir, serverPidName)); err == nil {
+			return pid, nil
+		}
+		if _, err := os.Stat(filepath.Join(dir, serverExitName)); err == nil {
+			return 0, errors.New("server exited during startup, see console")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return 0, errors.New("timed out waiting for the supervisor to start the server")
+}
+
+// attachDetached streams console.log from logOffset, opens the console pipe
+// and watches pid until it exits.
+func (mc *McServer) attachDetached(pid int, logOffset int64, exited chan struct{}) error {
+	dir := runtimeDir(mc.Config())
+
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		mc.startFailed(exited)
+		return err
+	}
+	fifo, err := openFifoWriter(filepath.Join(dir, consoleFifoName))
+	if err != nil {
+		mc.startFailed(exited)
+		return err
+	}
+
+	mc.mu.Lock()
+	mc.process = proc
+	mc.stdin = bufio.NewWriter(fifo)
+	mc.launchFinished()
+	mc.mu.Unlock()
+
+	go mc.sampleStats(int32(pid))
+	go mc.pollPlayers(exited)
+
+	gone := make(chan struct{})
+	tailed := make(chan struct{})
+	go func() {
+		mc.tailConsoleLog(filepath.Join(dir, consoleLogName), logOffset, gone)
+		close(tailed)
+	}()
+
+	go func() {
+		for processAlive(pid) {
+			time.Sleep(500 * time.Millisecond)
+		}
+		close(gone)
+		<-tailed
+		fifo.Close()
+
+		code := -1
+		deadline := time.Now().Add(exitFileTimeout)
+		for time.Now().Before(deadline) {
+			if exitCode, err := readIntFile(filepath.Join(dir, serverExitName)); err == nil {
+				code = exitCode
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		fmt.Printf("\nDetached server process exited with code %d", code)
+		mc.processExited(code, exited)
+	}()
+
+	return nil
+}
+
+// tailConsoleLog follows the log like tail -f until gone is closed, then
+// reads whatever is left.
+func (mc *McServer) tailConsoleLog(path string, offset int64, gone chan struct{}) {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("\nError opening console log: %v", err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		fmt.Printf("\nError seeking console log: %v", err)
+		return
+	}
+
+	reader := bufio.NewReader(file)
+	partial := ""
+	finished := false
+	for {
+		line, err := reader.ReadString('\n')
+		partial += line
+		if err == nil {
+			mc.handleConsoleLine(strings.TrimRight(partial, "\r\n"))
+			partial = ""
+			continue
+		}
+		if err != io.EOF {
+			fmt.Printf("\nError reading console log: %v", err)
+			return
+		}
+		if finished {
+			if partial != "" {
+				mc.handleConsoleLine(partial)
+			}
+			return
+		}
+
+		select {
+		case <-gone:
+			finished = true
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// replayConsoleLog copies the end of console.log into the scrollback without
+// acting on it, so a re-attached console has some context.
+func (mc *McServer) replayConsoleLog(path string, offset int64) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(file)
+	if offset > 0 {
+		// Skip the line we probably landed in the middle of.
+		scanner.Scan()
+	}
+	for scanner.Scan() {
+		text, spans := parseANSI(scanner.Text())
+		mc.logStyledMessage(consoleLevel(text), text, spans)
+	}
+}
+
+// Reattach resumes managing a detached server left running by a previous
+// panel process. It does nothing when the instance isn't running.
+func (mc *McServer) Reattach() error {
+	config := mc.Config()
+	if !config.Detached {
+		return nil
+	}
+
+	dir := runtimeDir(config)
+	pid, err := readIntFile(filepath.Join(dir, serverPidName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	proc, err := process.NewProcess(int32(pid))
+	if err != nil || !processAlive(pid) || !sameDirectory(proc, config.Directory) {
+		// Stale PID file, or the PID now belongs to someone else.
+		os.Remove(filepath.Join(dir, serverPidName))
+		return nil
+	}
+
+	logPath := filepath.Join(dir, consoleLogName)
+	info, err := os.Stat(logPath)
+	if err != nil {
+		return err
+	}
+	replayFrom := info.Size() - reattachReplayBytes
+	if replayFrom < 0 {
+		replayFrom = 0
+	}
+	mc.replayConsoleLog(logPath, replayFrom)
+
+	mc.mu.Lock()
+	mc.stopRequested = false
+	mc.stopping = false
+	mc.forcedSignal = 0
+	exited := make(chan struct{})
+	mc.exited = exited
+	mc.launched = make(chan struct{})
+	mc.setState(StateRunning)
+	if created, err := proc.CreateTime(); err == nil {
+		mc.startedAt = time.UnixMilli(created)
+	}
+	mc.mu.Unlock()
+
+	fmt.Printf("\nRe-attached to detached server %s (PID %d)", config.ID, pid)
+	mc.logMessage("log", fmt.Sprintf("Re-attached to running server (PID %d)", pid))
+	return mc.attachDetached(pid, info.Size(), exited)
+}
+
+func sameDirectory(proc *process.Process, directory string) bool {
+	cwd, err := proc.Cwd()
+	if err != nil {
+		return false
+	}
+	expected, err := filepath.Abs(directory)
+	if err != nil {
+		return false
+	}
+	if resolved, err := filepath.EvalSymlinks(expected); err == nil {
+		expected = resolved
+	}
+	return filepath.Clean(cwd) == expected
+}
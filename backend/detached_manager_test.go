@@ -0,0 +1,56 @@
+//go:build unix
+
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetachedServerSurvivesThePanel(t *testing.T) {
+	first := fakeInstance(t, InstanceConfig{Detached: true}, nil)
+	if err := first.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, first, StateRunning)
+	pid := first.Status().PID
+
+	// A new panel process only has the files in .webmine to go by.
+	second := NewMcServer(first.Config())
+	t.Cleanup(func() {
+		second.mu.Lock()
+		exited := second.exited
+		second.mu.Unlock()
+		if second.Kill() == nil {
+			<-exited
+		}
+	})
+	if err := second.Reattach(); err != nil {
+		t.Fatal(err)
+	}
+	if status := second.Status(); status.State != StateRunning || status.PID != pid {
+		t.Fatalf("re-attached as %+v, expected running PID %d", status, pid)
+	}
+	waitConsoleLine(t, second, "Re-attached to running server")
+	// The scrollback is replayed from console.log.
+	waitConsoleLine(t, second, "Done (")
+
+	seq := second.ConsoleSeq()
+	if err := second.SendCommand("say through the pipe"); err != nil {
+		t.Fatal(err)
+	}
+	waitConsoleLineAfter(t, second, seq, "[Server] through the pipe")
+
+	if err := second.StopAndWait(); err != nil {
+		t.Fatal(err)
+	}
+	waitConsoleLine(t, second, "Saving worlds")
+	// Without server.exit the code would be unknown, -1.
+	if exit := second.Status().LastExit; exit == nil || exit.Reason != ExitStopped || exit.Code != 0 {
+		t.Errorf("unexpected exit %+v", exit)
+	}
+	if _, err := os.Stat(filepath.Join(runtimeDir(second.Config()), serverPidName)); !os.IsNotExist(err) {
+		t.Errorf("server.pid left behind: %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package backend
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+var errDetachedUnsupported = errors.New("detached servers are only supported on unix systems")
+
+func detachProcess(cmd *exec.Cmd) {}
+
+func makeFifo(path string) error {
+	return errDetachedUnsupported
+}
+
+func openFifoWriter(path string) (*os.File, error) {
+	return nil, errDetachedUnsupported
+}
+
+func processAlive(pid int) bool {
+	return false
+}
@@ -0,0 +1,272 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const MOJANG_EULA_URL = "https://aka.ms/MinecraftEULA"
+
+// Every EULA acceptance is appended to this file, one JSON object per line.
+const EULA_AUDIT_FILE = "./eula_audit.jsonl"
+
+// Printed by the server when eula.txt doesn't say eula=true.
+var eulaLine = regexp.MustCompile(`(?i)you need to agree to the eula`)
+
+// EulaAcceptance is an entry of the EULA audit trail.
+type EulaAcceptance struct {
+	Instance   string    `json:"instance"`
+	AcceptedBy string    `json:"accepted_by"`
+	RemoteAddr string    `json:"remote_addr"`
+	Time       time.Time `json:"time"`
+	EulaUrl    string    `json:"eula_url"`
+}
+
+// EulaAccepted tells whether eula.txt in directory contains eula=true.
+// A missing file means not accepted.
+func EulaAccepted(directory string) (bool, error) {
+	file, err := os.Open(filepath.Join(directory, "eula.txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if found && strings.TrimSpace(key) == "eula" {
+			return strings.EqualFold(strings.TrimSpace(value), "true"), nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// EulaRequired tells whether the last start failed because the EULA
+// wasn't accepted.
+func (mc *McServer) EulaRequired() bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.eulaRequired
+}
+
+// markEulaRequired records that the server refused to run without the
+// EULA and tells the clients where to read it.
+func (mc *McServer) markEulaRequired() {
+	mc.mu.Lock()
+	if mc.eulaRequired {
+		mc.mu.Unlock()
+		return
+	}
+	mc.eulaRequired = true
+	mc.hub.BroadcastJSON(mc.status())
+	mc.mu.Unlock()
+
+	mc.logMessage("warn", "The server needs the Minecraft EULA to be accepted, read it at "+MOJANG_EULA_URL+" and accept it from the panel")
+}
+
+// checkEulaAfterExit catches EULA failures the console didn't mention,
+// from forks that word it differently: the server quits cleanly before
+// being ready when eula.txt doesn't say eula=true. Crashes are left to the
+// supervisor, a wrong Java version fails the same way.
+func (mc *McServer) checkEulaAfterExit(exit ExitInfo, wasStarting bool) {
+	if exit.Reason != ExitExited || !wasStarting {
+		return
+	}
+	if accepted, err := EulaAccepted(mc.Config().Directory); err == nil && !accepted {
+		mc.markEulaRequired()
+	}
+}
+
+// AcceptEula writes eula=true for an instance and appends who did it to
+// the audit trail.
+func (mc *McServer) AcceptEula(acceptedBy string, remoteAddr string) (EulaAcceptance, error) {
+	acceptedBy = strings.TrimSpace(acceptedBy)
+	if acceptedBy == "" {
+		return EulaAcceptance{}, errors.New("say who accepts the EULA")
+	}
+
+	acceptance := EulaAcceptance{
+		Instance:   mc.ID(),
+		AcceptedBy: acceptedBy,
+		RemoteAddr: remoteAddr,
+		Time:       time.Now(),
+		EulaUrl:    MOJANG_EULA_URL,
+	}
+	content := fmt.Sprintf("#By changing the setting below to TRUE you are indicating your agreement to our EULA (%s).\n#Accepted by %s from WebMine on %s\neula=true\n",
+		MOJANG_EULA_URL, strings.ReplaceAll(acceptedBy, "\n", " "), acceptance.Time.Format(time.RFC1123))
+	if err := os.WriteFile(filepath.Join(mc.Config().Directory, "eula.txt"), []byte(content), 0644); err != nil {
+		return EulaAcceptance{}, err
+	}
+
+	if err := appendEulaAudit(acceptance); err != nil {
+		return EulaAcceptance{}, err
+	}
+
+	mc.mu.Lock()
+	mc.eulaRequired = false
+	mc.hub.BroadcastJSON(mc.status())
+	mc.mu.Unlock()
+
+	fmt.Printf("\nEULA of instance %s accepted by %s from %s", acceptance.Instance, acceptedBy, remoteAddr)
+	mc.logMessage("log", "Minecraft EULA accepted by "+acceptedBy)
+	return acceptance, nil
+}
+
+func appendEulaAudit(acceptance EulaAcceptance) error {
+	data, err := json.Marshal(acceptance)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(EULA_AUDIT_FILE, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// EulaAudit returns the acceptances recorded for an instance, all of them
+// when instance is empty, oldest first.
+func EulaAudit(instance string) ([]EulaAcceptance, error) {
+	file, err := os.Open(EULA_AUDIT_FILE)
+	if errors.Is(err, os.ErrNotExist) {
+		return []EulaAcceptance{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	acceptances := []EulaAcceptance{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		acceptance := EulaAcceptance{}
+		if json.Unmarshal(scanner.Bytes(), &acceptance) != nil {
+			continue
+		}
+		if instance == "" || acceptance.Instance == instance {
+			acceptances = append(acceptances, acceptance)
+		}
+	}
+	return acceptances, scanner.Err()
+}
+
+type eulaStatus struct {
+	Instance string           `json:"instance"`
+	Accepted bool             `json:"accepted"`
+	Required bool             `json:"required"`
+	EulaUrl  string           `json:"eula_url"`
+	Audit    []EulaAcceptance `json:"audit"`
+}
+
+// LastAcceptance is the newest entry of the audit trail, nil when the EULA
+// was accepted outside of the panel.
+func (status eulaStatus) LastAcceptance() *EulaAcceptance {
+	if len(status.Audit) == 0 {
+		return nil
+	}
+	return &status.Audit[len(status.Audit)-1]
+}
+
+func instanceEulaStatus(mc *McServer) (eulaStatus, error) {
+	accepted, err := EulaAccepted(mc.Config().Directory)
+	if err != nil {
+		return eulaStatus{}, err
+	}
+	audit, err := EulaAudit(mc.ID())
+	if err != nil {
+		return eulaStatus{}, err
+	}
+	return eulaStatus{
+		Instance: mc.ID(),
+		Accepted: accepted,
+		Required: mc.EulaRequired(),
+		EulaUrl:  MOJANG_EULA_URL,
+		Audit:    audit,
+	}, nil
+}
+
+// EulaHandler tells whether an instance's EULA is accepted, whether its
+// last start failed for it, and who accepted it.
+func EulaHandler(w http.ResponseWriter, r *http.Request) {
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+	status, err := instanceEulaStatus(mcServer)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// AcceptEulaHandler accepts the EULA of an instance on behalf of the admin
+// named in accepted_by.
+func AcceptEulaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+	if _, err := mcServer.AcceptEula(r.FormValue("accepted_by"), r.RemoteAddr); err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	if r.Header.Get("HX-Request") == "true" {
+		EulaViewHandler(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": "EULA accepted for " + mcServer.ID(),
+	})
+}
+
+func EulaViewHandler(w http.ResponseWriter, r *http.Request) {
+	var eulaTemplate = template.Must(template.New("eula.html").ParseFiles("./frontend/templates/eula.html"))
+
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+	status, err := instanceEulaStatus(mcServer)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	eulaTemplate.ExecuteTemplate(w, "eula.html", status)
+}
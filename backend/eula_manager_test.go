@@ -0,0 +1,92 @@
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEulaAccepted(t *testing.T) {
+	cases := []struct {
+		content  string
+		accepted bool
+	}{
+		{"", false},
+		{"#eula=true\neula=false\n", false},
+		{"#By changing the setting below to TRUE...\neula=true\n", true},
+		{"eula = TRUE\n", true},
+	}
+	for _, c := range cases {
+		directory := t.TempDir()
+		if c.content != "" {
+			os.WriteFile(filepath.Join(directory, "eula.txt"), []byte(c.content), 0644)
+		}
+		accepted, err := EulaAccepted(directory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accepted != c.accepted {
+			t.Errorf("%q: accepted %t, expected %t", c.content, accepted, c.accepted)
+		}
+	}
+}
+
+func TestAcceptEula(t *testing.T) {
+	t.Chdir(t.TempDir())
+	directory := t.TempDir()
+	mc := NewMcServer(InstanceConfig{ID: "eula", Directory: directory})
+
+	mc.handleConsoleLine("[12:00:00] [ServerMain/INFO]: You need to agree to the EULA in order to run the server. Go to eula.txt for more info.")
+	if !mc.EulaRequired() || !mc.Status().EulaRequired {
+		t.Fatal("the EULA line wasn't detected")
+	}
+
+	if _, err := mc.AcceptEula(" ", "127.0.0.1:1234"); err == nil {
+		t.Error("accepting without a name should fail")
+	}
+	if _, err := mc.AcceptEula("admin", "127.0.0.1:1234"); err != nil {
+		t.Fatal(err)
+	}
+	if mc.EulaRequired() {
+		t.Error("still required after accepting")
+	}
+	if accepted, _ := EulaAccepted(directory); !accepted {
+		t.Error("eula.txt doesn't accept the EULA")
+	}
+
+	other := NewMcServer(InstanceConfig{ID: "other", Directory: t.TempDir()})
+	other.AcceptEula("someone else", "10.0.0.2:4321")
+
+	audit, err := EulaAudit("eula")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(audit) != 1 || audit[0].AcceptedBy != "admin" || audit[0].RemoteAddr != "127.0.0.1:1234" || audit[0].EulaUrl != MOJANG_EULA_URL {
+		t.Errorf("unexpected audit trail %+v", audit)
+	}
+	if all, _ := EulaAudit(""); len(all) != 2 {
+		t.Errorf("expected 2 acceptances in total, got %+v", all)
+	}
+}
+
+func TestEulaRequiredAfterEarlyExit(t *testing.T) {
+	directory := t.TempDir()
+	mc := NewMcServer(InstanceConfig{ID: "eula-exit", Directory: directory})
+
+	mc.checkEulaAfterExit(ExitInfo{Reason: ExitExited}, false)
+	if mc.EulaRequired() {
+		t.Error("a server that was running didn't fail on the EULA")
+	}
+	mc.checkEulaAfterExit(ExitInfo{Reason: ExitStopped}, true)
+	if mc.EulaRequired() {
+		t.Error("a requested stop isn't a EULA failure")
+	}
+	mc.checkEulaAfterExit(ExitInfo{Reason: ExitCrashed, Code: 1}, true)
+	if mc.EulaRequired() {
+		t.Error("crashes are left to the supervisor")
+	}
+	mc.checkEulaAfterExit(ExitInfo{Reason: ExitExited}, true)
+	if !mc.EulaRequired() {
+		t.Error("quitting while starting without eula.txt should require the EULA")
+	}
+}
@@ -0,0 +1,522 @@
+package filesdownload
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DEFAULT_CACHE_DIR = "./cache"
+
+// downloadCache keeps API responses under metadata/ and server jars under
+// jars/<provider>/<version>/<build>/<hash>.jar. Instances get hard links to
+// the cached jars, so instances on the same build share one file.
+type downloadCache struct {
+	dir string
+}
+
+func currentCache() downloadCache {
+	dir := backend.SavedAppConfig.DownloadConfig.CacheDir
+	if dir == "" {
+		dir = DEFAULT_CACHE_DIR
+	}
+	return downloadCache{dir: dir}
+}
+
+// CachedMetadata describes a cached API response.
+type CachedMetadata struct {
+	Url          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	Size         int64     `json:"size"`
+
+	key string
+}
+
+// CachedJar describes a cached server jar.
+type CachedJar struct {
+	Provider ServerType `json:"provider"`
+	Version  string     `json:"version"`
+	Build    string     `json:"build"`
+	Hash     string     `json:"hash"`
+	Size     int64      `json:"size"`
+	ModTime  time.Time  `json:"modified"`
+	// Instances whose server jar is this file.
+	UsedBy []string `json:"used_by"`
+
+	path string
+}
+
+func (cache downloadCache) metadataPaths(url string) (string, string) {
+	sum := sha256.Sum256([]byte(url))
+	key := filepath.Join(cache.dir, "metadata", hex.EncodeToString(sum[:]))
+	return key + ".json", key + ".info"
+}
+
+func (cache downloadCache) readMetadata(url string) ([]byte, CachedMetadata, error) {
+	bodyPath, infoPath := cache.metadataPaths(url)
+	info := CachedMetadata{}
+
+	data, err := os.ReadFile(infoPath)
+	if err != nil {
+		return nil, info, err
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, info, err
+	}
+	body, err := os.ReadFile(bodyPath)
+	if err != nil {
+		return nil, info, err
+	}
+	return body, info, nil
+}
+
+func (cache downloadCache) writeMetadata(body []byte, info CachedMetadata) error {
+	bodyPath, infoPath := cache.metadataPaths(info.Url)
+	if err := os.MkdirAll(filepath.Dir(bodyPath), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		if err := writeFileAtomic(bodyPath, body); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(infoPath, data)
+}
+
+// fetchMetadata returns an API response, revalidating the cached copy with
+// its ETag or Last-Modified. The cached copy is used when the API can't be
+// reached.
+func (cache downloadCache) fetchMetadata(ctx context.Context, url string) ([]byte, error) {
+	cached, info, cacheErr := cache.readMetadata(url)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(timeoutCtx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cacheErr == nil {
+		if info.ETag != "" {
+			request.Header.Set("If-None-Match", info.ETag)
+		}
+		if info.LastModified != "" {
+			request.Header.Set("If-Modified-Since", info.LastModified)
+		}
+	}
+
+	offline := func(err error) ([]byte, error) {
+		if cacheErr != nil || ctx.Err() != nil {
+			return nil, err
+		}
+		fmt.Printf("\n%v, using the copy cached at %s", err, info.FetchedAt.Format(time.RFC3339))
+		return cached, nil
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return offline(err)
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotModified && cacheErr == nil:
+		info.FetchedAt = time.Now()
+		if err := cache.writeMetadata(nil, info); err != nil {
+			fmt.Printf("\nCould not update the cache of %s: %v", url, err)
+		}
+		return cached, nil
+	case response.StatusCode == http.StatusOK:
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			return offline(err)
+		}
+		info = CachedMetadata{
+			Url:          url,
+			ETag:         response.Header.Get("ETag"),
+			LastModified: response.Header.Get("Last-Modified"),
+			FetchedAt:    time.Now(),
+			Size:         int64(len(body)),
+		}
+		if err := cache.writeMetadata(body, info); err != nil {
+			fmt.Printf("\nCould not cache %s: %v", url, err)
+		}
+		return body, nil
+	case response.StatusCode >= 500:
+		return offline(fmt.Errorf("GET %s: %s", url, response.Status))
+	default:
+		return nil, fmt.Errorf("GET %s: %s", url, response.Status)
+	}
+}
+
+// pathName makes a version or build usable as a directory name.
+func pathName(name string) string {
+	name = url.PathEscape(name)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return name
+}
+
+func (cache downloadCache) jarDir(serverType ServerType, download ServerDownload) string {
+	return filepath.Join(cache.dir, "jars", pathName(string(serverType)), pathName(download.Version), pathName(download.Build))
+}
+
+// announcedHash is the hash a cached jar is named after, empty when the
+// provider doesn't publish one and the SHA-256 of the file is used.
+func announcedHash(download ServerDownload) string {
+	if download.Sha256 != "" {
+		return strings.ToLower(download.Sha256)
+	}
+	return strings.ToLower(download.Sha1)
+}
+
+// fileHashes returns the SHA-1 and SHA-256 of a file.
+func fileHashes(path string) (string, string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer file.Close()
+
+	sha1Hash, sha256Hash := sha1.New(), sha256.New()
+	size, err := io.Copy(io.MultiWriter(sha1Hash, sha256Hash), file)
+	if err != nil {
+		return "", "", 0, err
+	}
+	return hex.EncodeToString(sha1Hash.Sum(nil)), hex.EncodeToString(sha256Hash.Sum(nil)), size, nil
+}
+
+// findJar returns a jar of download in dir whose content is still intact.
+func findJar(dir string, download ServerDownload) (string, bool) {
+	candidates, _ := filepath.Glob(filepath.Join(dir, "*.jar"))
+	if hash := announcedHash(download); hash != "" {
+		candidates = []string{filepath.Join(dir, hash+".jar")}
+	}
+
+	for _, candidate := range candidates {
+		sha1Sum, sha256Sum, size, err := fileHashes(candidate)
+		if err != nil {
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(candidate), ".jar")
+		if download.Size > 0 && size != download.Size ||
+			download.Sha1 != "" && !strings.EqualFold(sha1Sum, download.Sha1) ||
+			download.Sha256 != "" && !strings.EqualFold(sha256Sum, download.Sha256) ||
+			name != sha1Sum && name != sha256Sum {
+			fmt.Printf("\nCached %s is corrupt, downloading it again", candidate)
+			os.Remove(candidate)
+			continue
+		}
+		return candidate, true
+	}
+	return "", false
+}
+
+// jar returns the path of a verified copy of download in the cache,
+// downloading it first when missing.
+func (cache downloadCache) jar(ctx context.Context, serverType ServerType, download ServerDownload, progress ProgressFunc) (string, error) {
+	dir := cache.jarDir(serverType, download)
+	// A jar removed since it was found, by a cache cleanup, is downloaded
+	// again.
+	if path, ok := findJar(dir, download); ok {
+		if info, err := os.Stat(path); err == nil {
+			fmt.Printf("\nUsing cached %s", path)
+			if progress != nil {
+				progress(info.Size(), info.Size())
+			}
+			return path, nil
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	downloaded := filepath.Join(dir, fmt.Sprintf("%d.download", time.Now().UnixNano()))
+	if hash := announcedHash(download); hash != "" {
+		downloaded = filepath.Join(dir, hash+".jar")
+	}
+	if err := downloadVerified(ctx, download, downloaded, progress); err != nil {
+		return "", err
+	}
+	if announcedHash(download) != "" {
+		return downloaded, nil
+	}
+
+	_, sha256Sum, _, err := fileHashes(downloaded)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, sha256Sum+".jar")
+	return path, os.Rename(downloaded, path)
+}
+
+// linkFile puts source at destination, as a hard link when the file
+// system allows it and a copy otherwise. destination is replaced
+// atomically.
+func linkFile(source string, destination string) error {
+	if sourceInfo, err := os.Stat(source); err == nil {
+		if destinationInfo, err := os.Stat(destination); err == nil && os.SameFile(sourceInfo, destinationInfo) {
+			return nil
+		}
+	}
+
+	tmp := fmt.Sprintf("%s.%d.link", destination, time.Now().UnixNano())
+	if err := os.Link(source, tmp); err != nil {
+		if err := copyFile(source, tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, destination); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func copyFile(source string, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Metadata lists the cached API responses.
+func (cache downloadCache) Metadata() ([]CachedMetadata, error) {
+	infos, err := filepath.Glob(filepath.Join(cache.dir, "metadata", "*.info"))
+	if err != nil {
+		return nil, err
+	}
+
+	list := []CachedMetadata{}
+	for _, infoPath := range infos {
+		data, err := os.ReadFile(infoPath)
+		if err != nil {
+			continue
+		}
+		info := CachedMetadata{key: strings.TrimSuffix(infoPath, ".info")}
+		if json.Unmarshal(data, &info) != nil {
+			continue
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Url < list[j].Url
+	})
+	return list, nil
+}
+
+// Jars lists the cached server jars and the instances using them.
+func (cache downloadCache) Jars() ([]CachedJar, error) {
+	paths, err := filepath.Glob(filepath.Join(cache.dir, "jars", "*", "*", "*", "*.jar"))
+	if err != nil {
+		return nil, err
+	}
+
+	instanceJars := map[string]os.FileInfo{}
+	for _, mc := range backend.Instances.List() {
+		config := mc.Config()
+		if info, err := os.Stat(filepath.Join(config.Directory, config.ServerJarName)); err == nil {
+			instanceJars[config.ID] = info
+		}
+	}
+
+	list := []CachedJar{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		unescape := func(name string) string {
+			unescaped, err := url.PathUnescape(name)
+			if err != nil {
+				return name
+			}
+			return unescaped
+		}
+		buildDir := filepath.Dir(path)
+		versionDir := filepath.Dir(buildDir)
+		jar := CachedJar{
+			Provider: ServerType(unescape(filepath.Base(filepath.Dir(versionDir)))),
+			Version:  unescape(filepath.Base(versionDir)),
+			Build:    unescape(filepath.Base(buildDir)),
+			Hash:     strings.TrimSuffix(filepath.Base(path), ".jar"),
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+			UsedBy:   []string{},
+			path:     path,
+		}
+		for id, instanceJar := range instanceJars {
+			if os.SameFile(info, instanceJar) {
+				jar.UsedBy = append(jar.UsedBy, id)
+			}
+		}
+		sort.Strings(jar.UsedBy)
+		list = append(list, jar)
+	}
+	return list, nil
+}
+
+// PruneResult is what Prune removed.
+type PruneResult struct {
+	Removed []string `json:"removed"`
+	Freed   int64    `json:"freed"`
+}
+
+// Prune removes the cached jars no instance uses that are older than
+// olderThan, and with metadata the API responses fetched before that.
+func (cache downloadCache) Prune(olderThan time.Duration, metadata bool) (PruneResult, error) {
+	result := PruneResult{Removed: []string{}}
+	limit := time.Now().Add(-olderThan)
+
+	jars, err := cache.Jars()
+	if err != nil {
+		return result, err
+	}
+	for _, jar := range jars {
+		if len(jar.UsedBy) > 0 || jar.ModTime.After(limit) {
+			continue
+		}
+		if err := os.Remove(jar.path); err != nil {
+			return result, err
+		}
+		result.Removed = append(result.Removed, jar.path)
+		result.Freed += jar.Size
+		// Drop the build and version directories once empty.
+		os.Remove(filepath.Dir(jar.path))
+		os.Remove(filepath.Dir(filepath.Dir(jar.path)))
+	}
+
+	if !metadata {
+		return result, nil
+	}
+	entries, err := cache.Metadata()
+	if err != nil {
+		return result, err
+	}
+	for _, entry := range entries {
+		if entry.FetchedAt.After(limit) {
+			continue
+		}
+		if err := os.Remove(entry.key + ".json"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return result, err
+		}
+		os.Remove(entry.key + ".info")
+		result.Removed = append(result.Removed, entry.Url)
+		result.Freed += entry.Size
+	}
+	return result, nil
+}
+
+// CacheHandler lists what is in the download cache.
+func CacheHandler(w http.ResponseWriter, r *http.Request) {
+	cache := currentCache()
+	metadata, err := cache.Metadata()
+	if err != nil {
+		backend.HtmlDetailedError(w, err)
+		return
+	}
+	jars, err := cache.Jars()
+	if err != nil {
+		backend.HtmlDetailedError(w, err)
+		return
+	}
+
+	var size int64
+	for _, entry := range metadata {
+		size += entry.Size
+	}
+	for _, jar := range jars {
+		size += jar.Size
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"directory": cache.dir,
+		"metadata":  metadata,
+		"jars":      jars,
+		"size":      size,
+	})
+}
+
+// CachePruneHandler removes unused jars, older_than (a duration such as
+// "720h") keeps the recent ones and metadata=true also clears API
+// responses.
+func CachePruneHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+
+	var olderThan time.Duration
+	if value := r.FormValue("older_than"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			backend.HtmlDetailedError(w, fmt.Errorf("older_than should be a duration such as 720h: %w", err))
+			return
+		}
+		olderThan = duration
+	}
+
+	result, err := currentCache().Prune(olderThan, r.FormValue("metadata") == "true")
+	if err != nil {
+		backend.HtmlDetailedError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"message": fmt.Sprintf("Removed %d cached files, %.1f MB freed", len(result.Removed), float64(result.Freed)/1048576),
+		"removed": result.Removed,
+	})
+}
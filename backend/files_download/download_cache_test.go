@@ -0,0 +1,136 @@
+package filesdownload
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetadataCacheRevalidates(t *testing.T) {
+	tempCache(t)
+	served, notModified := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"manifest-1"`)
+		if r.Header.Get("If-None-Match") == `"manifest-1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		served++
+		w.Write([]byte(`{"latest": {"release": "1.21.10"}}`))
+	}))
+
+	for i := 0; i < 3; i++ {
+		manifest := MojangVersionsManifest{}
+		if err := manifest.Populate(server.URL); err != nil {
+			t.Fatal(err)
+		}
+		if manifest.LatestVersions.Release != "1.21.10" {
+			t.Fatalf("request %d: got %+v", i, manifest.LatestVersions)
+		}
+	}
+	if served != 1 || notModified != 2 {
+		t.Errorf("served %d times and revalidated %d times, expected 1 and 2", served, notModified)
+	}
+
+	// Offline, the cached copy is used and unknown URLs fail.
+	server.Close()
+	manifest := MojangVersionsManifest{}
+	if err := manifest.Populate(server.URL); err != nil || manifest.LatestVersions.Release != "1.21.10" {
+		t.Errorf("offline manifest: %+v, %v", manifest.LatestVersions, err)
+	}
+	if err := manifest.Populate(server.URL + "/other"); err == nil {
+		t.Error("an uncached URL should fail offline")
+	}
+}
+
+func TestJarCacheSharedBetweenInstances(t *testing.T) {
+	providers := fakeProviders(t)
+
+	jars := []string{}
+	for i := 0; i < 2; i++ {
+		directory := t.TempDir()
+		if _, err := providers[Paper].Install(context.Background(), "1.21.10", "101", directory, "server.jar", nil); err != nil {
+			t.Fatal(err)
+		}
+		jars = append(jars, filepath.Join(directory, "server.jar"))
+	}
+
+	first, err := os.Stat(jars[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := os.Stat(jars[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(first, second) {
+		t.Error("both instances should share the cached jar")
+	}
+
+	cached, err := currentCache().Jars()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != 1 || cached[0].Provider != Paper || cached[0].Version != "1.21.10" || cached[0].Build != "101" || cached[0].Hash != fakeJarSha256 {
+		t.Errorf("unexpected cache content %+v", cached)
+	}
+
+	// A damaged cache entry is downloaded again.
+	if err := os.WriteFile(cached[0].path, []byte("damaged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	directory := t.TempDir()
+	if _, err := providers[Paper].Install(context.Background(), "1.21.10", "101", directory, "server.jar", nil); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(directory, "server.jar")); string(content) != string(fakeJar) {
+		t.Errorf("installed a damaged jar: %q", content)
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+	t.Chdir(t.TempDir())
+	providers := fakeProviders(t)
+
+	used := t.TempDir()
+	if _, err := backend.Instances.Create(backend.InstanceConfig{ID: "cache-prune", Directory: used, ServerJarName: "server.jar"}); err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Instances.Delete("cache-prune")
+
+	for directory, version := range map[string]string{used: "1.21.10", t.TempDir(): "1.20.4"} {
+		if _, err := providers[Vanilla].Install(context.Background(), version, "", directory, "server.jar", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache := currentCache()
+	result, err := cache.Prune(time.Hour, false)
+	if err != nil || len(result.Removed) != 0 {
+		t.Errorf("recent jars should be kept: %+v, %v", result, err)
+	}
+
+	result, err = cache.Prune(0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jars, _ := cache.Jars()
+	if len(jars) != 1 || jars[0].Version != "1.21.10" || len(jars[0].UsedBy) != 1 || jars[0].UsedBy[0] != "cache-prune" {
+		t.Errorf("only the jar in use should be kept, got %+v", jars)
+	}
+	if result.Freed <= int64(len(fakeJar)) {
+		t.Errorf("freed %d bytes, expected the unused jar and the metadata", result.Freed)
+	}
+	if metadata, _ := cache.Metadata(); len(metadata) != 0 {
+		t.Errorf("metadata should be cleared, got %d entries", len(metadata))
+	}
+	if _, err := os.Stat(filepath.Join(used, "server.jar")); err != nil {
+		t.Errorf("the instance jar was removed: %v", err)
+	}
+}
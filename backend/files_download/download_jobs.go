@@ -0,0 +1,423 @@
+package filesdownload
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+	// The upgrade failed and the previous server was put back.
+	JobRolledBack = "rolled_back"
+)
+
+const (
+	JobInstall = "install"
+	JobUpgrade = "upgrade"
+)
+
+const (
+	// Finished jobs kept for GET /downloads.
+	finishedJobsKept = 20
+	// Progress is broadcast at most this often per job.
+	progressInterval = 250 * time.Millisecond
+)
+
+// DownloadJob is a server install or upgrade running in the background.
+type DownloadJob struct {
+	ID       int        `json:"id"`
+	Kind     string     `json:"kind"`
+	Instance string     `json:"instance"`
+	Provider ServerType `json:"provider"`
+	Version  string     `json:"version"`
+	Build    string     `json:"build,omitempty"`
+	State    string     `json:"state"`
+	// What an upgrade is doing, "downloading", "starting"...
+	Step       string     `json:"step,omitempty"`
+	Done       int64      `json:"done"`
+	Total      int64      `json:"total"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	cancel        context.CancelFunc
+	lastBroadcast time.Time
+}
+
+type downloadJobs struct {
+	mu     sync.Mutex
+	jobs   []*DownloadJob
+	nextID int
+	feed   *progressFeed
+}
+
+var DownloadJobs = &downloadJobs{nextID: 1, feed: newProgressFeed()}
+
+// jobMessage is what the progress feed sends for each change of a job.
+type jobMessage struct {
+	Type string      `json:"type"`
+	Job  DownloadJob `json:"job"`
+}
+
+// Start installs a server into an instance in the background. Only one
+// job can run per instance.
+func (jobs *downloadJobs) Start(instanceID string, serverType ServerType, version string, build string) (DownloadJob, error) {
+	return jobs.start(JobInstall, instanceID, serverType, version, build, func(ctx context.Context, job *DownloadJob) (InstallResult, error) {
+		return InstallServer(ctx, instanceID, serverType, version, build, jobs.progressFunc(job))
+	})
+}
+
+// StartUpgrade runs UpgradeServer in the background, see Start.
+func (jobs *downloadJobs) StartUpgrade(instanceID string, options UpgradeOptions) (DownloadJob, error) {
+	if options.Provider == "" {
+		if mc, err := backend.Instances.Get(instanceID); err == nil {
+			options.Provider = ServerType(mc.Config().ServerType)
+		}
+	}
+	return jobs.start(JobUpgrade, instanceID, options.Provider, options.Version, options.Build, func(ctx context.Context, job *DownloadJob) (InstallResult, error) {
+		return UpgradeServer(ctx, instanceID, options, func(step string) {
+			jobs.step(job, step)
+		}, jobs.progressFunc(job))
+	})
+}
+
+func (jobs *downloadJobs) start(kind string, instanceID string, serverType ServerType, version string, build string, run func(ctx context.Context, job *DownloadJob) (InstallResult, error)) (DownloadJob, error) {
+	if serverType == "" {
+		serverType = Vanilla
+	}
+	if _, err := GetProvider(serverType); err != nil {
+		return DownloadJob{}, err
+	}
+	mc, err := backend.Instances.Get(instanceID)
+	if err != nil {
+		return DownloadJob{}, err
+	}
+	if kind == JobInstall && mc.IsActive() {
+		return DownloadJob{}, fmt.Errorf("instance %s is running, stop it first", instanceID)
+	}
+	if version == "" {
+		return DownloadJob{}, errors.New("no version given")
+	}
+
+	jobs.mu.Lock()
+	for _, job := range jobs.jobs {
+		if job.Instance == instanceID && job.State == JobRunning {
+			jobs.mu.Unlock()
+			return DownloadJob{}, fmt.Errorf("instance %s is already running an %s of %s %s", instanceID, job.Kind, job.Provider, job.Version)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &DownloadJob{
+		ID:        jobs.nextID,
+		Kind:      kind,
+		Instance:  instanceID,
+		Provider:  serverType,
+		Version:   version,
+		Build:     build,
+		State:     JobRunning,
+		StartedAt: time.Now(),
+		cancel:    cancel,
+	}
+	jobs.nextID++
+	jobs.jobs = append(jobs.jobs, job)
+	jobs.prune()
+	snapshot := *job
+	jobs.broadcast(job)
+	jobs.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		result, err := run(ctx, job)
+		jobs.finish(job, result, err, ctx.Err() != nil)
+	}()
+
+	return snapshot, nil
+}
+
+func (jobs *downloadJobs) progressFunc(job *DownloadJob) ProgressFunc {
+	return func(done int64, total int64) {
+		jobs.progress(job, done, total)
+	}
+}
+
+func (jobs *downloadJobs) step(job *DownloadJob, step string) {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	job.Step = step
+	jobs.broadcast(job)
+}
+
+func (jobs *downloadJobs) progress(job *DownloadJob, done int64, total int64) {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	job.Done = done
+	job.Total = total
+	if time.Since(job.lastBroadcast) >= progressInterval {
+		jobs.broadcast(job)
+	}
+}
+
+func (jobs *downloadJobs) finish(job *DownloadJob, result InstallResult, err error, cancelled bool) {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	now := time.Now()
+	job.FinishedAt = &now
+	// A cancelled upgrade still rolls back, what became of the server
+	// matters more than the cancel.
+	switch {
+	case errors.As(err, new(*RollbackError)):
+		job.State = JobRolledBack
+		job.Error = err.Error()
+		fmt.Printf("\nDownload %d rolled back: %v", job.ID, err)
+	case errors.As(err, new(*RollbackFailedError)):
+		job.State = JobFailed
+		job.Error = err.Error()
+		fmt.Printf("\nDownload %d failed to roll back: %v", job.ID, err)
+	case cancelled:
+		job.State = JobCancelled
+		fmt.Printf("\nDownload %d cancelled", job.ID)
+	case err != nil:
+		job.State = JobFailed
+		job.Error = err.Error()
+		fmt.Printf("\nDownload %d failed: %v", job.ID, err)
+	default:
+		job.State = JobCompleted
+		job.Build = result.Build
+		job.Version = result.Version
+		fmt.Printf("\nDownload %d completed: %s %s build %s", job.ID, result.Provider, result.Version, result.Build)
+	}
+	jobs.broadcast(job)
+}
+
+// broadcast sends the job to the feed. Callers hold jobs.mu.
+func (jobs *downloadJobs) broadcast(job *DownloadJob) {
+	job.lastBroadcast = time.Now()
+	message, err := json.Marshal(jobMessage{Type: "download", Job: *job})
+	if err != nil {
+		return
+	}
+	jobs.feed.broadcast(message, job.State != JobRunning)
+}
+
+// prune forgets the oldest finished jobs. Callers hold jobs.mu.
+func (jobs *downloadJobs) prune() {
+	finished := 0
+	for _, job := range jobs.jobs {
+		if job.State != JobRunning {
+			finished++
+		}
+	}
+	kept := jobs.jobs[:0]
+	for _, job := range jobs.jobs {
+		if job.State != JobRunning && finished > finishedJobsKept {
+			finished--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	jobs.jobs = kept
+}
+
+// Cancel stops a running job, its partial download is removed.
+func (jobs *downloadJobs) Cancel(id int) error {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	for _, job := range jobs.jobs {
+		if job.ID != id {
+			continue
+		}
+		if job.State != JobRunning {
+			return fmt.Errorf("download %d is already %s", id, job.State)
+		}
+		job.cancel()
+		return nil
+	}
+	return fmt.Errorf("download %d does not exist", id)
+}
+
+// List returns every known job, oldest first.
+func (jobs *downloadJobs) List() []DownloadJob {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	list := make([]DownloadJob, 0, len(jobs.jobs))
+	for _, job := range jobs.jobs {
+		list = append(list, *job)
+	}
+	return list
+}
+
+// Wait blocks until job id is finished and returns it, for tests and
+// callers that need the result.
+func (jobs *downloadJobs) Wait(ctx context.Context, id int) (DownloadJob, error) {
+	for {
+		for _, job := range jobs.List() {
+			if job.ID == id && job.State != JobRunning {
+				return job, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return DownloadJob{}, ctx.Err()
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// progressFeed fans job updates out to the WebSocket clients. Slow clients
+// miss progress updates rather than holding up downloads, but not the end
+// of a job: they are disconnected instead, and get every job again when
+// they connect back.
+type progressFeed struct {
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+}
+
+func newProgressFeed() *progressFeed {
+	return &progressFeed{clients: make(map[chan []byte]struct{})}
+}
+
+func (feed *progressFeed) subscribe() chan []byte {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	client := make(chan []byte, 64)
+	feed.clients[client] = struct{}{}
+	return client
+}
+
+func (feed *progressFeed) unsubscribe(client chan []byte) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	delete(feed.clients, client)
+}
+
+// broadcast sends message to the clients, final tells it is the end of a
+// job. A client is closed when it can't take a final message.
+func (feed *progressFeed) broadcast(message []byte, final bool) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	for client := range feed.clients {
+		select {
+		case client <- message:
+		default:
+			if final {
+				delete(feed.clients, client)
+				close(client)
+			}
+		}
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// DownloadsHandler lists the download jobs.
+func DownloadsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DownloadJobs.List())
+}
+
+func CancelDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		backend.HtmlDetailedError(w, errors.New("id should be a download id"))
+		return
+	}
+	if err := DownloadJobs.Cancel(id); err != nil {
+		backend.HtmlDetailedError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": fmt.Sprintf("Download %d cancelled", id),
+	})
+}
+
+// DownloadsWsHandler sends every job once, as a "downloads" message, then a
+// "download" message each time a job changes.
+func DownloadsWsHandler(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Printf("\nWebSocket upgrade error from %s: %v", r.RemoteAddr, err)
+		return
+	}
+	defer ws.Close()
+
+	client := DownloadJobs.feed.subscribe()
+	defer DownloadJobs.feed.unsubscribe(client)
+
+	err = ws.WriteJSON(map[string]interface{}{
+		"type": "downloads",
+		"jobs": DownloadJobs.List(),
+	})
+	if err != nil {
+		return
+	}
+
+	// The feed is one way, reading only notices the client going away.
+	closed := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case message, ok := <-client:
+			if !ok {
+				// Too slow to be sent the end of a job.
+				return
+			}
+			ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := ws.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func DownloadsViewHandler(w http.ResponseWriter, r *http.Request) {
+	var downloadsTemplate = template.Must(template.New("downloads.html").ParseFiles("./frontend/templates/downloads.html"))
+
+	w.Header().Set("Content-Type", "text/html")
+	downloadsTemplate.ExecuteTemplate(w, "downloads.html", map[string]string{
+		"Instance": r.URL.Query().Get("instance"),
+	})
+}
@@ -0,0 +1,229 @@
+package filesdownload
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func shortRetries(t *testing.T) {
+	previous := retryDelay
+	retryDelay = func(attempt int) time.Duration { return time.Millisecond }
+	t.Cleanup(func() { retryDelay = previous })
+}
+
+// flakyServer serves content but drops the connection after cut bytes the
+// first time. etag changes what later requests are told the file is.
+func flakyServer(t *testing.T, content []byte, cut int, etag func(request int) string) (*httptest.Server, *[]string) {
+	ranges := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", etag(len(ranges)))
+		if len(ranges) == 1 {
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Write(content[:cut])
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "server.jar", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+	return server, &ranges
+}
+
+func TestDownloadResumesWithRange(t *testing.T) {
+	shortRetries(t)
+	content := bytes.Repeat([]byte("minecraft "), 10000)
+	sum := sha256.Sum256(content)
+
+	cases := []struct {
+		name     string
+		etag     func(request int) string
+		expected []string
+	}{
+		{"resumed", func(int) string { return `"v1"` }, []string{"", "bytes=40000-"}},
+		// The file changed in between, If-Range makes the server send all of it.
+		{"changed", func(request int) string { return fmt.Sprintf(`"v%d"`, request) }, []string{"", "bytes=40000-"}},
+	}
+	for _, c := range cases {
+		server, ranges := flakyServer(t, content, 40000, c.etag)
+		destination := filepath.Join(t.TempDir(), "server.jar")
+
+		var done, total int64
+		download := ServerDownload{Url: server.URL, Size: int64(len(content)), Sha256: hexSum(sum[:])}
+		err := downloadVerified(context.Background(), download, destination, func(d int64, t int64) {
+			done, total = d, t
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if fmt.Sprint(*ranges) != fmt.Sprint(c.expected) {
+			t.Errorf("%s: requested ranges %q, expected %q", c.name, *ranges, c.expected)
+		}
+		if done != int64(len(content)) || total != int64(len(content)) {
+			t.Errorf("%s: last progress %d/%d", c.name, done, total)
+		}
+		written, _ := os.ReadFile(destination)
+		if !bytes.Equal(written, content) {
+			t.Errorf("%s: downloaded content differs", c.name)
+		}
+	}
+}
+
+func TestDownloadGivesUpOnClientErrors(t *testing.T) {
+	shortRetries(t)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	err := downloadVerified(context.Background(), ServerDownload{Url: server.URL}, filepath.Join(t.TempDir(), "server.jar"), nil)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a 404 error, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("a 404 was retried %d times", requests-1)
+	}
+}
+
+// jobsInstance points the providers at fakeAPIs and registers a stopped
+// instance to install into.
+func jobsInstance(t *testing.T, id string) string {
+	t.Chdir(t.TempDir())
+	configureFakeAPIs(t)
+
+	directory := t.TempDir()
+	if _, err := backend.Instances.Create(backend.InstanceConfig{ID: id, Directory: directory, ServerJarName: "server.jar"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Instances.Delete(id) })
+	return directory
+}
+
+func waitJob(t *testing.T, id int) DownloadJob {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	job, err := DownloadJobs.Wait(ctx, id)
+	if err != nil {
+		t.Fatalf("download %d: %v", id, err)
+	}
+	return job
+}
+
+func TestDownloadJobCompletes(t *testing.T) {
+	directory := jobsInstance(t, "jobs-complete")
+
+	job, err := DownloadJobs.Start("jobs-complete", Vanilla, "1.21.10", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitJob(t, job.ID)
+	if job.State != JobCompleted || job.Done != int64(len(fakeJar)) || job.Error != "" {
+		t.Errorf("unexpected job %+v", job)
+	}
+
+	if _, err := os.Stat(filepath.Join(directory, "server.jar")); err != nil {
+		t.Error(err)
+	}
+	mc, _ := backend.Instances.Get("jobs-complete")
+	if mc.Config().MinecraftVersion != "1.21.10" {
+		t.Errorf("instance records version %q", mc.Config().MinecraftVersion)
+	}
+}
+
+func TestDownloadJobCancel(t *testing.T) {
+	directory := jobsInstance(t, "jobs-cancel")
+
+	job, err := DownloadJobs.Start("jobs-cancel", Vanilla, "slow", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DownloadJobs.Start("jobs-cancel", Vanilla, "1.21.10", ""); err == nil {
+		t.Error("a second download of the same instance should be refused")
+	}
+
+	// Wait for the first half to arrive.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		started := false
+		for _, running := range DownloadJobs.List() {
+			started = started || (running.ID == job.ID && running.Done > 0)
+		}
+		if started {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("download never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := DownloadJobs.Cancel(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	job = waitJob(t, job.ID)
+	if job.State != JobCancelled {
+		t.Errorf("job is %s, expected %s", job.State, JobCancelled)
+	}
+	if err := DownloadJobs.Cancel(job.ID); err == nil {
+		t.Error("cancelling a finished job should fail")
+	}
+
+	entries, _ := os.ReadDir(directory)
+	if len(entries) != 0 {
+		t.Errorf("cancelled download left %v behind", entries)
+	}
+}
+
+func TestDownloadJobCancelledDuringRollback(t *testing.T) {
+	jobs := &downloadJobs{nextID: 1, feed: newProgressFeed()}
+	cases := []struct {
+		err   error
+		state string
+	}{
+		{&RollbackError{Cause: context.Canceled, Version: "1.20.4"}, JobRolledBack},
+		{&RollbackFailedError{Cause: context.Canceled, Rollback: os.ErrPermission, Snapshot: "upgrade_backups/1"}, JobFailed},
+		{context.Canceled, JobCancelled},
+	}
+	for _, c := range cases {
+		job := &DownloadJob{State: JobRunning}
+		jobs.finish(job, InstallResult{}, c.err, true)
+		if job.State != c.state {
+			t.Errorf("%v: job %s, expected %s", c.err, job.State, c.state)
+		}
+		if c.state != JobCancelled && job.Error != c.err.Error() {
+			t.Errorf("%v: the error isn't reported, got %q", c.err, job.Error)
+		}
+	}
+}
+
+func TestProgressFeedClosesSlowClients(t *testing.T) {
+	feed := newProgressFeed()
+	client := feed.subscribe()
+	for range cap(client) + 1 {
+		feed.broadcast([]byte("progress"), false)
+	}
+	if len(client) != cap(client) {
+		t.Fatalf("%d messages queued", len(client))
+	}
+
+	// The end of a job doesn't fit, the client is dropped.
+	feed.broadcast([]byte("completed"), true)
+	for range cap(client) {
+		<-client
+	}
+	if _, ok := <-client; ok {
+		t.Error("a client that missed the end of a job is still subscribed")
+	}
+	feed.unsubscribe(client)
+}
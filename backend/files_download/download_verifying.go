@@ -0,0 +1,248 @@
+package filesdownload
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// API calls must answer within metadataTimeout.
+	metadataTimeout = 30 * time.Second
+	// A download is retried once no byte arrived for stallTimeout.
+	stallTimeout = 30 * time.Second
+	// How many times a download is resumed before giving up.
+	downloadAttempts = 5
+)
+
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 15 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// retryDelay is how long to wait before the given attempt, tests shorten it.
+var retryDelay = func(attempt int) time.Duration {
+	return time.Duration(attempt) * time.Second
+}
+
+// ProgressFunc is told how many bytes of a download are on disk, total is
+// 0 while unknown.
+type ProgressFunc func(done int64, total int64)
+
+func checkSha1(data []byte, expected string) error {
+	sum := sha1.Sum(data)
+	if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("SHA-1 mismatch, expected %s got %s", expected, actual)
+	}
+	return nil
+}
+
+// partialDownload is a download being written to a temporary file, hashed
+// as it goes so it can be resumed where it stopped.
+type partialDownload struct {
+	file       *os.File
+	written    int64
+	total      int64
+	validator  string
+	sha1Hash   hash.Hash
+	sha256Hash hash.Hash
+}
+
+func (partial *partialDownload) restart() error {
+	if _, err := partial.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := partial.file.Truncate(0); err != nil {
+		return err
+	}
+	partial.written = 0
+	partial.sha1Hash = sha1.New()
+	partial.sha256Hash = sha256.New()
+	return nil
+}
+
+// errPermanent marks failures that a retry won't fix.
+type errPermanent struct{ err error }
+
+func (e errPermanent) Error() string { return e.err.Error() }
+func (e errPermanent) Unwrap() error { return e.err }
+
+// downloadVerified streams a download into a temporary file next to
+// destination and renames it into place only when its size and hashes
+// match what the provider announced. Interrupted transfers are resumed
+// with HTTP Range requests. A failed download leaves destination untouched.
+func downloadVerified(ctx context.Context, download ServerDownload, destination string, progress ProgressFunc) error {
+	tmp, err := os.CreateTemp(filepath.Dir(destination), "."+filepath.Base(destination)+".*.part")
+	if err != nil {
+		return err
+	}
+	// Removing fails harmlessly once the file has been renamed.
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	partial := &partialDownload{file: tmp, total: download.Size}
+	partial.restart()
+
+	for attempt := 1; ; attempt++ {
+		err = partial.fetch(ctx, download.Url, progress)
+		if err == nil {
+			break
+		}
+		var permanent errPermanent
+		if ctx.Err() != nil || errors.As(err, &permanent) || attempt >= downloadAttempts {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return fmt.Errorf("downloading %s: %w", download.Url, err)
+		}
+		fmt.Printf("\nDownload of %s interrupted at %d bytes, retrying: %v", download.Url, partial.written, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("downloading %s: %w", download.Url, ctx.Err())
+		case <-time.After(retryDelay(attempt)):
+		}
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if download.Size > 0 && partial.written != download.Size {
+		return fmt.Errorf("downloading %s: expected %d bytes, got %d", download.Url, download.Size, partial.written)
+	}
+	if err := checkHash("SHA-1", partial.sha1Hash, download.Sha1); err != nil {
+		return fmt.Errorf("downloading %s: %w", download.Url, err)
+	}
+	if err := checkHash("SHA-256", partial.sha256Hash, download.Sha256); err != nil {
+		return fmt.Errorf("downloading %s: %w", download.Url, err)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), destination)
+}
+
+// fetch requests what is still missing and appends it to the file.
+func (partial *partialDownload) fetch(ctx context.Context, url string, progress ProgressFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return errPermanent{err}
+	}
+	if partial.written > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", partial.written))
+		if partial.validator != "" {
+			// Only resume if the file didn't change in between.
+			request.Header.Set("If-Range", partial.validator)
+		}
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusOK:
+		if partial.written > 0 {
+			// The server ignored the range, start over.
+			if err := partial.restart(); err != nil {
+				return errPermanent{err}
+			}
+		}
+		if response.ContentLength > 0 {
+			partial.total = response.ContentLength
+		}
+	case response.StatusCode == http.StatusPartialContent && partial.written > 0:
+		if total := contentRangeTotal(response.Header.Get("Content-Range")); total > 0 {
+			partial.total = total
+		}
+	case response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusRequestTimeout:
+		return fmt.Errorf("GET %s: %s", url, response.Status)
+	default:
+		return errPermanent{fmt.Errorf("GET %s: %s", url, response.Status)}
+	}
+
+	if partial.written == 0 {
+		partial.validator = response.Header.Get("ETag")
+		if partial.validator == "" || strings.HasPrefix(partial.validator, "W/") {
+			partial.validator = response.Header.Get("Last-Modified")
+		}
+	}
+
+	// Cancel the request when the server stops sending.
+	stall := time.AfterFunc(stallTimeout, cancel)
+	defer stall.Stop()
+
+	writer := io.MultiWriter(partial.file, partial.sha1Hash, partial.sha256Hash)
+	buffer := make([]byte, 32*1024)
+	for {
+		n, readErr := response.Body.Read(buffer)
+		if n > 0 {
+			stall.Reset(stallTimeout)
+			if _, err := writer.Write(buffer[:n]); err != nil {
+				return errPermanent{err}
+			}
+			partial.written += int64(n)
+			if progress != nil {
+				progress(partial.written, partial.total)
+			}
+		}
+		if readErr == io.EOF {
+			if partial.total > 0 && partial.written < partial.total {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// contentRangeTotal reads the complete length from "bytes 100-199/200".
+func contentRangeTotal(header string) int64 {
+	slash := strings.LastIndexByte(header, '/')
+	if slash < 0 {
+		return 0
+	}
+	total, err := strconv.ParseInt(header[slash+1:], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return total
+}
+
+func checkHash(name string, hasher hash.Hash, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("%s mismatch, expected %s got %s", name, expected, actual)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package filesdownload
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeJar is the content served for every server jar.
+var fakeJar = []byte("PK\x03\x04 not really a jar")
+
+func hexSum(sum []byte) string {
+	return hex.EncodeToString(sum)
+}
+
+var fakeJarSha1 = func() string { sum := sha1.Sum(fakeJar); return hexSum(sum[:]) }()
+var fakeJarSha256 = func() string { sum := sha256.Sum256(fakeJar); return hexSum(sum[:]) }()
+
+// crashingJar is served for the Mojang version "crashes", fakeJava exits
+// with an error when it runs it.
+var crashingJar = []byte("PK\x03\x04 crashes on start")
+
+func fakeJarFor(id string) []byte {
+	if id == "crashes" {
+		return crashingJar
+	}
+	return fakeJar
+}
+
+// tempCache points the download cache at a directory removed after the test.
+func tempCache(t *testing.T) string {
+	previous := backend.SavedAppConfig.DownloadConfig.CacheDir
+	backend.SavedAppConfig.DownloadConfig.CacheDir = t.TempDir()
+	t.Cleanup(func() { backend.SavedAppConfig.DownloadConfig.CacheDir = previous })
+	return backend.SavedAppConfig.DownloadConfig.CacheDir
+}
+
+// fakeAPIs serves small copies of the Mojang, PaperMC and Fabric APIs:
+//
+//	/mojang/version_manifest_v2.json, /mojang/v/<id>.json, /mojang/jar/<id>
+//	/paper/projects/<project>/...
+//	/fabric/versions/...
+//
+// Mojang versions "tampered", "truncated" and "bad-json" announce hashes or
+// sizes that don't match what is served. The jar of "slow" stops halfway
+// until the client goes away, the one of "crashes" is crashingJar.
+// Downloads are cached in a tempCache.
+func fakeAPIs(t *testing.T) *httptest.Server {
+	tempCache(t)
+	mux := http.NewServeMux()
+	var server *httptest.Server
+
+	writeJSON := func(w http.ResponseWriter, value interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(value)
+	}
+	serveJar := func(w http.ResponseWriter, r *http.Request) {
+		w.Write(fakeJar)
+	}
+
+	mojangVersions := map[string]int{"1.21.10": 21, "25w41a": 21, "1.20.4": 17, "1.16.5": 8, "tampered": 21, "truncated": 21, "bad-json": 21, "slow": 21, "crashes": 21}
+	versionJSON := func(id string) []byte {
+		jar := fakeJarFor(id)
+		jarSha1 := sha1.Sum(jar)
+		download := map[string]interface{}{"url": server.URL + "/mojang/jar/" + id, "sha1": hexSum(jarSha1[:]), "size": len(jar)}
+		switch id {
+		case "tampered":
+			download["sha1"] = "0000000000000000000000000000000000000000"
+		case "truncated":
+			download["size"] = len(fakeJar) + 100
+		}
+		data, _ := json.Marshal(map[string]interface{}{
+			"id":          id,
+			"downloads":   map[string]interface{}{"server": download},
+			"javaVersion": map[string]interface{}{"component": "java-runtime", "majorVersion": mojangVersions[id]},
+		})
+		return data
+	}
+	mux.HandleFunc("/mojang/version_manifest_v2.json", func(w http.ResponseWriter, r *http.Request) {
+		versions := []map[string]string{}
+		for _, version := range []struct{ id, kind, time string }{
+			{"25w41a", "snapshot", "2025-10-08T12:00:00+00:00"},
+			{"1.21.10", "release", "2025-10-07T09:00:00+00:00"},
+			{"1.20.4", "release", "2023-12-07T12:00:00+00:00"},
+			{"1.16.5", "release", "2021-01-14T16:05:32+00:00"},
+			{"tampered", "old_alpha", "2010-01-01T00:00:00+00:00"},
+			{"truncated", "old_alpha", "2010-01-01T00:00:00+00:00"},
+			{"bad-json", "old_alpha", "2010-01-01T00:00:00+00:00"},
+			{"slow", "old_alpha", "2010-01-01T00:00:00+00:00"},
+			{"crashes", "old_alpha", "2026-01-01T00:00:00+00:00"},
+		} {
+			sum := sha1.Sum(versionJSON(version.id))
+			if version.id == "bad-json" {
+				sum = [20]byte{}
+			}
+			versions = append(versions, map[string]string{
+				"id":          version.id,
+				"type":        version.kind,
+				"url":         server.URL + "/mojang/v/" + version.id + ".json",
+				"releaseTime": version.time,
+				"sha1":        hexSum(sum[:]),
+			})
+		}
+		writeJSON(w, map[string]interface{}{
+			"latest":   map[string]string{"release": "1.21.10", "snapshot": "25w41a"},
+			"versions": versions,
+		})
+	})
+	mux.HandleFunc("/mojang/v/{file}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("file")
+		id = id[:len(id)-len(".json")]
+		if _, ok := mojangVersions[id]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(versionJSON(id))
+	})
+	mux.HandleFunc("/mojang/jar/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if id := r.PathValue("id"); id != "slow" {
+			w.Write(fakeJarFor(id))
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(fakeJar)))
+		w.Write(fakeJar[:len(fakeJar)/2])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+
+	mux.HandleFunc("/paper/projects/{project}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"project_id": r.PathValue("project"),
+			"versions":   []string{"1.20.4", "1.21.10-pre1", "1.21.10"},
+		})
+	})
+	mux.HandleFunc("/paper/projects/{project}/versions/{version}/builds", func(w http.ResponseWriter, r *http.Request) {
+		project, version := r.PathValue("project"), r.PathValue("version")
+		builds := []map[string]interface{}{}
+		for i, channel := range []string{"default", "default", "experimental"} {
+			build := 100 + i
+			builds = append(builds, map[string]interface{}{
+				"build":   build,
+				"time":    fmt.Sprintf("2025-10-0%dT10:00:00Z", i+1),
+				"channel": channel,
+				"downloads": map[string]interface{}{"application": map[string]string{
+					"name":   fmt.Sprintf("%s-%s-%d.jar", project, version, build),
+					"sha256": fakeJarSha256,
+				}},
+			})
+		}
+		writeJSON(w, map[string]interface{}{"builds": builds})
+	})
+	mux.HandleFunc("/paper/projects/{project}/versions/{version}/builds/{build}/downloads/{name}", serveJar)
+
+	mux.HandleFunc("/fabric/versions/game", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, []map[string]interface{}{
+			{"version": "25w41a", "stable": false},
+			{"version": "1.21.10", "stable": true},
+		})
+	})
+	mux.HandleFunc("/fabric/versions/loader/{game}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("game") == "1.0" {
+			writeJSON(w, []interface{}{})
+			return
+		}
+		writeJSON(w, []map[string]interface{}{
+			{"loader": map[string]interface{}{"version": "0.17.3-beta", "stable": false}},
+			{"loader": map[string]interface{}{"version": "0.17.2", "stable": true}},
+		})
+	})
+	mux.HandleFunc("/fabric/versions/installer", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, []map[string]interface{}{
+			{"version": "1.1.1", "stable": false},
+			{"version": "1.1.0", "stable": true},
+		})
+	})
+	mux.HandleFunc("/fabric/versions/loader/{game}/{loader}/{installer}/server/jar", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("loader") != "0.17.2" || r.PathValue("installer") != "1.1.0" {
+			http.NotFound(w, r)
+			return
+		}
+		serveJar(w, r)
+	})
+
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// fakeProviders returns every provider pointed at a fakeAPIs server.
+func fakeProviders(t *testing.T) map[ServerType]ServerProvider {
+	server := fakeAPIs(t)
+	vanilla := NewVanillaProvider(server.URL + "/mojang/version_manifest_v2.json")
+	return map[ServerType]ServerProvider{
+		Vanilla: vanilla,
+		Paper:   NewPaperProvider(server.URL+"/paper", Paper, vanilla),
+		Folia:   NewPaperProvider(server.URL+"/paper", Folia, vanilla),
+		Fabric:  NewFabricProvider(server.URL+"/fabric", vanilla),
+	}
+}
+
+// configureFakeAPIs points the app settings at a fakeAPIs server, for code
+// that uses Providers.
+func configureFakeAPIs(t *testing.T) *httptest.Server {
+	server := fakeAPIs(t)
+	previous := backend.SavedAppConfig.DownloadConfig
+	backend.SavedAppConfig.DownloadConfig.VanillaManifestUrl = server.URL + "/mojang/version_manifest_v2.json"
+	backend.SavedAppConfig.DownloadConfig.PaperApiUrl = server.URL + "/paper"
+	backend.SavedAppConfig.DownloadConfig.FabricMetaUrl = server.URL + "/fabric"
+	t.Cleanup(func() { backend.SavedAppConfig.DownloadConfig = previous })
+	return server
+}
@@ -0,0 +1,118 @@
+package filesdownload
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// FABRIC_LAUNCHER_JAR is where the Fabric server launcher is saved. It
+// downloads the vanilla server to server.jar on first start, so it can't
+// use that name.
+const FABRIC_LAUNCHER_JAR = "fabric-server-launch.jar"
+
+// FabricProvider installs the Fabric server launcher from Fabric meta. A
+// build is a loader version, the launcher is built for the latest stable
+// installer.
+type FabricProvider struct {
+	MetaUrl string
+	// Asked for the Java version, Fabric meta doesn't give it.
+	Vanilla *VanillaProvider
+}
+
+func NewFabricProvider(metaUrl string, vanilla *VanillaProvider) *FabricProvider {
+	return &FabricProvider{MetaUrl: metaUrl, Vanilla: vanilla}
+}
+
+type fabricVersion struct {
+	Version string `json:"version"`
+	Stable  bool   `json:"stable"`
+}
+
+type fabricLoader struct {
+	Loader fabricVersion `json:"loader"`
+}
+
+func (provider *FabricProvider) Type() ServerType {
+	return Fabric
+}
+
+func (provider *FabricProvider) ListVersions(ctx context.Context) ([]ServerVersion, error) {
+	var games []fabricVersion
+	if err := getJSON(ctx, provider.MetaUrl+"/versions/game", &games); err != nil {
+		return nil, err
+	}
+
+	versions := make([]ServerVersion, 0, len(games))
+	for _, game := range games {
+		versionType := "snapshot"
+		if game.Stable {
+			versionType = "release"
+		}
+		versions = append(versions, ServerVersion{Id: game.Version, Type: versionType})
+	}
+	return versions, nil
+}
+
+func (provider *FabricProvider) ListBuilds(ctx context.Context, version string) ([]ServerBuild, error) {
+	var loaders []fabricLoader
+	if err := getJSON(ctx, provider.MetaUrl+"/versions/loader/"+url.PathEscape(version), &loaders); err != nil {
+		return nil, err
+	}
+	if len(loaders) == 0 {
+		return nil, fmt.Errorf("Fabric does not support Minecraft %s", version)
+	}
+
+	builds := make([]ServerBuild, 0, len(loaders))
+	for _, loader := range loaders {
+		builds = append(builds, ServerBuild{Id: loader.Loader.Version, Stable: loader.Loader.Stable})
+	}
+	return builds, nil
+}
+
+func (provider *FabricProvider) latestInstaller(ctx context.Context) (string, error) {
+	var installers []fabricVersion
+	if err := getJSON(ctx, provider.MetaUrl+"/versions/installer", &installers); err != nil {
+		return "", err
+	}
+	if len(installers) == 0 {
+		return "", fmt.Errorf("no Fabric installer available")
+	}
+	for _, installer := range installers {
+		if installer.Stable {
+			return installer.Version, nil
+		}
+	}
+	return installers[0].Version, nil
+}
+
+func (provider *FabricProvider) ResolveDownload(ctx context.Context, version string, build string) (ServerDownload, error) {
+	builds, err := provider.ListBuilds(ctx, version)
+	if err != nil {
+		return ServerDownload{}, err
+	}
+	loader, err := findBuild(builds, build)
+	if err != nil {
+		return ServerDownload{}, err
+	}
+	installer, err := provider.latestInstaller(ctx)
+	if err != nil {
+		return ServerDownload{}, err
+	}
+
+	download := ServerDownload{
+		Version:  version,
+		Build:    loader.Id,
+		Url:      fmt.Sprintf("%s/versions/loader/%s/%s/%s/server/jar", provider.MetaUrl, url.PathEscape(version), url.PathEscape(loader.Id), url.PathEscape(installer)),
+		FileName: FABRIC_LAUNCHER_JAR,
+	}
+	if provider.Vanilla != nil {
+		download.JavaMajor, _ = provider.Vanilla.JavaMajor(ctx, version)
+	}
+	return download, nil
+}
+
+// Install always saves the launcher as FABRIC_LAUNCHER_JAR.
+func (provider *FabricProvider) Install(ctx context.Context, version string, build string, directory string, jarName string, progress ProgressFunc) (InstallResult, error) {
+	return installDownload(ctx, provider, version, build, directory, FABRIC_LAUNCHER_JAR, progress)
+}
@@ -0,0 +1,127 @@
+package filesdownload
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// PaperProvider installs PaperMC projects, Paper and Folia, from the
+// downloads API v2.
+type PaperProvider struct {
+	ApiUrl  string
+	Project ServerType
+	// Asked for the Java version, the Paper API doesn't give it.
+	Vanilla *VanillaProvider
+}
+
+func NewPaperProvider(apiUrl string, project ServerType, vanilla *VanillaProvider) *PaperProvider {
+	return &PaperProvider{ApiUrl: apiUrl, Project: project, Vanilla: vanilla}
+}
+
+type paperProject struct {
+	Versions []string `json:"versions"`
+}
+
+type paperBuilds struct {
+	Builds []struct {
+		Build     int       `json:"build"`
+		Time      time.Time `json:"time"`
+		Channel   string    `json:"channel"`
+		Downloads struct {
+			Application struct {
+				Name   string `json:"name"`
+				Sha256 string `json:"sha256"`
+			} `json:"application"`
+		} `json:"downloads"`
+	} `json:"builds"`
+}
+
+func (provider *PaperProvider) Type() ServerType {
+	return provider.Project
+}
+
+func (provider *PaperProvider) projectUrl() string {
+	return provider.ApiUrl + "/projects/" + url.PathEscape(string(provider.Project))
+}
+
+func (provider *PaperProvider) ListVersions(ctx context.Context) ([]ServerVersion, error) {
+	project := paperProject{}
+	if err := getJSON(ctx, provider.projectUrl(), &project); err != nil {
+		return nil, err
+	}
+
+	// The API lists versions oldest first.
+	versions := make([]ServerVersion, 0, len(project.Versions))
+	for i := len(project.Versions) - 1; i >= 0; i-- {
+		versions = append(versions, ServerVersion{
+			Id:   project.Versions[i],
+			Type: versionType(project.Versions[i]),
+		})
+	}
+	return versions, nil
+}
+
+func (provider *PaperProvider) builds(ctx context.Context, version string) (paperBuilds, error) {
+	builds := paperBuilds{}
+	err := getJSON(ctx, provider.projectUrl()+"/versions/"+url.PathEscape(version)+"/builds", &builds)
+	return builds, err
+}
+
+func (provider *PaperProvider) ListBuilds(ctx context.Context, version string) ([]ServerBuild, error) {
+	builds, err := provider.builds(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	return builds.serverBuilds(), nil
+}
+
+// serverBuilds converts the builds, which the API lists oldest first.
+func (builds paperBuilds) serverBuilds() []ServerBuild {
+	result := make([]ServerBuild, 0, len(builds.Builds))
+	for i := len(builds.Builds) - 1; i >= 0; i-- {
+		build := builds.Builds[i]
+		result = append(result, ServerBuild{
+			Id:     strconv.Itoa(build.Build),
+			Stable: build.Channel == "default",
+			Time:   build.Time,
+		})
+	}
+	return result
+}
+
+func (provider *PaperProvider) ResolveDownload(ctx context.Context, version string, build string) (ServerDownload, error) {
+	builds, err := provider.builds(ctx, version)
+	if err != nil {
+		return ServerDownload{}, err
+	}
+	selected, err := findBuild(builds.serverBuilds(), build)
+	if err != nil {
+		return ServerDownload{}, err
+	}
+
+	for _, candidate := range builds.Builds {
+		if strconv.Itoa(candidate.Build) != selected.Id {
+			continue
+		}
+		application := candidate.Downloads.Application
+		download := ServerDownload{
+			Version:  version,
+			Build:    selected.Id,
+			Url:      fmt.Sprintf("%s/versions/%s/builds/%d/downloads/%s", provider.projectUrl(), url.PathEscape(version), candidate.Build, url.PathEscape(application.Name)),
+			FileName: application.Name,
+			Sha256:   application.Sha256,
+		}
+		if provider.Vanilla != nil {
+			download.JavaMajor, _ = provider.Vanilla.JavaMajor(ctx, version)
+		}
+		return download, nil
+	}
+	return ServerDownload{}, fmt.Errorf("Build %s is nowhere to be found.", selected.Id)
+}
+
+func (provider *PaperProvider) Install(ctx context.Context, version string, build string, directory string, jarName string, progress ProgressFunc) (InstallResult, error) {
+	return installDownload(ctx, provider, version, build, directory, jarName, progress)
+}
@@ -0,0 +1,169 @@
+package filesdownload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Version files fetched at once by JavaMajors.
+const javaLookupWorkers = 8
+
+// Version files JavaMajors downloads in one call, it only reads the others
+// from the cache. A cold listing of every version fetches the newest ones
+// and each listing the next, rather than hundreds of files at once.
+var javaLookupLimit = 20
+
+// VanillaProvider installs the official server from Mojang's version
+// manifest.
+type VanillaProvider struct {
+	ManifestUrl string
+}
+
+func NewVanillaProvider(manifestUrl string) *VanillaProvider {
+	return &VanillaProvider{ManifestUrl: manifestUrl}
+}
+
+func (provider *VanillaProvider) Type() ServerType {
+	return Vanilla
+}
+
+func (provider *VanillaProvider) ListVersions(ctx context.Context) ([]ServerVersion, error) {
+	manifest := MojangVersionsManifest{}
+	if err := getJSON(ctx, provider.ManifestUrl, &manifest); err != nil {
+		return nil, err
+	}
+
+	versions := make([]ServerVersion, 0, len(manifest.Versions))
+	for _, version := range manifest.Versions {
+		latest := version.Id == manifest.LatestVersions.Release || version.Id == manifest.LatestVersions.Snapshot
+		versions = append(versions, ServerVersion{
+			Id:          version.Id,
+			Type:        version.VersionType,
+			ReleaseTime: version.ReleaseTime,
+			Latest:      latest && (version.VersionType == "release" || version.VersionType == "snapshot"),
+		})
+	}
+	return versions, nil
+}
+
+// ListBuilds returns a single build named after the version.
+func (provider *VanillaProvider) ListBuilds(ctx context.Context, version string) ([]ServerBuild, error) {
+	versionInfo, err := provider.versionInfo(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	return []ServerBuild{{Id: versionInfo.Id, Stable: true}}, nil
+}
+
+func (provider *VanillaProvider) versionInfo(ctx context.Context, version string) (MojangVersionManifest, error) {
+	manifest := MojangVersionsManifest{}
+	if err := getJSON(ctx, provider.ManifestUrl, &manifest); err != nil {
+		return MojangVersionManifest{}, err
+	}
+
+	for _, entry := range manifest.Versions {
+		if entry.Id == version {
+			return getVersionInfo(ctx, entry.Url, entry.Sha1)
+		}
+	}
+	return MojangVersionManifest{}, fmt.Errorf("Version %s is nowhere to be found.", version)
+}
+
+// JavaMajor returns the Java version Mojang requires for a Minecraft
+// version, which modded servers share.
+func (provider *VanillaProvider) JavaMajor(ctx context.Context, version string) (int, error) {
+	versionInfo, err := provider.versionInfo(ctx, version)
+	if err != nil {
+		return 0, err
+	}
+	return versionInfo.JavaVersion.MajorVersion, nil
+}
+
+// JavaMajors returns the Java version required by each of versions, leaving
+// out the unknown ones. Version files are cached for good, they never
+// change: the cached ones are read, then the first javaLookupLimit others
+// in the order of versions are fetched a few at a time.
+func (provider *VanillaProvider) JavaMajors(ctx context.Context, versions []string) (map[string]int, error) {
+	manifest := MojangVersionsManifest{}
+	if err := getJSON(ctx, provider.ManifestUrl, &manifest); err != nil {
+		return nil, err
+	}
+	indexes := map[string]int{}
+	for i, entry := range manifest.Versions {
+		indexes[entry.Id] = i
+	}
+
+	majors := map[string]int{}
+	missing := []int{}
+	for _, version := range versions {
+		i, found := indexes[version]
+		if !found {
+			continue
+		}
+		entry := manifest.Versions[i]
+		if major := cachedJavaMajor(entry.Url, entry.Sha1); major != 0 {
+			majors[entry.Id] = major
+		} else if len(missing) < javaLookupLimit {
+			missing = append(missing, i)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, javaLookupWorkers)
+	for _, i := range missing {
+		entry := manifest.Versions[i]
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(id string, url string, sha1 string) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			versionInfo, err := getVersionInfo(ctx, url, sha1)
+			if err != nil || versionInfo.JavaVersion.MajorVersion == 0 {
+				return
+			}
+			mu.Lock()
+			majors[id] = versionInfo.JavaVersion.MajorVersion
+			mu.Unlock()
+		}(entry.Id, entry.Url, entry.Sha1)
+	}
+	wg.Wait()
+	return majors, ctx.Err()
+}
+
+// cachedJavaMajor returns the Java version of a version file in the cache,
+// or 0 when it isn't there.
+func cachedJavaMajor(url string, sha1 string) int {
+	data, _, err := currentCache().readMetadata(url)
+	if err != nil || checkSha1(data, sha1) != nil {
+		return 0
+	}
+	versionInfo := MojangVersionManifest{}
+	if err := json.Unmarshal(data, &versionInfo); err != nil {
+		return 0
+	}
+	return versionInfo.JavaVersion.MajorVersion
+}
+
+func (provider *VanillaProvider) ResolveDownload(ctx context.Context, version string, build string) (ServerDownload, error) {
+	versionInfo, err := provider.versionInfo(ctx, version)
+	if err != nil {
+		return ServerDownload{}, err
+	}
+	return ServerDownload{
+		Version:   versionInfo.Id,
+		Build:     versionInfo.Id,
+		Url:       versionInfo.Downloads.Server.Url,
+		FileName:  "server.jar",
+		Sha1:      versionInfo.Downloads.Server.Sha1,
+		Size:      versionInfo.Downloads.Server.Size,
+		JavaMajor: versionInfo.JavaVersion.MajorVersion,
+	}, nil
+}
+
+func (provider *VanillaProvider) Install(ctx context.Context, version string, build string, directory string, jarName string, progress ProgressFunc) (InstallResult, error) {
+	return installDownload(ctx, provider, version, build, directory, jarName, progress)
+}
@@ -2,12 +2,10 @@ package filesdownload
 
 import (
 	"Skyfield1888/WebMine/backend"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
 	"os"
 	"time"
 )
@@ -15,16 +13,17 @@ import (
 const DEFAULT_VERSION_MANIFEST_URL = "https://piston-meta.mojang.com/mc/game/version_manifest_v2.json"
 const FALLBACK_VERSION_MANIFEST_URL = "https://piston-meta.mojang.com/mc/game/version_manifest.json"
 
-type ServerType int
+// ServerType names a server distribution, see Providers.
+type ServerType string
 
 const (
-	Vanilla ServerType = iota
-	// Fabric
+	Vanilla ServerType = "vanilla"
+	Paper   ServerType = "paper"
+	Folia   ServerType = "folia"
+	Fabric  ServerType = "fabric"
 	// Quilt
 	// Forge
 	// NeoForge
-	// Paper
-	// Folia
 	// Above to be implemented
 )
 
@@ -47,6 +46,8 @@ type MojangVersionManifest struct {
 	Downloads struct {
 		Server struct {
 			Url string
+			Sha1 string
+			Size int64
 		}
 	}
 
@@ -59,24 +60,10 @@ type MojangVersionManifest struct {
 }
 
 func (manifest *MojangVersionsManifest) Populate(url string) error {
-	manifestData, err := http.Get(url)
-	if err != nil { return err }
-	
-	defer manifestData.Body.Close()
-
-	manifestBody, err := io.ReadAll(manifestData.Body)
-	if err != nil { return err }
-	
-	// log.Print(string(manifestBody))
-
-	err = json.Unmarshal(manifestBody, &manifest)
-	if err != nil { return err }
-	
-	return nil
+	return getJSON(context.Background(), url, manifest)
 }
 
 func GetVersionUrl(version string, manifest MojangVersionsManifest) (string, error) {
-	log.Print(manifest.Versions)
 	for _, minecraftVersion := range manifest.Versions {
 		if minecraftVersion.Id == version {
 			return minecraftVersion.Url, nil
@@ -86,13 +73,26 @@ func GetVersionUrl(version string, manifest MojangVersionsManifest) (string, err
 }
 
 func GetVersionInfo(url string) (MojangVersionManifest, error) {
+	return getVersionInfo(context.Background(), url, "")
+}
+
+// getVersionInfo is GetVersionInfo checking the JSON against the Sha1
+// listed in the versions manifest, unless sha1 is empty. A cached copy
+// matching sha1 is used without asking Mojang.
+func getVersionInfo(ctx context.Context, url string, sha1 string) (MojangVersionManifest, error) {
 	result := MojangVersionManifest{}
-	versionJson, err := http.Get(url)
-	if err != nil { return MojangVersionManifest{}, err }
+	cache := currentCache()
+
+	versionData, _, err := cache.readMetadata(url)
+	if err != nil || sha1 == "" || checkSha1(versionData, sha1) != nil {
+		versionData, err = cache.fetchMetadata(ctx, url)
+		if err != nil { return MojangVersionManifest{}, err }
+	}
 
-	defer versionJson.Body.Close()
+	if sha1 != "" {
+		if err := checkSha1(versionData, sha1); err != nil { return MojangVersionManifest{}, fmt.Errorf("%s: %w", url, err) }
+	}
 
-	versionData, err := io.ReadAll(versionJson.Body)
 	err = json.Unmarshal(versionData, &result)
 	if err != nil { return MojangVersionManifest{}, err }
 
@@ -100,32 +100,8 @@ func GetVersionInfo(url string) (MojangVersionManifest, error) {
 }
 
 func DownloadVanillaServer(path string, version string) error {
-	manifest := MojangVersionsManifest{}
-	err := manifest.Populate(DEFAULT_VERSION_MANIFEST_URL)
-	if err != nil { return err }
-
-	versionUrl, err := GetVersionUrl(version, manifest)
-	if err != nil { return err }
-
-	versionInfo, err := GetVersionInfo(versionUrl)
-	if err != nil {return err}
-
-	serverUrl := versionInfo.Downloads.Server.Url
-
-	out, err := os.Create(fmt.Sprintf("%sserver.jar", path))
-	if err != nil {return err}
-
-	defer out.Close()
-
-	response, err := http.Get(serverUrl)
-	if err != nil {return err}
-
-	defer response.Body.Close()
-
-	_, err = io.Copy(out, response.Body)
-	if err != nil {return err}
-
-	return nil
+	_, err := Providers()[Vanilla].Install(context.Background(), version, "", path, "server.jar", nil)
+	return err
 }
 
 func CheckFolderStructure() error {
@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -32,11 +33,13 @@ func CheckChecksum(filepath string, sha256Hash string) error {
 	return nil
 }
 func TestDownloadVanillaServer(t *testing.T) {
-	err := DownloadVanillaServer("./test/", "1.21.10")
+	configureFakeAPIs(t)
+	directory := t.TempDir()
+	err := DownloadVanillaServer(directory, "1.21.10")
 	if err != nil {
 		t.Fatal(err)
 	}
-	ans := CheckChecksum("./test/server.jar", "5bb64dc47379903e8f288bd6a4b276e889075c5c0f4c0b714e958d835c1874e7")
+	ans := CheckChecksum(filepath.Join(directory, "server.jar"), fakeJarSha256)
 	if ans != nil {
 		t.Errorf("Downloaded server does not match reference hash")
 	}
@@ -0,0 +1,90 @@
+package filesdownload
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// InstallServer downloads a build of a server distribution into an
+// instance and records what was installed and the Java version it needs.
+// When the instance is pinned to a Java runtime that is too old, a
+// compatible one is picked. progress may be nil.
+func InstallServer(ctx context.Context, instanceID string, serverType ServerType, version string, build string, progress ProgressFunc) (InstallResult, error) {
+	provider, err := GetProvider(serverType)
+	if err != nil {
+		return InstallResult{}, err
+	}
+	mc, err := backend.Instances.Get(instanceID)
+	if err != nil {
+		return InstallResult{}, err
+	}
+	if mc.IsActive() {
+		return InstallResult{}, fmt.Errorf("instance %s is running, stop it first", instanceID)
+	}
+	config := mc.Config()
+
+	jarName := config.ServerJarName
+	if jarName == FABRIC_LAUNCHER_JAR && serverType != Fabric {
+		// Leaving Fabric, its launcher name would be misleading.
+		jarName = backend.SavedAppConfig.MinecraftServerConfig.ServerJarName
+	}
+	if jarName == "" {
+		jarName = "server.jar"
+	}
+
+	result, err := provider.Install(ctx, version, build, config.Directory, jarName, progress)
+	if err != nil {
+		return InstallResult{}, err
+	}
+	required := result.JavaMajor
+
+	javaPath := config.Launch.JavaPath
+	if javaPath != "" && required > 0 {
+		current, err := backend.JavaRuntimes.Probe(javaPath)
+		if err != nil || current.Major < required {
+			if compatible, err := backend.JavaRuntimes.Select(required); err == nil {
+				fmt.Printf("\nSwitching instance %s from %s to Java %d at %s", instanceID, javaPath, compatible.Major, compatible.Path)
+				javaPath = compatible.Path
+			}
+		}
+	}
+
+	err = backend.Instances.Update(instanceID, func(config *backend.InstanceConfig) error {
+		config.ServerType = string(result.Provider)
+		config.ServerBuild = result.Build
+		config.ServerJarName = result.JarName
+		config.MinecraftVersion = result.Version
+		config.RequiredJavaMajor = required
+		config.Launch.JavaPath = javaPath
+		return nil
+	})
+	return result, err
+}
+
+// InstallServerHandler starts the install as a download job, its progress
+// is on GET /downloads and /downloads/ws.
+func InstallServerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+
+	serverType := ServerType(r.FormValue("provider"))
+	job, err := DownloadJobs.Start(r.FormValue("instance"), serverType, r.FormValue("version"), r.FormValue("build"))
+	if err != nil {
+		backend.HtmlDetailedError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": fmt.Sprintf("Downloading %s %s", job.Provider, job.Version),
+		"job":     strconv.Itoa(job.ID),
+	})
+}
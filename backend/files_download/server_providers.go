@@ -0,0 +1,177 @@
+package filesdownload
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+const DEFAULT_PAPER_API_URL = "https://api.papermc.io/v2"
+const DEFAULT_FABRIC_META_URL = "https://meta.fabricmc.net/v2"
+
+// ServerVersion is a Minecraft version a provider can install.
+type ServerVersion struct {
+	Id string `json:"id"`
+	// "release" or "snapshot", vanilla also has "old_beta" and "old_alpha".
+	Type        string    `json:"type"`
+	ReleaseTime time.Time `json:"release_time,omitempty"`
+	// Newest version of its type.
+	Latest bool `json:"latest"`
+	// Filled by ListServerVersions, 0 when unknown.
+	JavaMajor int `json:"java_major,omitempty"`
+}
+
+// ServerBuild is one build of a provider for a Minecraft version: a Paper
+// build number, a Fabric loader version. Vanilla has a single build named
+// after the version.
+type ServerBuild struct {
+	Id     string    `json:"id"`
+	Stable bool      `json:"stable"`
+	Time   time.Time `json:"time,omitempty"`
+}
+
+// ServerDownload is where the server jar of a build comes from.
+type ServerDownload struct {
+	Version  string
+	Build    string
+	Url      string
+	FileName string
+	// Checked after the download when known, empty or 0 otherwise.
+	Sha1   string
+	Sha256 string
+	Size   int64
+	// 0 when the provider doesn't say.
+	JavaMajor int
+}
+
+// InstallResult describes what Install put in the instance directory.
+type InstallResult struct {
+	Provider  ServerType
+	Version   string
+	Build     string
+	JarName   string
+	JavaMajor int
+}
+
+// ServerProvider is a distribution of the Minecraft server. Versions and
+// builds are listed newest first, an empty build means the latest stable.
+type ServerProvider interface {
+	Type() ServerType
+	ListVersions(ctx context.Context) ([]ServerVersion, error)
+	ListBuilds(ctx context.Context, version string) ([]ServerBuild, error)
+	ResolveDownload(ctx context.Context, version string, build string) (ServerDownload, error)
+	// Install downloads the server into directory as jarName, unless the
+	// provider needs its own name, and returns what was installed.
+	// progress may be nil.
+	Install(ctx context.Context, version string, build string, directory string, jarName string, progress ProgressFunc) (InstallResult, error)
+}
+
+// Providers returns every available provider, using the API base URLs of
+// the app settings.
+func Providers() map[ServerType]ServerProvider {
+	urls := backend.SavedAppConfig.DownloadConfig
+	if urls.VanillaManifestUrl == "" {
+		urls.VanillaManifestUrl = DEFAULT_VERSION_MANIFEST_URL
+	}
+	if urls.PaperApiUrl == "" {
+		urls.PaperApiUrl = DEFAULT_PAPER_API_URL
+	}
+	if urls.FabricMetaUrl == "" {
+		urls.FabricMetaUrl = DEFAULT_FABRIC_META_URL
+	}
+
+	vanilla := NewVanillaProvider(urls.VanillaManifestUrl)
+	return map[ServerType]ServerProvider{
+		Vanilla: vanilla,
+		Paper:   NewPaperProvider(urls.PaperApiUrl, Paper, vanilla),
+		Folia:   NewPaperProvider(urls.PaperApiUrl, Folia, vanilla),
+		Fabric:  NewFabricProvider(urls.FabricMetaUrl, vanilla),
+	}
+}
+
+// GetProvider returns the provider of a server type, vanilla when empty.
+func GetProvider(serverType ServerType) (ServerProvider, error) {
+	if serverType == "" {
+		serverType = Vanilla
+	}
+	provider, ok := Providers()[serverType]
+	if !ok {
+		return nil, fmt.Errorf("Unknown server type %s", serverType)
+	}
+	return provider, nil
+}
+
+// getJSON fetches and decodes an API response through the download cache,
+// giving up after metadataTimeout.
+func getJSON(ctx context.Context, url string, result interface{}) error {
+	body, err := currentCache().fetchMetadata(ctx, url)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("%s: %w", url, err)
+	}
+	return nil
+}
+
+// installDownload resolves a build of provider and links it into directory
+// from the download cache, downloading it first when it isn't cached.
+func installDownload(ctx context.Context, provider ServerProvider, version string, build string, directory string, jarName string, progress ProgressFunc) (InstallResult, error) {
+	download, err := provider.ResolveDownload(ctx, version, build)
+	if err != nil {
+		return InstallResult{}, err
+	}
+	cached, err := currentCache().jar(ctx, provider.Type(), download, progress)
+	if err != nil {
+		return InstallResult{}, err
+	}
+	if err := linkFile(cached, filepath.Join(directory, jarName)); err != nil {
+		return InstallResult{}, err
+	}
+	return InstallResult{
+		Provider:  provider.Type(),
+		Version:   download.Version,
+		Build:     download.Build,
+		JarName:   jarName,
+		JavaMajor: download.JavaMajor,
+	}, nil
+}
+
+var releaseVersion = regexp.MustCompile(`^\d+\.\d+(\.\d+)?$`)
+
+// versionType tells releases from snapshots, pre-releases and release
+// candidates for providers that only give the version name.
+func versionType(version string) string {
+	if releaseVersion.MatchString(version) {
+		return "release"
+	}
+	return "snapshot"
+}
+
+func latestStableBuild(builds []ServerBuild) (ServerBuild, error) {
+	if len(builds) == 0 {
+		return ServerBuild{}, fmt.Errorf("no builds available")
+	}
+	for _, build := range builds {
+		if build.Stable {
+			return build, nil
+		}
+	}
+	return builds[0], nil
+}
+
+func findBuild(builds []ServerBuild, id string) (ServerBuild, error) {
+	if id == "" {
+		return latestStableBuild(builds)
+	}
+	for _, build := range builds {
+		if build.Id == id {
+			return build, nil
+		}
+	}
+	return ServerBuild{}, fmt.Errorf("Build %s is nowhere to be found.", id)
+}
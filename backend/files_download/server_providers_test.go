@@ -0,0 +1,156 @@
+package filesdownload
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func versionIds(versions []ServerVersion) []string {
+	ids := []string{}
+	for _, version := range versions {
+		ids = append(ids, version.Id+":"+version.Type)
+	}
+	return ids
+}
+
+func buildIds(builds []ServerBuild) []string {
+	ids := []string{}
+	for _, build := range builds {
+		ids = append(ids, build.Id)
+	}
+	return ids
+}
+
+func TestProviderVersions(t *testing.T) {
+	providers := fakeProviders(t)
+
+	expected := map[ServerType][]string{
+		Vanilla: {"25w41a:snapshot", "1.21.10:release", "1.20.4:release", "1.16.5:release"},
+		Paper:   {"1.21.10:release", "1.21.10-pre1:snapshot", "1.20.4:release"},
+		Fabric:  {"25w41a:snapshot", "1.21.10:release"},
+	}
+	for serverType, ids := range expected {
+		versions, err := providers[serverType].ListVersions(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %v", serverType, err)
+		}
+		if serverType == Vanilla {
+			// Drop the broken versions used by the verification tests.
+			versions = versions[:len(ids)]
+		}
+		if !reflect.DeepEqual(versionIds(versions), ids) {
+			t.Errorf("%s versions = %v, expected %v", serverType, versionIds(versions), ids)
+		}
+	}
+}
+
+func TestProviderBuilds(t *testing.T) {
+	providers := fakeProviders(t)
+
+	expected := map[ServerType][]string{
+		Vanilla: {"1.21.10"},
+		Paper:   {"102", "101", "100"},
+		Fabric:  {"0.17.3-beta", "0.17.2"},
+	}
+	for serverType, ids := range expected {
+		builds, err := providers[serverType].ListBuilds(context.Background(), "1.21.10")
+		if err != nil {
+			t.Fatalf("%s: %v", serverType, err)
+		}
+		if !reflect.DeepEqual(buildIds(builds), ids) {
+			t.Errorf("%s builds = %v, expected %v", serverType, buildIds(builds), ids)
+		}
+	}
+
+	if _, err := providers[Fabric].ListBuilds(context.Background(), "1.0"); err == nil {
+		t.Error("Fabric should refuse versions without loaders")
+	}
+}
+
+func TestProviderResolveDownload(t *testing.T) {
+	providers := fakeProviders(t)
+
+	cases := []struct {
+		serverType ServerType
+		build      string
+		expected   ServerDownload
+	}{
+		{Vanilla, "", ServerDownload{Version: "1.20.4", Build: "1.20.4", FileName: "server.jar", Sha1: fakeJarSha1, Size: int64(len(fakeJar)), JavaMajor: 17}},
+		// The latest build is experimental, the latest stable is picked.
+		{Paper, "", ServerDownload{Version: "1.20.4", Build: "101", FileName: "paper-1.20.4-101.jar", Sha256: fakeJarSha256, JavaMajor: 17}},
+		{Folia, "102", ServerDownload{Version: "1.20.4", Build: "102", FileName: "folia-1.20.4-102.jar", Sha256: fakeJarSha256, JavaMajor: 17}},
+		{Fabric, "", ServerDownload{Version: "1.20.4", Build: "0.17.2", FileName: FABRIC_LAUNCHER_JAR, JavaMajor: 17}},
+	}
+	for _, c := range cases {
+		download, err := providers[c.serverType].ResolveDownload(context.Background(), "1.20.4", c.build)
+		if err != nil {
+			t.Fatalf("%s: %v", c.serverType, err)
+		}
+		if download.Url == "" {
+			t.Errorf("%s: no download url", c.serverType)
+		}
+		download.Url = ""
+		if download != c.expected {
+			t.Errorf("%s: got %+v, expected %+v", c.serverType, download, c.expected)
+		}
+	}
+
+	if _, err := providers[Paper].ResolveDownload(context.Background(), "1.20.4", "99"); err == nil {
+		t.Error("unknown Paper build should fail")
+	}
+	if _, err := providers[Vanilla].ResolveDownload(context.Background(), "0.0.1", ""); err == nil {
+		t.Error("unknown vanilla version should fail")
+	}
+}
+
+func TestProviderInstall(t *testing.T) {
+	providers := fakeProviders(t)
+
+	for serverType, expectedJar := range map[ServerType]string{Vanilla: "server.jar", Paper: "server.jar", Fabric: FABRIC_LAUNCHER_JAR} {
+		directory := t.TempDir()
+		result, err := providers[serverType].Install(context.Background(), "1.21.10", "", directory, "server.jar", nil)
+		if err != nil {
+			t.Fatalf("%s: %v", serverType, err)
+		}
+		if result.Provider != serverType || result.Version != "1.21.10" || result.JarName != expectedJar || result.JavaMajor != 21 {
+			t.Errorf("%s: unexpected result %+v", serverType, result)
+		}
+
+		content, err := os.ReadFile(filepath.Join(directory, expectedJar))
+		if err != nil {
+			t.Fatalf("%s: %v", serverType, err)
+		}
+		if !bytes.Equal(content, fakeJar) {
+			t.Errorf("%s: unexpected jar content", serverType)
+		}
+	}
+}
+
+func TestInstallRejectsCorruptDownloads(t *testing.T) {
+	providers := fakeProviders(t)
+
+	for _, version := range []string{"tampered", "truncated", "bad-json"} {
+		directory := t.TempDir()
+		jar := filepath.Join(directory, "server.jar")
+		if err := os.WriteFile(jar, []byte("working jar"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := providers[Vanilla].Install(context.Background(), version, "", directory, "server.jar", nil); err == nil {
+			t.Errorf("%s: install should fail", version)
+		}
+
+		content, err := os.ReadFile(jar)
+		if err != nil || string(content) != "working jar" {
+			t.Errorf("%s: the working jar was replaced", version)
+		}
+		entries, _ := os.ReadDir(directory)
+		if len(entries) != 1 {
+			t.Errorf("%s: temporary files left behind: %v", version, entries)
+		}
+	}
+}
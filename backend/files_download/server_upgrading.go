@@ -0,0 +1,390 @@
+package filesdownload
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Upgrade snapshots are kept in this folder of the instance directory.
+const UPGRADE_BACKUPS_DIR = "upgrade_backups"
+
+const (
+	// How long the upgraded server has to print its "Done" line.
+	DEFAULT_UPGRADE_TIMEOUT = 5 * time.Minute
+	// Older upgrade snapshots are removed.
+	upgradeBackupsKept = 3
+)
+
+// UpgradeOptions is the server an instance is moved to. An empty Provider
+// keeps the current one.
+type UpgradeOptions struct {
+	Provider ServerType
+	Version  string
+	Build    string
+	// Allow going back to an older Minecraft version.
+	Force bool
+	// Zero means DEFAULT_UPGRADE_TIMEOUT.
+	Timeout time.Duration
+}
+
+// RollbackError is returned when the upgraded server didn't come up and
+// the previous one was put back.
+type RollbackError struct {
+	Cause error
+	// Version running again.
+	Version string
+}
+
+func (e *RollbackError) Error() string {
+	return fmt.Sprintf("%v, rolled back to %s", e.Cause, e.Version)
+}
+
+func (e *RollbackError) Unwrap() error {
+	return e.Cause
+}
+
+// RollbackFailedError is returned when the upgraded server didn't come up
+// and the previous one couldn't be put back either.
+type RollbackFailedError struct {
+	Cause    error
+	Rollback error
+	// Where the worlds and jar of the previous server are kept.
+	Snapshot string
+}
+
+func (e *RollbackFailedError) Error() string {
+	return fmt.Sprintf("%v, and the rollback failed: %v, the snapshot is in %s", e.Cause, e.Rollback, e.Snapshot)
+}
+
+func (e *RollbackFailedError) Unwrap() error {
+	return e.Rollback
+}
+
+// upgradeSnapshot is a copy of the worlds and the jar of an instance taken
+// before an upgrade.
+type upgradeSnapshot struct {
+	Directory string                 `json:"-"`
+	Config    backend.InstanceConfig `json:"config"`
+	Worlds    []string               `json:"worlds"`
+	Time      time.Time              `json:"time"`
+}
+
+// UpgradeServer moves an instance to another server version: it stops the
+// instance, snapshots its worlds and jar, installs the new server, starts
+// it and waits for its "Done" line. When the server crashes or doesn't get
+// there within the timeout, the snapshot is restored. An instance that
+// was stopped is stopped again once the upgrade is verified. It fails with
+// backend.ErrInstanceBusy while the instance is backed up or restored.
+// step is told what is going on and may be nil, like progress.
+func UpgradeServer(ctx context.Context, instanceID string, options UpgradeOptions, step func(string), progress ProgressFunc) (InstallResult, error) {
+	if step == nil {
+		step = func(string) {}
+	}
+	mc, err := backend.Instances.Get(instanceID)
+	if err != nil {
+		return InstallResult{}, err
+	}
+	config := mc.Config()
+	if options.Provider == "" {
+		options.Provider = ServerType(config.ServerType)
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DEFAULT_UPGRADE_TIMEOUT
+	}
+	provider, err := GetProvider(options.Provider)
+	if err != nil {
+		return InstallResult{}, err
+	}
+	// Backups and restores would race with the snapshot and the rollback.
+	if !backend.LockInstance(instanceID) {
+		return InstallResult{}, backend.ErrInstanceBusy
+	}
+	defer backend.UnlockInstance(instanceID)
+
+	if !options.Force {
+		step("checking")
+		older, err := isOlderVersion(ctx, provider, options.Version, config.MinecraftVersion)
+		if err != nil {
+			return InstallResult{}, err
+		}
+		if older {
+			return InstallResult{}, fmt.Errorf("%s is older than %s, downgrading can corrupt the world, force it to do it anyway", options.Version, config.MinecraftVersion)
+		}
+	}
+
+	wasRunning := mc.State().IsAlive()
+	if wasRunning {
+		step("stopping")
+		if err := mc.StopAndWait(); err != nil {
+			return InstallResult{}, err
+		}
+	}
+
+	step("snapshot")
+	snapshot, err := takeUpgradeSnapshot(mc.Config())
+	if err != nil {
+		return InstallResult{}, fmt.Errorf("snapshot before upgrade: %w", err)
+	}
+
+	step("downloading")
+	result, err := InstallServer(ctx, instanceID, options.Provider, options.Version, options.Build, progress)
+	if err != nil {
+		// Nothing was replaced, the old server is still there.
+		if wasRunning {
+			mc.Start()
+		}
+		return InstallResult{}, err
+	}
+
+	step("starting")
+	err = verifyStart(ctx, mc, options.Timeout)
+	if err == nil {
+		if !wasRunning {
+			step("stopping")
+			mc.StopAndWait()
+		}
+		fmt.Printf("\nInstance %s upgraded to %s %s build %s", instanceID, result.Provider, result.Version, result.Build)
+		return result, nil
+	}
+
+	step("rolling back")
+	fmt.Printf("\nUpgrade of instance %s to %s failed, rolling back: %v", instanceID, result.Version, err)
+	if rollbackErr := rollbackUpgrade(mc, snapshot); rollbackErr != nil {
+		return InstallResult{}, &RollbackFailedError{Cause: err, Rollback: rollbackErr, Snapshot: snapshot.Directory}
+	}
+	if wasRunning {
+		mc.Start()
+	}
+	return InstallResult{}, &RollbackError{Cause: err, Version: snapshot.Config.MinecraftVersion}
+}
+
+// isOlderVersion compares Minecraft versions by their position in the
+// vanilla manifest, which has them all, then in the provider's list.
+// Versions neither knows can't be compared and aren't older.
+func isOlderVersion(ctx context.Context, provider ServerProvider, version string, than string) (bool, error) {
+	if than == "" || version == than {
+		return false, nil
+	}
+	vanilla := Providers()[Vanilla]
+	for _, lister := range []ServerProvider{vanilla, provider} {
+		versions, err := lister.ListVersions(ctx)
+		if err != nil {
+			return false, err
+		}
+		sort.SliceStable(versions, func(i, j int) bool {
+			return versions[i].ReleaseTime.After(versions[j].ReleaseTime)
+		})
+
+		position := map[string]int{}
+		for i, listed := range versions {
+			position[listed.Id] = i
+		}
+		versionPosition, found := position[version]
+		thanPosition, thanFound := position[than]
+		if found && thanFound {
+			// Newest first.
+			return versionPosition > thanPosition, nil
+		}
+	}
+	return false, nil
+}
+
+// verifyStart starts the server and waits for it to be running, or for
+// ctx to be cancelled.
+func verifyStart(ctx context.Context, mc *backend.McServer, timeout time.Duration) error {
+	if err := mc.Start(); err != nil {
+		return err
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	state, err := mc.WaitState(waitCtx, backend.StateRunning, backend.StateCrashed, backend.StateStopped, backend.StateRestarting, backend.StateCrashLoop)
+	switch {
+	case err != nil && ctx.Err() != nil:
+		return ctx.Err()
+	case err != nil:
+		return fmt.Errorf("server not ready after %s", timeout)
+	case state != backend.StateRunning:
+		return fmt.Errorf("server %s while starting", state)
+	}
+	return nil
+}
+
+func takeUpgradeSnapshot(config backend.InstanceConfig) (upgradeSnapshot, error) {
+	snapshot := upgradeSnapshot{
+		Config: config,
+		Worlds: backend.WorldDirectories(config.Directory),
+		Time:   time.Now(),
+	}
+	from := config.MinecraftVersion
+	if from == "" {
+		from = "unknown"
+	}
+	snapshot.Directory = filepath.Join(config.Directory, UPGRADE_BACKUPS_DIR, snapshot.Time.Format("20060102-150405")+"-"+pathName(from))
+	if err := os.MkdirAll(snapshot.Directory, 0755); err != nil {
+		return snapshot, err
+	}
+
+	for _, world := range snapshot.Worlds {
+		if err := copyTree(filepath.Join(config.Directory, world), filepath.Join(snapshot.Directory, world)); err != nil {
+			os.RemoveAll(snapshot.Directory)
+			return snapshot, err
+		}
+	}
+	jar := filepath.Join(config.Directory, config.ServerJarName)
+	if _, err := os.Stat(jar); err == nil {
+		if err := linkFile(jar, filepath.Join(snapshot.Directory, config.ServerJarName)); err != nil {
+			os.RemoveAll(snapshot.Directory)
+			return snapshot, err
+		}
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return snapshot, err
+	}
+	if err := os.WriteFile(filepath.Join(snapshot.Directory, "upgrade.json"), data, 0644); err != nil {
+		return snapshot, err
+	}
+
+	pruneUpgradeSnapshots(filepath.Dir(snapshot.Directory))
+	return snapshot, nil
+}
+
+// pruneUpgradeSnapshots keeps the newest upgradeBackupsKept snapshots, their
+// names start with the time they were taken.
+func pruneUpgradeSnapshots(directory string) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return
+	}
+	for i := 0; i < len(entries)-upgradeBackupsKept; i++ {
+		os.RemoveAll(filepath.Join(directory, entries[i].Name()))
+	}
+}
+
+// rollbackUpgrade stops whatever is left of the upgraded server and puts
+// back the worlds, the jar and the server settings of snapshot.
+func rollbackUpgrade(mc *backend.McServer, snapshot upgradeSnapshot) error {
+	if mc.State().IsAlive() {
+		if err := mc.StopAndWait(); err != nil {
+			return err
+		}
+	} else if state := mc.State(); state == backend.StateRestarting || state == backend.StateCrashLoop {
+		// Cancels the automatic restart of the crashed server.
+		mc.Stop()
+	}
+
+	config := snapshot.Config
+	// The new server may have created worlds that didn't exist before.
+	for _, world := range backend.WorldDirectories(config.Directory) {
+		if err := os.RemoveAll(filepath.Join(config.Directory, world)); err != nil {
+			return err
+		}
+	}
+	for _, world := range snapshot.Worlds {
+		if err := copyTree(filepath.Join(snapshot.Directory, world), filepath.Join(config.Directory, world)); err != nil {
+			return err
+		}
+	}
+	jar := filepath.Join(snapshot.Directory, config.ServerJarName)
+	if _, err := os.Stat(jar); err == nil {
+		if err := linkFile(jar, filepath.Join(config.Directory, config.ServerJarName)); err != nil {
+			return err
+		}
+	}
+
+	return backend.Instances.Update(config.ID, func(current *backend.InstanceConfig) error {
+		current.ServerType = config.ServerType
+		current.ServerBuild = config.ServerBuild
+		current.ServerJarName = config.ServerJarName
+		current.MinecraftVersion = config.MinecraftVersion
+		current.RequiredJavaMajor = config.RequiredJavaMajor
+		current.Launch.JavaPath = config.Launch.JavaPath
+		return nil
+	})
+}
+
+// copyTree copies a directory recursively, keeping file modes.
+func copyTree(source string, destination string) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(destination, relative)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode().IsRegular():
+			in, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, in); err != nil {
+				out.Close()
+				return err
+			}
+			return out.Close()
+		}
+		// Symlinks and special files aren't part of a world.
+		return nil
+	})
+}
+
+// UpgradeServerHandler starts an upgrade job. Form values: instance,
+// version, build, provider (the current one when empty), force=true to
+// allow downgrades and timeout in seconds.
+func UpgradeServerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+
+	options := UpgradeOptions{
+		Provider: ServerType(r.FormValue("provider")),
+		Version:  r.FormValue("version"),
+		Build:    r.FormValue("build"),
+		Force:    r.FormValue("force") == "true",
+	}
+	if value := r.FormValue("timeout"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			backend.HtmlDetailedError(w, fmt.Errorf("timeout should be a number of seconds"))
+			return
+		}
+		options.Timeout = time.Duration(seconds) * time.Second
+	}
+
+	job, err := DownloadJobs.StartUpgrade(r.FormValue("instance"), options)
+	if err != nil {
+		backend.HtmlDetailedError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": fmt.Sprintf("Upgrading to %s %s", job.Provider, job.Version),
+		"job":     strconv.Itoa(job.ID),
+	})
+}
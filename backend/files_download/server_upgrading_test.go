@@ -0,0 +1,164 @@
+package filesdownload
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeJavaScript stands in for java: it runs the jar given after -jar by
+// printing the "Done" line and waiting for "stop", unless the jar is
+// crashingJar, which damages the world and exits with an error.
+const fakeJavaScript = `#!/bin/sh
+if [ "$1" = "-version" ]; then
+	echo 'openjdk version "21.0.4" 2024-07-16' >&2
+	exit 0
+fi
+while [ "$#" -gt 0 ] && [ "$1" != "-jar" ]; do shift; done
+if grep -q "crashes on start" "$2"; then
+	echo "damaged by the new version" > world/level.dat
+	echo "[12:00:00] [Server thread/ERROR]: Encountered an unexpected exception"
+	exit 1
+fi
+echo '[12:00:00] [Server thread/INFO]: Done (1.234s)! For help, type "help"'
+while read line; do
+	if [ "$line" = "stop" ]; then
+		exit 0
+	fi
+done
+`
+
+// upgradeInstance creates a stopped instance running fakeJavaScript with
+// Minecraft 1.20.4 installed and a world.
+func upgradeInstance(t *testing.T, id string) string {
+	t.Chdir(t.TempDir())
+	configureFakeAPIs(t)
+
+	java := filepath.Join(t.TempDir(), "java")
+	if err := os.WriteFile(java, []byte(fakeJavaScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	directory := t.TempDir()
+	config := backend.InstanceConfig{ID: id, Directory: directory, ServerJarName: "server.jar", MinAllowedRam: "512M", MaxAllowedRam: "512M"}
+	config.Launch.JavaPath = java
+	if _, err := backend.Instances.Create(config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Instances.Delete(id) })
+
+	if _, err := InstallServer(context.Background(), id, Vanilla, "1.20.4", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(directory, "world"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(directory, "world", "level.dat"), []byte("1.20.4 world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return directory
+}
+
+func instanceVersion(t *testing.T, id string) string {
+	mc, err := backend.Instances.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mc.Config().MinecraftVersion
+}
+
+func TestUpgradeServer(t *testing.T) {
+	directory := upgradeInstance(t, "upgrade")
+	steps := []string{}
+	result, err := UpgradeServer(context.Background(), "upgrade", UpgradeOptions{Version: "1.21.10", Timeout: 10 * time.Second}, func(step string) {
+		steps = append(steps, step)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Version != "1.21.10" || instanceVersion(t, "upgrade") != "1.21.10" {
+		t.Errorf("upgraded to %+v, instance on %s", result, instanceVersion(t, "upgrade"))
+	}
+	// The instance was stopped, it is stopped again once verified.
+	if expected := "checking snapshot downloading starting stopping"; strings.Join(steps, " ") != expected {
+		t.Errorf("steps %v, expected %s", steps, expected)
+	}
+	mc, _ := backend.Instances.Get("upgrade")
+	if state := mc.State(); state != backend.StateStopped {
+		t.Errorf("instance is %s after the upgrade", state)
+	}
+
+	snapshots, _ := filepath.Glob(filepath.Join(directory, UPGRADE_BACKUPS_DIR, "*-1.20.4", "world", "level.dat"))
+	if len(snapshots) != 1 {
+		t.Errorf("expected a snapshot of the 1.20.4 world, got %v", snapshots)
+	}
+
+	_, err = UpgradeServer(context.Background(), "upgrade", UpgradeOptions{Version: "1.20.4"}, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "older") {
+		t.Errorf("a downgrade should be refused, got %v", err)
+	}
+	if instanceVersion(t, "upgrade") != "1.21.10" {
+		t.Error("the refused downgrade changed the instance")
+	}
+
+	// A backup of the instance is running.
+	if !backend.LockInstance("upgrade") {
+		t.Fatal("the upgrade left the instance busy")
+	}
+	_, err = UpgradeServer(context.Background(), "upgrade", UpgradeOptions{Version: "1.21.10", Force: true}, nil, nil)
+	backend.UnlockInstance("upgrade")
+	if !errors.Is(err, backend.ErrInstanceBusy) {
+		t.Errorf("upgrading a busy instance got %v", err)
+	}
+}
+
+func TestVerifyStartCancelled(t *testing.T) {
+	upgradeInstance(t, "upgrade-cancelled")
+	mc, _ := backend.Instances.Get("upgrade-cancelled")
+	t.Cleanup(func() { mc.StopAndWait() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := verifyStart(ctx, mc, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("a cancelled verification got %v", err)
+	}
+}
+
+func TestUpgradeRollsBack(t *testing.T) {
+	directory := upgradeInstance(t, "upgrade-rollback")
+	mc, _ := backend.Instances.Get("upgrade-rollback")
+	if err := mc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := mc.WaitState(ctx, backend.StateRunning); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := UpgradeServer(context.Background(), "upgrade-rollback", UpgradeOptions{Version: "crashes", Timeout: 10 * time.Second}, nil, nil)
+	var rollback *RollbackError
+	if !errors.As(err, &rollback) || rollback.Version != "1.20.4" {
+		t.Fatalf("expected a rollback to 1.20.4, got %v", err)
+	}
+
+	if world, _ := os.ReadFile(filepath.Join(directory, "world", "level.dat")); string(world) != "1.20.4 world" {
+		t.Errorf("world not restored: %q", world)
+	}
+	if jar, _ := os.ReadFile(filepath.Join(directory, "server.jar")); string(jar) != string(fakeJar) {
+		t.Errorf("jar not restored: %q", jar)
+	}
+	if instanceVersion(t, "upgrade-rollback") != "1.20.4" {
+		t.Errorf("instance on %s after the rollback", instanceVersion(t, "upgrade-rollback"))
+	}
+
+	// It was running before, the old version is started again.
+	if _, err := mc.WaitState(ctx, backend.StateRunning); err != nil {
+		t.Errorf("the old server didn't come back: %v", err)
+	}
+	mc.StopAndWait()
+}
@@ -0,0 +1,98 @@
+package filesdownload
+
+import (
+	"Skyfield1888/WebMine/backend"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ListServerVersions returns the versions of a provider, newest first,
+// keeping only the given types when there are any. The newest release and
+// snapshot are marked Latest, and the versions have the Java version
+// Mojang requires for them, the newest ones first when their version files
+// aren't cached yet, see JavaMajors.
+func ListServerVersions(ctx context.Context, serverType ServerType, types []string) ([]ServerVersion, error) {
+	provider, err := GetProvider(serverType)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := provider.ListVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Providers other than vanilla don't say which versions are the latest.
+	if provider.Type() != Vanilla {
+		marked := map[string]bool{}
+		for i := range versions {
+			if !marked[versions[i].Type] {
+				versions[i].Latest = true
+				marked[versions[i].Type] = true
+			}
+		}
+	}
+
+	if len(types) > 0 {
+		filtered := []ServerVersion{}
+		for _, version := range versions {
+			for _, versionType := range types {
+				if version.Type == versionType {
+					filtered = append(filtered, version)
+					break
+				}
+			}
+		}
+		versions = filtered
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].ReleaseTime.After(versions[j].ReleaseTime)
+	})
+
+	ids := make([]string, 0, len(versions))
+	for _, version := range versions {
+		ids = append(ids, version.Id)
+	}
+	majors, err := Providers()[Vanilla].(*VanillaProvider).JavaMajors(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range versions {
+		versions[i].JavaMajor = majors[versions[i].Id]
+	}
+	return versions, nil
+}
+
+// VersionsHandler lists the versions of ?provider= (vanilla by default),
+// ?type= keeps only some types, repeated or separated by commas.
+func VersionsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	types := []string{}
+	for _, value := range query["type"] {
+		for _, versionType := range strings.Split(value, ",") {
+			if versionType = strings.TrimSpace(versionType); versionType != "" {
+				types = append(types, versionType)
+			}
+		}
+	}
+
+	versions, err := ListServerVersions(r.Context(), ServerType(query.Get("provider")), types)
+	if err != nil {
+		backend.HtmlDetailedError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// StartInstall starts downloading the latest stable build of a version
+// into an instance, see backend.ServerInstaller.
+func StartInstall(instanceID string, serverType string, version string) error {
+	_, err := DownloadJobs.Start(instanceID, ServerType(serverType), version, "")
+	return err
+}
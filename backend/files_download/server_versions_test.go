@@ -0,0 +1,73 @@
+package filesdownload
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestListServerVersions(t *testing.T) {
+	configureFakeAPIs(t)
+
+	describe := func(versions []ServerVersion) []string {
+		described := []string{}
+		for _, version := range versions {
+			described = append(described, fmt.Sprintf("%s:%s:%d:%t", version.Id, version.Type, version.JavaMajor, version.Latest))
+		}
+		return described
+	}
+
+	cases := []struct {
+		serverType ServerType
+		types      []string
+		expected   []string
+	}{
+		{Vanilla, []string{"release"}, []string{"1.21.10:release:21:true", "1.20.4:release:17:false", "1.16.5:release:8:false"}},
+		{Vanilla, []string{"snapshot", "release"}, []string{"25w41a:snapshot:21:true", "1.21.10:release:21:true", "1.20.4:release:17:false", "1.16.5:release:8:false"}},
+		// The version file of bad-json doesn't match its hash.
+		{Vanilla, []string{"old_alpha"}, []string{"crashes:old_alpha:21:false", "tampered:old_alpha:21:false", "truncated:old_alpha:21:false", "bad-json:old_alpha:0:false", "slow:old_alpha:21:false"}},
+		{Paper, nil, []string{"1.21.10:release:21:true", "1.21.10-pre1:snapshot:0:true", "1.20.4:release:17:false"}},
+		{Fabric, []string{"release"}, []string{"1.21.10:release:21:true"}},
+	}
+	for _, c := range cases {
+		versions, err := ListServerVersions(context.Background(), c.serverType, c.types)
+		if err != nil {
+			t.Fatalf("%s %v: %v", c.serverType, c.types, err)
+		}
+		if !reflect.DeepEqual(describe(versions), c.expected) {
+			t.Errorf("%s %v: got %v, expected %v", c.serverType, c.types, describe(versions), c.expected)
+		}
+	}
+
+	if _, err := ListServerVersions(context.Background(), "forge", nil); err == nil {
+		t.Error("unknown providers should fail")
+	}
+}
+
+func TestListServerVersionsLookupLimit(t *testing.T) {
+	configureFakeAPIs(t)
+	previous := javaLookupLimit
+	javaLookupLimit = 2
+	t.Cleanup(func() { javaLookupLimit = previous })
+
+	// The newest two version files are fetched, then the next with the
+	// others read from the cache.
+	majors := func() []int {
+		versions, err := ListServerVersions(context.Background(), Vanilla, []string{"release"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := []int{}
+		for _, version := range versions {
+			found = append(found, version.JavaMajor)
+		}
+		return found
+	}
+	if found := majors(); !reflect.DeepEqual(found, []int{21, 17, 0}) {
+		t.Errorf("first listing found Java %v", found)
+	}
+	if found := majors(); !reflect.DeepEqual(found, []int{21, 17, 8}) {
+		t.Errorf("second listing found Java %v", found)
+	}
+}
@@ -0,0 +1,438 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const DEFAULT_INSTANCE_ID = "default"
+
+var instanceIdPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// InstanceConfig is the persisted description of one Minecraft server
+// managed by the panel. Every instance lives in its own directory.
+type InstanceConfig struct {
+	ID                     string
+	Name                   string
+	Directory              string
+	ServerJarName          string
+	MaxAllowedRam          string
+	MinAllowedRam          string
+	OthersCommandArguments string
+	// What the installer put in Directory: the distribution ("vanilla",
+	// "paper", ...), its build, the Minecraft version and the Java major it
+	// needs. 0 means unknown and any runtime is accepted.
+	ServerType        string
+	ServerBuild       string
+	MinecraftVersion  string
+	RequiredJavaMajor int
+	Launch            LaunchSpec
+	Supervisor        SupervisorConfig
+	BackupRetention   BackupRetention
+	// Run the server under "webmine supervise" so it survives panel restarts.
+	Detached bool
+	// Give the server a pseudo-terminal instead of pipes, so it prints
+	// colors and its interactive console behaves like in a terminal.
+	Pty bool
+}
+
+type InstanceRegistry struct {
+	mu      sync.RWMutex
+	servers map[string]*McServer
+}
+
+var Instances = &InstanceRegistry{servers: make(map[string]*McServer)}
+
+// Load registers every instance found in the app settings. Installs that
+// predate instances get a "default" one pointing at PathToMcServers.
+func (reg *InstanceRegistry) Load() error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.servers = make(map[string]*McServer)
+
+	if len(SavedAppConfig.Instances) == 0 {
+		defaults := SavedAppConfig.MinecraftServerConfig
+		SavedAppConfig.Instances = []InstanceConfig{{
+			ID:                     DEFAULT_INSTANCE_ID,
+			Name:                   "Default server",
+			Directory:              defaults.PathToMcServers,
+			ServerJarName:          defaults.ServerJarName,
+			MaxAllowedRam:          defaults.MaxAllowedRam,
+			MinAllowedRam:          defaults.MinAllowedRam,
+			OthersCommandArguments: defaults.OthersCommandArguments,
+		}}
+		EncodeConfig()
+	}
+
+	for _, config := range SavedAppConfig.Instances {
+		if _, exists := reg.servers[config.ID]; exists {
+			return fmt.Errorf("duplicate instance id %s", config.ID)
+		}
+		mc := NewMcServer(config)
+		if err := mc.Reattach(); err != nil {
+			fmt.Printf("\nCould not re-attach to instance %s: %v", config.ID, err)
+		}
+		reg.servers[config.ID] = mc
+	}
+	return nil
+}
+
+func (reg *InstanceRegistry) Get(id string) (*McServer, error) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	mc, ok := reg.servers[id]
+	if !ok {
+		return nil, fmt.Errorf("instance %s does not exist", id)
+	}
+	return mc, nil
+}
+
+// List returns every instance sorted by ID.
+func (reg *InstanceRegistry) List() []*McServer {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	servers := make([]*McServer, 0, len(reg.servers))
+	for _, mc := range reg.servers {
+		servers = append(servers, mc)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].ID() < servers[j].ID()
+	})
+	return servers
+}
+
+// Create registers a new instance, filling blank fields from the
+// MinecraftServerConfig defaults, and creates its directory.
+func (reg *InstanceRegistry) Create(config InstanceConfig) (*McServer, error) {
+	if !instanceIdPattern.MatchString(config.ID) {
+		return nil, errors.New("Instance id should only contain letters, digits, '-' and '_'")
+	}
+
+	defaults := SavedAppConfig.MinecraftServerConfig
+	if config.Name == "" {
+		config.Name = config.ID
+	}
+	if config.Directory == "" {
+		config.Directory = filepath.Join(defaults.PathToMcServers, config.ID)
+	}
+	if config.ServerJarName == "" {
+		config.ServerJarName = defaults.ServerJarName
+	}
+	if config.MaxAllowedRam == "" {
+		config.MaxAllowedRam = defaults.MaxAllowedRam
+	}
+	if config.MinAllowedRam == "" {
+		config.MinAllowedRam = defaults.MinAllowedRam
+	}
+	if config.OthersCommandArguments == "" {
+		config.OthersCommandArguments = defaults.OthersCommandArguments
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if _, exists := reg.servers[config.ID]; exists {
+		return nil, fmt.Errorf("instance %s already exists", config.ID)
+	}
+
+	if err := os.MkdirAll(config.Directory, 0755); err != nil {
+		return nil, err
+	}
+
+	mc := NewMcServer(config)
+	reg.servers[config.ID] = mc
+	reg.save()
+	return mc, nil
+}
+
+// Update applies change to an instance's config and saves the registry.
+func (reg *InstanceRegistry) Update(id string, change func(config *InstanceConfig) error) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	mc, ok := reg.servers[id]
+	if !ok {
+		return fmt.Errorf("instance %s does not exist", id)
+	}
+
+	mc.mu.Lock()
+	config := mc.config
+	err := change(&config)
+	if err == nil {
+		mc.config = config
+	}
+	mc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	reg.save()
+	return nil
+}
+
+// Delete unregisters an instance. Its directory is left on disk.
+func (reg *InstanceRegistry) Delete(id string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	mc, ok := reg.servers[id]
+	if !ok {
+		return fmt.Errorf("instance %s does not exist", id)
+	}
+	if mc.IsActive() {
+		return fmt.Errorf("instance %s is still running", id)
+	}
+
+	delete(reg.servers, id)
+	reg.save()
+	return nil
+}
+
+// ErrInstanceBusy is returned when an instance is already being backed up,
+// restored or upgraded.
+var ErrInstanceBusy = errors.New("a backup, restore or upgrade of this instance is already running")
+
+// busyInstances holds the instances being backed up, restored or upgraded,
+// one at a time per instance. freed is closed, and replaced, on each
+// unlock.
+var busyInstances = struct {
+	mu    sync.Mutex
+	ids   map[string]bool
+	freed chan struct{}
+}{ids: map[string]bool{}, freed: make(chan struct{})}
+
+// LockInstance marks an instance busy, and returns false when it already
+// was.
+func LockInstance(id string) bool {
+	busyInstances.mu.Lock()
+	defer busyInstances.mu.Unlock()
+	if busyInstances.ids[id] {
+		return false
+	}
+	busyInstances.ids[id] = true
+	return true
+}
+
+// WaitLockInstance marks an instance busy once whatever holds it is done.
+func WaitLockInstance(ctx context.Context, id string) error {
+	for {
+		busyInstances.mu.Lock()
+		if !busyInstances.ids[id] {
+			busyInstances.ids[id] = true
+			busyInstances.mu.Unlock()
+			return nil
+		}
+		freed := busyInstances.freed
+		busyInstances.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-freed:
+		}
+	}
+}
+
+func UnlockInstance(id string) {
+	busyInstances.mu.Lock()
+	defer busyInstances.mu.Unlock()
+	delete(busyInstances.ids, id)
+	close(busyInstances.freed)
+	busyInstances.freed = make(chan struct{})
+}
+
+// save writes the registry back to the app settings. Callers hold reg.mu.
+func (reg *InstanceRegistry) save() {
+	configs := make([]InstanceConfig, 0, len(reg.servers))
+	for _, mc := range reg.servers {
+		configs = append(configs, mc.Config())
+	}
+	sort.Slice(configs, func(i, j int) bool {
+		return configs[i].ID < configs[j].ID
+	})
+	SavedAppConfig.Instances = configs
+	EncodeConfig()
+}
+
+// instanceFromRequest resolves the "instance" query or form value.
+func instanceFromRequest(r *http.Request) (*McServer, error) {
+	id := r.FormValue("instance")
+	if id == "" {
+		return nil, errors.New("Missing instance id")
+	}
+	return Instances.Get(id)
+}
+
+func InstancesTableHandler(w http.ResponseWriter, r *http.Request) {
+	var instancesTemplate = template.Must(template.New("instances.html").ParseFiles("./frontend/templates/instances.html"))
+
+	w.Header().Set("Content-Type", "text/html")
+
+	instances := []map[string]interface{}{}
+	for _, mc := range Instances.List() {
+		config := mc.Config()
+		instances = append(instances, map[string]interface{}{
+			"ID":        config.ID,
+			"Name":      config.Name,
+			"Directory": config.Directory,
+			"Ram":       config.MinAllowedRam + " / " + config.MaxAllowedRam,
+			"State":     mc.State(),
+			"Detached":  config.Detached,
+			"Pty":       config.Pty,
+		})
+	}
+
+	instancesTemplate.ExecuteTemplate(w, "instances.html", instances)
+}
+
+// ServerInstaller starts downloading a server into an instance. It is set
+// by main to the files_download package, which imports backend.
+var ServerInstaller func(instanceID string, serverType string, version string) error
+
+// CreateInstanceHandler creates an instance, and when a version is chosen
+// starts installing that server into it.
+func CreateInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+
+	policy := r.FormValue("restart_policy")
+	if !validRestartPolicy(policy) {
+		HtmlDetailedError(w, fmt.Errorf("Unknown restart policy %s", policy))
+		return
+	}
+
+	mc, err := Instances.Create(InstanceConfig{
+		ID:                     r.FormValue("id"),
+		Name:                   r.FormValue("name"),
+		ServerJarName:          r.FormValue("jar"),
+		MaxAllowedRam:          r.FormValue("max_ram"),
+		MinAllowedRam:          r.FormValue("min_ram"),
+		OthersCommandArguments: r.FormValue("arguments"),
+		Supervisor:             SupervisorConfig{RestartPolicy: policy},
+		Detached:               r.FormValue("detached") == "on",
+		Pty:                    r.FormValue("pty") == "on",
+	})
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	if version := r.FormValue("version"); version != "" && ServerInstaller != nil {
+		if err := ServerInstaller(mc.ID(), r.FormValue("provider"), version); err != nil {
+			HtmlDetailedError(w, err)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/instances/view", http.StatusSeeOther)
+}
+
+func DeleteInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := Instances.Delete(r.FormValue("instance")); err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/instances/view", http.StatusSeeOther)
+}
+
+func SupervisorSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+
+	err := Instances.Update(r.FormValue("instance"), func(config *InstanceConfig) error {
+		supervisor := config.Supervisor
+		if policy := r.FormValue("restart_policy"); policy != "" {
+			if !validRestartPolicy(policy) {
+				return fmt.Errorf("Unknown restart policy %s", policy)
+			}
+			supervisor.RestartPolicy = policy
+		}
+
+		fields := map[string]*int{
+			"max_restarts":         &supervisor.MaxRestarts,
+			"window_seconds":       &supervisor.WindowSeconds,
+			"backoff_seconds":      &supervisor.BackoffSeconds,
+			"max_backoff_seconds":  &supervisor.MaxBackoffSeconds,
+			"stop_timeout_seconds": &supervisor.StopTimeoutSeconds,
+			"kill_timeout_seconds": &supervisor.KillTimeoutSeconds,
+		}
+		for name, field := range fields {
+			value := r.FormValue(name)
+			if value == "" {
+				continue
+			}
+			number, err := strconv.Atoi(value)
+			if err != nil || number < 0 {
+				return fmt.Errorf("%s should be a positive integer", name)
+			}
+			*field = number
+		}
+
+		config.Supervisor = supervisor
+
+		if detached := r.FormValue("detached"); detached != "" {
+			value, err := strconv.ParseBool(detached)
+			if err != nil {
+				return errors.New("detached should be true or false")
+			}
+			config.Detached = value
+		}
+
+		if pty := r.FormValue("pty"); pty != "" {
+			value, err := strconv.ParseBool(pty)
+			if err != nil {
+				return errors.New("pty should be true or false")
+			}
+			config.Pty = value
+		}
+		return nil
+	})
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": "Supervisor settings saved",
+	})
+}
+
+func ManageInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	var managingTemplate = template.Must(template.New("server_managing.html").ParseFiles("./frontend/templates/server_managing.html"))
+
+	mc, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	managingTemplate.ExecuteTemplate(w, "server_managing.html", mc.Config())
+}
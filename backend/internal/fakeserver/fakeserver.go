@@ -0,0 +1,345 @@
+// Package fakeserver stands in for a Minecraft server in tests. A test
+// binary calls Main from its TestMain and launches itself with the
+// command returned by Command in place of java: it then prints the log
+// lines of a vanilla server, answers a few console commands and exits on
+// "stop", without a JVM or network access.
+package fakeserver
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// ENV is set in the environment of the fake server process.
+const ENV = "WEBMINE_FAKE_SERVER"
+
+// Main runs the fake server and exits when the process was started by
+// Command, and returns otherwise.
+func Main() {
+	if os.Getenv(ENV) == "" {
+		return
+	}
+	os.Exit(Run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// Command is the executable, arguments and environment variables that
+// start the running test binary as a fake server with flags:
+//
+//	-version 1.21.10  version printed on start
+//	-startup 50ms     time spent "loading the world" before the Done line
+//	-eula             refuse to start until eula.txt says eula=true
+//	-crash            print an exception and exit with 1 instead of starting
+//	-ignore-stop      hang on "stop" instead of exiting, like a stuck server
+//	-ignore-sigterm   survive SIGTERM, only SIGKILL ends it
+func Command(flags ...string) (string, []string, []string) {
+	executable, err := os.Executable()
+	if err != nil {
+		executable = os.Args[0]
+	}
+	return executable, flags, []string{ENV + "=1"}
+}
+
+// FreePort returns a port nothing listens on, network is "tcp" or "udp".
+func FreePort(t testing.TB, network string) string {
+	t.Helper()
+	var address net.Addr
+	if network == "udp" {
+		packets, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		address = packets.LocalAddr()
+		packets.Close()
+	} else {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		address = listener.Addr()
+		listener.Close()
+	}
+	_, port, _ := net.SplitHostPort(address.String())
+	return port
+}
+
+// WriteProperties writes a server.properties in directory, with the two
+// comment lines a server puts first.
+func WriteProperties(t testing.TB, directory string, properties map[string]string) {
+	t.Helper()
+	content := "#Minecraft server properties\n#Generated by the test\n"
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		content += key + "=" + properties[key] + "\n"
+	}
+	if err := os.WriteFile(filepath.Join(directory, "server.properties"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Run is the fake server itself, reading commands from stdin in the
+// working directory, and from RCON when server.properties enables it.
+// When server.properties sets server-port, it answers Server List Pings
+// on it, and queries with enable-query.
+// Besides the server commands stop, save-all, save-off, save-on, list,
+// say and whitelist add, it takes test commands that make things happen:
+//
+//	join <player>, leave <player>  a player joins or leaves
+//	sneak <player>                 a player joins without a console line
+//	warn <text>, error <text>      a WARN or ERROR line is logged
+//	lines <n>                      n lines of output, to fill RCON packets
+//	crash                          the server crashes with exit code 1
+//
+// It stops when stdin is closed, so it never outlives the test.
+func Run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("fakeserver", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	version := flags.String("version", "1.21.10", "")
+	startup := flags.Duration("startup", 0, "")
+	eula := flags.Bool("eula", false, "")
+	crash := flags.Bool("crash", false, "")
+	ignoreStop := flags.Bool("ignore-stop", false, "")
+	ignoreSigterm := flags.Bool("ignore-sigterm", false, "")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *ignoreSigterm {
+		signal.Ignore(syscall.SIGTERM)
+	}
+
+	server := &server{out: stdout, errOut: stderr, players: []string{}, rcon: make(chan rconRequest), version: *version, ignoreStop: *ignoreStop}
+	if *eula && !eulaAccepted() {
+		server.log("ServerMain", "WARN", "Failed to load eula.txt")
+		server.log("ServerMain", "INFO", "You need to agree to the EULA in order to run the server. Go to eula.txt for more info.")
+		os.WriteFile("eula.txt", []byte("#By changing the setting below to TRUE you are indicating your agreement to our EULA (https://aka.ms/MinecraftEULA).\neula=false\n"), 0644)
+		return 0
+	}
+
+	server.info("Starting minecraft server version " + *version)
+	server.info("Loading properties")
+	properties := readProperties()
+	server.info("Default game type: SURVIVAL")
+	server.info("Starting Minecraft server on *:25565")
+	if *crash {
+		server.crash()
+		return 1
+	}
+	server.log("Server thread", "WARN", "**** SERVER IS RUNNING IN OFFLINE/INSECURE MODE!")
+	server.info(`Preparing level "world"`)
+	time.Sleep(*startup)
+	if err := os.MkdirAll("world", 0755); err == nil {
+		if _, err := os.Stat(filepath.Join("world", "level.dat")); err != nil {
+			os.WriteFile(filepath.Join("world", "level.dat"), []byte("fake level "+*version), 0644)
+		}
+	}
+	server.info(fmt.Sprintf(`Done (%.3fs)! For help, type "help"`, startup.Seconds()+1.234))
+
+	server.motd = properties["motd"]
+	if server.motd == "" {
+		server.motd = "A Minecraft Server"
+	}
+	// The game port is only opened when the test chose one, so tests
+	// don't fight over 25565.
+	if port := properties["server-port"]; port != "" {
+		if err := server.listenStatus(port); err != nil {
+			server.log("Server thread", "WARN", "**** FAILED TO BIND TO PORT!")
+		}
+		if properties["enable-query"] == "true" {
+			queryPort := properties["query.port"]
+			if queryPort == "" {
+				queryPort = port
+			}
+			if err := server.listenQuery(queryPort); err != nil {
+				server.log("Server thread", "WARN", "Unable to initialise query system on 0.0.0.0:"+queryPort)
+			}
+		}
+	}
+	if properties["enable-rcon"] == "true" {
+		if err := server.listenRcon(properties["rcon.port"], properties["rcon.password"]); err != nil {
+			server.log("Server thread", "WARN", "Unable to initialise RCON on 0.0.0.0:"+properties["rcon.port"]+": "+err.Error())
+		}
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return 0
+			}
+			if exit, stop := server.execute(line, server.info); stop {
+				return exit
+			}
+		case request := <-server.rcon:
+			output := []string{}
+			exit, stop := server.execute(request.command, func(text string) { output = append(output, text) })
+			request.reply <- strings.Join(output, "\n")
+			if stop {
+				<-request.sent
+				return exit
+			}
+		}
+	}
+}
+
+// execute runs a console command, its output goes to reply. It returns
+// the exit code when the command stops the server.
+func (s *server) execute(line string, reply func(string)) (int, bool) {
+	command, argument, _ := strings.Cut(strings.TrimSpace(line), " ")
+	switch command {
+	case "stop":
+		reply("Stopping the server")
+		s.info("Stopping server")
+		if s.ignoreStop {
+			return 0, false
+		}
+		s.info("Saving players")
+		s.info("Saving worlds")
+		s.info("ThreadedAnvilChunkStorage: All dimensions are saved")
+		return 0, true
+	case "save-all":
+		reply("Saving the game (this may take a moment!)")
+		reply("Saved the game")
+	case "save-off":
+		reply("Automatic saving is now disabled")
+	case "save-on":
+		reply("Automatic saving is now enabled")
+	case "list":
+		players := s.onlinePlayers()
+		reply(fmt.Sprintf("There are %d of a max of %d players online: %s", len(players), maxPlayers, strings.Join(players, ", ")))
+	case "say":
+		s.info("[Server] " + argument)
+	case "whitelist":
+		if player, found := strings.CutPrefix(argument, "add "); found {
+			reply("Added " + player + " to the whitelist")
+		} else {
+			reply("Unknown or incomplete command, see below for error")
+		}
+	case "lines":
+		count, _ := strconv.Atoi(argument)
+		for i := 1; i <= count; i++ {
+			reply(fmt.Sprintf("line %d of %d", i, count))
+		}
+	case "join":
+		count := s.join(argument)
+		s.info(fmt.Sprintf("%s[/127.0.0.1:%d] logged in with entity id %d at (0.5, 64.0, 0.5)", argument, 50000+count, count))
+		s.info(argument + " joined the game")
+	case "sneak":
+		s.join(argument)
+	case "leave":
+		s.mu.Lock()
+		for i, player := range s.players {
+			if player == argument {
+				s.players = append(s.players[:i], s.players[i+1:]...)
+				break
+			}
+		}
+		s.mu.Unlock()
+		s.info(argument + " lost connection: Disconnected")
+		s.info(argument + " left the game")
+	case "warn":
+		s.log("Server thread", "WARN", argument)
+	case "error":
+		s.log("Server thread", "ERROR", argument)
+	case "crash":
+		s.crash()
+		return 1, true
+	case "":
+	default:
+		reply("Unknown or incomplete command, see below for error")
+	}
+	return 0, false
+}
+
+const maxPlayers = 20
+
+type server struct {
+	out     io.Writer
+	errOut  io.Writer
+	rcon    chan rconRequest
+	version string
+	motd    string
+	// Set by -ignore-stop.
+	ignoreStop bool
+
+	// Read by the status and query listeners.
+	mu      sync.Mutex
+	players []string
+}
+
+// join adds a player and returns how many are online.
+func (s *server) join(player string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.players = append(s.players, player)
+	return len(s.players)
+}
+
+func (s *server) onlinePlayers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.players...)
+}
+
+func (s *server) log(thread string, level string, text string) {
+	fmt.Fprintf(s.out, "[%s] [%s/%s]: %s\n", time.Now().Format("15:04:05"), thread, level, text)
+}
+
+func (s *server) info(text string) {
+	s.log("Server thread", "INFO", text)
+}
+
+func (s *server) crash() {
+	s.log("Server thread", "ERROR", "Encountered an unexpected exception")
+	fmt.Fprintln(s.errOut, "java.lang.IllegalStateException: fake crash")
+}
+
+func eulaAccepted() bool {
+	return strings.EqualFold(readKeyValues("eula.txt")["eula"], "true")
+}
+
+func readProperties() map[string]string {
+	return readKeyValues("server.properties")
+}
+
+// readKeyValues reads a key=value file, a missing file is empty.
+func readKeyValues(name string) map[string]string {
+	values := map[string]string{}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		if key, value, found := strings.Cut(line, "="); found {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return values
+}
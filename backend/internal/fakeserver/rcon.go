@@ -0,0 +1,111 @@
+package fakeserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Packet types of the RCON protocol.
+const (
+	rconResponse = 0
+	rconCommand  = 2
+	rconAuth     = 3
+)
+
+// Vanilla splits command output in packets of this many bytes.
+const rconFragment = 4096
+
+type rconRequest struct {
+	command string
+	reply   chan string
+	// Closed once the reply is sent, a server stopped over RCON still
+	// answers.
+	sent chan struct{}
+}
+
+// listenRcon answers RCON clients on port like a vanilla server, commands
+// are run by the main loop.
+func (s *server) listenRcon(port string, password string) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		return err
+	}
+	s.log("RCON Listener #1", "INFO", "RCON running on 0.0.0.0:"+port)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveRcon(conn, password)
+		}
+	}()
+	return nil
+}
+
+func (s *server) serveRcon(conn net.Conn, password string) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := false
+
+	for {
+		id, kind, body, err := readRconPacket(reader)
+		if err != nil {
+			return
+		}
+		switch {
+		case kind == rconAuth:
+			authenticated = password != "" && body == password
+			if !authenticated {
+				id = -1
+			}
+			writeRconPacket(conn, id, rconCommand, "")
+		case !authenticated:
+			writeRconPacket(conn, -1, rconCommand, "")
+		case kind == rconCommand:
+			request := rconRequest{command: body, reply: make(chan string), sent: make(chan struct{})}
+			s.rcon <- request
+			output := <-request.reply
+			for len(output) > rconFragment {
+				writeRconPacket(conn, id, rconResponse, output[:rconFragment])
+				output = output[rconFragment:]
+			}
+			writeRconPacket(conn, id, rconResponse, output)
+			close(request.sent)
+		default:
+			writeRconPacket(conn, id, rconResponse, fmt.Sprintf("Unknown request %x", kind))
+		}
+	}
+}
+
+func readRconPacket(reader io.Reader) (int32, int32, string, error) {
+	var length int32
+	if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+		return 0, 0, "", err
+	}
+	if length < 10 || length > 1460 {
+		return 0, 0, "", fmt.Errorf("bad packet length %d", length)
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(reader, packet); err != nil {
+		return 0, 0, "", err
+	}
+	id := int32(binary.LittleEndian.Uint32(packet[0:4]))
+	kind := int32(binary.LittleEndian.Uint32(packet[4:8]))
+	return id, kind, string(packet[8 : length-2]), nil
+}
+
+func writeRconPacket(writer io.Writer, id int32, kind int32, body string) error {
+	packet := make([]byte, 12, 14+len(body))
+	binary.LittleEndian.PutUint32(packet[0:4], uint32(10+len(body)))
+	binary.LittleEndian.PutUint32(packet[4:8], uint32(id))
+	binary.LittleEndian.PutUint32(packet[8:12], uint32(kind))
+	packet = append(packet, body...)
+	packet = append(packet, 0, 0)
+	_, err := writer.Write(packet)
+	return err
+}
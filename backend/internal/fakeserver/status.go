@@ -0,0 +1,195 @@
+package fakeserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// The protocol number of 1.21.10, answered to every version.
+const protocolVersion = 773
+
+// listenStatus answers Server List Pings on port: the handshake, the
+// status JSON and the ping. It doesn't accept logins.
+func (s *server) listenStatus(port string) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveStatus(conn)
+		}
+	}()
+	return nil
+}
+
+func (s *server) serveStatus(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	id, payload, err := readPacket(reader)
+	if err != nil || id != 0x00 {
+		return
+	}
+	// The next state is the last byte of the handshake, 1 for status.
+	if len(payload) == 0 || payload[len(payload)-1] != 1 {
+		return
+	}
+
+	for {
+		id, payload, err := readPacket(reader)
+		if err != nil {
+			return
+		}
+		switch id {
+		case 0x00:
+			players := s.onlinePlayers()
+			sample := []map[string]string{}
+			for i, player := range players {
+				if i == 12 {
+					break
+				}
+				sample = append(sample, map[string]string{"name": player, "id": fmt.Sprintf("00000000-0000-0000-0000-%012d", i)})
+			}
+			status, _ := json.Marshal(map[string]any{
+				"version":     map[string]any{"name": s.version, "protocol": protocolVersion},
+				"players":     map[string]any{"max": maxPlayers, "online": len(players), "sample": sample},
+				"description": map[string]any{"text": "", "extra": []map[string]string{{"text": s.motd, "color": "gold"}}},
+			})
+			body := appendVarint(nil, int32(len(status)))
+			writePacket(conn, 0x00, append(body, status...))
+		case 0x01:
+			writePacket(conn, 0x01, payload)
+			return
+		}
+	}
+}
+
+// listenQuery answers GameSpy4 queries on port, with the full stat only.
+func (s *server) listenQuery(port string) error {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:"+port)
+	if err != nil {
+		return err
+	}
+	s.log("Query Listener #1", "INFO", "Query running on 0.0.0.0:"+port)
+
+	go func() {
+		// A single token is enough for a test, vanilla changes it every
+		// 30 seconds.
+		const token = 9513307
+		buffer := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			packet := buffer[:n]
+			if n < 7 || packet[0] != 0xFE || packet[1] != 0xFD {
+				continue
+			}
+			kind, session := packet[2], packet[3:7]
+			response := append([]byte{kind}, session...)
+			switch {
+			case kind == 0x09:
+				response = append(response, strconv.Itoa(token)...)
+				response = append(response, 0)
+			case kind == 0x00 && n == 15 && binary.BigEndian.Uint32(packet[7:11]) == token:
+				response = append(response, s.fullStat()...)
+			default:
+				continue
+			}
+			conn.WriteTo(response, from)
+		}
+	}()
+	return nil
+}
+
+func (s *server) fullStat() []byte {
+	players := s.onlinePlayers()
+	stat := []byte("splitnum\x00\x80\x00")
+	for _, pair := range [][2]string{
+		{"hostname", s.motd},
+		{"gametype", "SMP"},
+		{"game_id", "MINECRAFT"},
+		{"version", s.version},
+		{"plugins", ""},
+		{"map", "world"},
+		{"numplayers", strconv.Itoa(len(players))},
+		{"maxplayers", strconv.Itoa(maxPlayers)},
+		{"hostport", "25565"},
+		{"hostip", "127.0.0.1"},
+	} {
+		stat = append(stat, pair[0]...)
+		stat = append(stat, 0)
+		stat = append(stat, pair[1]...)
+		stat = append(stat, 0)
+	}
+	stat = append(stat, 0)
+	stat = append(stat, "\x01player_\x00\x00"...)
+	for _, player := range players {
+		stat = append(stat, player...)
+		stat = append(stat, 0)
+	}
+	return append(stat, 0)
+}
+
+func readPacket(reader *bufio.Reader) (int32, []byte, error) {
+	length, err := readVarint(reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length < 1 || length > 1<<16 {
+		return 0, nil, errors.New("bad packet length")
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(reader, packet); err != nil {
+		return 0, nil, err
+	}
+	packetReader := bytes.NewReader(packet)
+	id, err := readVarint(packetReader)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, packet[len(packet)-packetReader.Len():], nil
+}
+
+func writePacket(writer io.Writer, id int32, payload []byte) error {
+	body := append(appendVarint(nil, id), payload...)
+	_, err := writer.Write(append(appendVarint(nil, int32(len(body))), body...))
+	return err
+}
+
+func appendVarint(buffer []byte, value int32) []byte {
+	unsigned := uint32(value)
+	for unsigned >= 0x80 {
+		buffer = append(buffer, byte(unsigned)|0x80)
+		unsigned >>= 7
+	}
+	return append(buffer, byte(unsigned))
+}
+
+func readVarint(reader io.ByteReader) (int32, error) {
+	var value uint32
+	for shift := 0; shift < 35; shift += 7 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return int32(value), nil
+		}
+	}
+	return 0, errors.New("varint too long")
+}
@@ -0,0 +1,353 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const javaProbeTimeout = 10 * time.Second
+
+// JavaConfig holds where to look for Java runtimes on top of the usual
+// locations. An entry can be a java executable, a JDK home or a folder
+// containing JDKs.
+type JavaConfig struct {
+	SearchPaths []string
+}
+
+type JavaRuntime struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Major   int    `json:"major"`
+}
+
+type probedRuntime struct {
+	runtime JavaRuntime
+	modTime time.Time
+	err     error
+}
+
+// javaRuntimeManager finds the Java runtimes installed on the machine. Each
+// executable is run once to read its version, results are cached until the
+// file changes.
+type javaRuntimeManager struct {
+	mu       sync.Mutex
+	runtimes []JavaRuntime
+	scanned  bool
+	probed   map[string]probedRuntime
+}
+
+var JavaRuntimes = &javaRuntimeManager{probed: make(map[string]probedRuntime)}
+
+var javaVersionLine = regexp.MustCompile(`version "([^"]+)"`)
+
+// parseJavaVersion reads the output of "java -version" and returns the
+// version string and its major version, "1.8.0_392" being Java 8.
+func parseJavaVersion(output string) (string, int, error) {
+	match := javaVersionLine.FindStringSubmatch(output)
+	if match == nil {
+		return "", 0, errors.New("no version in java -version output")
+	}
+	version := match[1]
+
+	number := strings.TrimPrefix(version, "1.")
+	end := 0
+	for end < len(number) && number[end] >= '0' && number[end] <= '9' {
+		end++
+	}
+	major, err := strconv.Atoi(number[:end])
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot read java version %q", version)
+	}
+	return version, major, nil
+}
+
+func javaExecutableName() string {
+	if runtime.GOOS == "windows" {
+		return "java.exe"
+	}
+	return "java"
+}
+
+// javaCandidates lists the executables worth probing, in order of
+// preference: JAVA_HOME, the PATH, configured paths, then well known
+// install locations.
+func javaCandidates() []string {
+	java := javaExecutableName()
+	var candidates []string
+
+	if home := os.Getenv("JAVA_HOME"); home != "" {
+		candidates = append(candidates, filepath.Join(home, "bin", java))
+	}
+	if path, err := exec.LookPath(java); err == nil {
+		candidates = append(candidates, path)
+	}
+
+	for _, searchPath := range SavedAppConfig.JavaConfig.SearchPaths {
+		candidates = append(candidates, javaInFolder(searchPath)...)
+	}
+
+	var patterns []string
+	switch runtime.GOOS {
+	case "windows":
+		for _, root := range []string{os.Getenv("ProgramFiles"), os.Getenv("ProgramFiles(x86)")} {
+			if root == "" {
+				continue
+			}
+			for _, vendor := range []string{"Java", "Eclipse Adoptium", "Eclipse Foundation", "Microsoft", "Zulu", "Amazon Corretto", "BellSoft"} {
+				patterns = append(patterns, filepath.Join(root, vendor, "*", "bin", java))
+			}
+		}
+	case "darwin":
+		patterns = append(patterns,
+			"/Library/Java/JavaVirtualMachines/*/Contents/Home/bin/java",
+			"/opt/homebrew/opt/openjdk*/bin/java",
+			"/usr/local/opt/openjdk*/bin/java",
+		)
+	default:
+		patterns = append(patterns,
+			"/usr/lib/jvm/*/bin/java",
+			"/usr/lib64/jvm/*/bin/java",
+			"/usr/java/*/bin/java",
+			"/opt/java/*/bin/java",
+			"/opt/jdk*/bin/java",
+		)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		patterns = append(patterns,
+			filepath.Join(home, ".sdkman", "candidates", "java", "*", "bin", java),
+			filepath.Join(home, ".jdks", "*", "bin", java),
+		)
+	}
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		candidates = append(candidates, matches...)
+	}
+	return candidates
+}
+
+// javaInFolder resolves a configured search path to java executables.
+func javaInFolder(path string) []string {
+	java := javaExecutableName()
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	if !info.IsDir() {
+		return []string{path}
+	}
+	if executable := filepath.Join(path, "bin", java); fileExists(executable) {
+		return []string{executable}
+	}
+	matches, _ := filepath.Glob(filepath.Join(path, "*", "bin", java))
+	return matches
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// Probe runs the java executable at path, which may also be a command
+// found in the PATH, and returns its version.
+func (m *javaRuntimeManager) Probe(path string) (JavaRuntime, error) {
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return JavaRuntime{}, err
+	}
+	if absolute, err := filepath.Abs(resolved); err == nil {
+		resolved = absolute
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return JavaRuntime{}, err
+	}
+
+	m.mu.Lock()
+	cached, found := m.probed[resolved]
+	m.mu.Unlock()
+	if found && cached.modTime.Equal(info.ModTime()) {
+		return cached.runtime, cached.err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), javaProbeTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, resolved, "-version").CombinedOutput()
+
+	result := probedRuntime{modTime: info.ModTime()}
+	if err != nil {
+		result.err = fmt.Errorf("%s -version failed: %w", resolved, err)
+	} else if version, major, err := parseJavaVersion(string(output)); err != nil {
+		result.err = fmt.Errorf("%s: %w", resolved, err)
+	} else {
+		result.runtime = JavaRuntime{Path: resolved, Version: version, Major: major}
+	}
+
+	m.mu.Lock()
+	m.probed[resolved] = result
+	m.mu.Unlock()
+	return result.runtime, result.err
+}
+
+// Scan probes every candidate again and replaces the list of runtimes.
+func (m *javaRuntimeManager) Scan() []JavaRuntime {
+	seen := make(map[string]bool)
+	var runtimes []JavaRuntime
+	for _, candidate := range javaCandidates() {
+		// Symlinks such as /usr/bin/java and /etc/alternatives point to
+		// the same JDK.
+		real := candidate
+		if resolved, err := filepath.EvalSymlinks(candidate); err == nil {
+			real = resolved
+		}
+		if seen[real] {
+			continue
+		}
+		seen[real] = true
+
+		java, err := m.Probe(candidate)
+		if err != nil {
+			fmt.Printf("\nIgnoring java runtime %s: %v", candidate, err)
+			continue
+		}
+		runtimes = append(runtimes, java)
+	}
+
+	m.mu.Lock()
+	m.runtimes = runtimes
+	m.scanned = true
+	m.mu.Unlock()
+	return runtimes
+}
+
+// List returns the runtimes found by the last scan, scanning first if
+// needed.
+func (m *javaRuntimeManager) List() []JavaRuntime {
+	m.mu.Lock()
+	scanned := m.scanned
+	runtimes := m.runtimes
+	m.mu.Unlock()
+
+	if !scanned {
+		return m.Scan()
+	}
+	return runtimes
+}
+
+// Select picks a runtime able to run a server that needs the given Java
+// major version: the same major if installed, else the oldest newer one.
+func (m *javaRuntimeManager) Select(major int) (JavaRuntime, error) {
+	var compatible []JavaRuntime
+	for _, java := range m.List() {
+		if java.Major == major {
+			return java, nil
+		}
+		if java.Major > major {
+			compatible = append(compatible, java)
+		}
+	}
+	if len(compatible) == 0 {
+		return JavaRuntime{}, fmt.Errorf("no Java %d or newer runtime found, install one or add its path to the Java search paths", major)
+	}
+	sort.SliceStable(compatible, func(i, j int) bool {
+		return compatible[i].Major < compatible[j].Major
+	})
+	return compatible[0], nil
+}
+
+// selectJava returns the java executable to start config with. A runtime
+// that is too old for the installed Minecraft version is refused.
+func selectJava(config InstanceConfig) (string, error) {
+	required := config.RequiredJavaMajor
+	path := config.Launch.JavaPath
+
+	if required == 0 {
+		if path == "" {
+			return DEFAULT_JAVA_PATH, nil
+		}
+		return path, nil
+	}
+
+	if path == "" {
+		java, err := JavaRuntimes.Select(required)
+		if err != nil {
+			return "", fmt.Errorf("Minecraft %s: %w", config.MinecraftVersion, err)
+		}
+		return java.Path, nil
+	}
+
+	java, err := JavaRuntimes.Probe(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot use java runtime %s: %w", path, err)
+	}
+	if java.Major < required {
+		return "", fmt.Errorf("Minecraft %s needs Java %d or newer but %s is Java %d (%s)",
+			config.MinecraftVersion, required, path, java.Major, java.Version)
+	}
+	return path, nil
+}
+
+// ResolveLaunchCommand is BuildLaunchCommand with the java executable
+// picked for the instance's Minecraft version.
+func ResolveLaunchCommand(config InstanceConfig) (LaunchCommand, error) {
+	java, err := selectJava(config)
+	if err != nil {
+		return LaunchCommand{}, err
+	}
+	config.Launch.JavaPath = java
+	return BuildLaunchCommand(config)
+}
+
+// LaunchCommandFor gives the command an instance is started with. Tests
+// replace it to run a fake server instead of java.
+var LaunchCommandFor = ResolveLaunchCommand
+
+// JavaRuntimesHandler lists the detected runtimes, ?refresh=true scans again.
+func JavaRuntimesHandler(w http.ResponseWriter, r *http.Request) {
+	var runtimes []JavaRuntime
+	if r.URL.Query().Get("refresh") == "true" {
+		runtimes = JavaRuntimes.Scan()
+	} else {
+		runtimes = JavaRuntimes.List()
+	}
+	if runtimes == nil {
+		runtimes = []JavaRuntime{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runtimes)
+}
+
+// JavaSearchPathsHandler replaces the configured search paths, one per line
+// in "paths", and rescans.
+func JavaSearchPathsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+
+	var paths []string
+	for _, line := range strings.Split(r.FormValue("paths"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	SavedAppConfig.JavaConfig.SearchPaths = paths
+	EncodeConfig()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(JavaRuntimes.Scan())
+}
@@ -0,0 +1,105 @@
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseJavaVersion(t *testing.T) {
+	cases := map[string]int{
+		`openjdk version "21.0.2" 2024-01-16`:                                       21,
+		`java version "1.8.0_392"`:                                                  8,
+		`openjdk version "17" 2021-09-14`:                                           17,
+		"Picked up JAVA_TOOL_OPTIONS: -Xss1M\nopenjdk version \"25-ea\" 2025-09-16": 25,
+	}
+	for output, expected := range cases {
+		_, major, err := parseJavaVersion(output)
+		if err != nil || major != expected {
+			t.Errorf("parseJavaVersion(%q) = %d, %v, expected %d", output, major, err, expected)
+		}
+	}
+
+	if _, _, err := parseJavaVersion("bash: java: command not found"); err == nil {
+		t.Error("output without a version should fail")
+	}
+}
+
+// fakeJava writes an executable printing the given version like java does.
+func fakeJava(t *testing.T, version string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake java is a shell script")
+	}
+	path := filepath.Join(t.TempDir(), "java")
+	script := "#!/bin/sh\necho 'openjdk version \"" + version + "\" 2024-01-16' >&2\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func withJavaRuntimes(t *testing.T, runtimes []JavaRuntime) {
+	previous := JavaRuntimes
+	JavaRuntimes = &javaRuntimeManager{runtimes: runtimes, scanned: true, probed: make(map[string]probedRuntime)}
+	t.Cleanup(func() { JavaRuntimes = previous })
+}
+
+func TestProbeJavaRuntime(t *testing.T) {
+	withJavaRuntimes(t, nil)
+	path := fakeJava(t, "17.0.9")
+
+	java, err := JavaRuntimes.Probe(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if java.Path != path || java.Version != "17.0.9" || java.Major != 17 {
+		t.Errorf("unexpected runtime %+v", java)
+	}
+}
+
+func TestSelectJavaRuntime(t *testing.T) {
+	withJavaRuntimes(t, []JavaRuntime{
+		{Path: "/jvm/25/bin/java", Major: 25},
+		{Path: "/jvm/17/bin/java", Major: 17},
+		{Path: "/jvm/21/bin/java", Major: 21},
+		{Path: "/jvm/8/bin/java", Major: 8},
+	})
+
+	cases := map[int]string{8: "/jvm/8/bin/java", 16: "/jvm/17/bin/java", 21: "/jvm/21/bin/java"}
+	for major, expected := range cases {
+		java, err := JavaRuntimes.Select(major)
+		if err != nil || java.Path != expected {
+			t.Errorf("Select(%d) = %s, %v, expected %s", major, java.Path, err, expected)
+		}
+	}
+	if _, err := JavaRuntimes.Select(26); err == nil {
+		t.Error("Select(26) should fail")
+	}
+}
+
+func TestSelectJavaForInstance(t *testing.T) {
+	withJavaRuntimes(t, []JavaRuntime{{Path: "/jvm/21/bin/java", Major: 21}})
+	java17 := fakeJava(t, "17.0.9")
+
+	config := InstanceConfig{MinecraftVersion: "1.21.10", RequiredJavaMajor: 21}
+	if path, err := selectJava(config); err != nil || path != "/jvm/21/bin/java" {
+		t.Errorf("expected the detected Java 21, got %s, %v", path, err)
+	}
+
+	config.Launch.JavaPath = java17
+	_, err := selectJava(config)
+	if err == nil || !strings.Contains(err.Error(), "needs Java 21") {
+		t.Errorf("expected a version mismatch, got %v", err)
+	}
+
+	config.RequiredJavaMajor = 17
+	if path, err := selectJava(config); err != nil || path != java17 {
+		t.Errorf("expected %s, got %s, %v", java17, path, err)
+	}
+
+	if path, err := selectJava(InstanceConfig{}); err != nil || path != DEFAULT_JAVA_PATH {
+		t.Errorf("unknown versions should run %s, got %s, %v", DEFAULT_JAVA_PATH, path, err)
+	}
+}
@@ -0,0 +1,418 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const DEFAULT_JAVA_PATH = "java"
+
+const (
+	GcPresetNone  = ""
+	GcPresetAikar = "aikar"
+	GcPresetZgc   = "zgc"
+)
+
+// LaunchSpec describes how the JVM of an instance is started, on top of
+// the jar, RAM and server arguments of InstanceConfig.
+type LaunchSpec struct {
+	// Java executable, "java" from the PATH when empty.
+	JavaPath string
+	// Extra JVM flags, added after the GC preset.
+	JvmFlags []string
+	GcPreset string
+	// Passed as -Dkey=value.
+	SystemProperties map[string]string
+	// Added to the environment the panel runs with.
+	Environment map[string]string
+}
+
+// aikarFlags are the G1 flags recommended by Aikar for Minecraft servers,
+// https://docs.papermc.io/paper/aikars-flags. Heaps above 12G get a larger
+// young generation.
+func aikarFlags(maxRamMb int) []string {
+	newSize, maxNewSize, regionSize, reserve, occupancy := "30", "40", "8M", "20", "15"
+	if maxRamMb > 12*1024 {
+		newSize, maxNewSize, regionSize, reserve, occupancy = "40", "50", "16M", "15", "20"
+	}
+	return []string{
+		"-XX:+UseG1GC",
+		"-XX:+ParallelRefProcEnabled",
+		"-XX:MaxGCPauseMillis=200",
+		"-XX:+UnlockExperimentalVMOptions",
+		"-XX:+DisableExplicitGC",
+		"-XX:+AlwaysPreTouch",
+		"-XX:G1NewSizePercent=" + newSize,
+		"-XX:G1MaxNewSizePercent=" + maxNewSize,
+		"-XX:G1HeapRegionSize=" + regionSize,
+		"-XX:G1ReservePercent=" + reserve,
+		"-XX:G1HeapWastePercent=5",
+		"-XX:G1MixedGCCountTarget=4",
+		"-XX:InitiatingHeapOccupancyPercent=" + occupancy,
+		"-XX:G1MixedGCLiveThresholdPercent=90",
+		"-XX:G1RSetUpdatingPauseTimePercent=5",
+		"-XX:SurvivorRatio=32",
+		"-XX:+PerfDisableSharedMem",
+		"-XX:MaxTenuringThreshold=1",
+		"-Dusing.aikars.flags=https://mcflags.emc.gs",
+		"-Daikars.new.flags=true",
+	}
+}
+
+func validGcPreset(preset string) bool {
+	switch preset {
+	case GcPresetNone, GcPresetAikar, GcPresetZgc:
+		return true
+	}
+	return false
+}
+
+func gcPresetFlags(preset string, maxRamMb int) ([]string, error) {
+	switch preset {
+	case GcPresetNone:
+		return nil, nil
+	case GcPresetAikar:
+		return aikarFlags(maxRamMb), nil
+	case GcPresetZgc:
+		return []string{"-XX:+UseZGC", "-XX:+AlwaysPreTouch", "-XX:+DisableExplicitGC"}, nil
+	}
+	return nil, fmt.Errorf("unknown GC preset %s", preset)
+}
+
+// parseRamMb reads a JVM memory size such as "1024M" or "4G" in megabytes.
+func parseRamMb(size string) (int, error) {
+	size = strings.TrimSpace(size)
+	if size == "" {
+		return 0, errors.New("empty memory size")
+	}
+	multiplier := 1.0 / 1024 / 1024
+	switch size[len(size)-1] {
+	case 'k', 'K':
+		multiplier = 1.0 / 1024
+		size = size[:len(size)-1]
+	case 'm', 'M':
+		multiplier = 1
+		size = size[:len(size)-1]
+	case 'g', 'G':
+		multiplier = 1024
+		size = size[:len(size)-1]
+	case 't', 'T':
+		multiplier = 1024 * 1024
+		size = size[:len(size)-1]
+	}
+	value, err := strconv.Atoi(size)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid memory size %q", size)
+	}
+	return int(float64(value) * multiplier), nil
+}
+
+// LaunchCommand is the fully resolved command line of an instance.
+type LaunchCommand struct {
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+	// Only the variables added by the launch spec.
+	Env []string `json:"env"`
+}
+
+// String renders the command the way it could be typed in a shell.
+func (launch LaunchCommand) String() string {
+	words := make([]string, 0, len(launch.Env)+len(launch.Args)+1)
+	for _, variable := range launch.Env {
+		words = append(words, quoteShellWord(variable))
+	}
+	words = append(words, quoteShellWord(launch.Path))
+	for _, arg := range launch.Args {
+		words = append(words, quoteShellWord(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// Environ is the environment the server process gets.
+func (launch LaunchCommand) Environ() []string {
+	return append(os.Environ(), launch.Env...)
+}
+
+// BuildLaunchCommand assembles the command line of config:
+// java -Xms -Xmx <preset> <flags> <-D...> -jar <jar> <server arguments>.
+func BuildLaunchCommand(config InstanceConfig) (LaunchCommand, error) {
+	spec := config.Launch
+	launch := LaunchCommand{Path: spec.JavaPath}
+	if launch.Path == "" {
+		launch.Path = DEFAULT_JAVA_PATH
+	}
+
+	maxRamMb, err := parseRamMb(config.MaxAllowedRam)
+	if err != nil {
+		return launch, fmt.Errorf("max RAM: %w", err)
+	}
+	if _, err := parseRamMb(config.MinAllowedRam); err != nil {
+		return launch, fmt.Errorf("min RAM: %w", err)
+	}
+	launch.Args = append(launch.Args, "-Xms"+config.MinAllowedRam, "-Xmx"+config.MaxAllowedRam)
+
+	presetFlags, err := gcPresetFlags(spec.GcPreset, maxRamMb)
+	if err != nil {
+		return launch, err
+	}
+	launch.Args = append(launch.Args, presetFlags...)
+	launch.Args = append(launch.Args, spec.JvmFlags...)
+
+	for _, key := range sortedKeys(spec.SystemProperties) {
+		launch.Args = append(launch.Args, "-D"+key+"="+spec.SystemProperties[key])
+	}
+
+	if config.ServerJarName == "" {
+		return launch, errors.New("no server jar configured")
+	}
+	launch.Args = append(launch.Args, "-jar", config.ServerJarName)
+
+	serverArgs, err := splitShellWords(config.OthersCommandArguments)
+	if err != nil {
+		return launch, fmt.Errorf("server arguments: %w", err)
+	}
+	launch.Args = append(launch.Args, serverArgs...)
+
+	for _, key := range sortedKeys(spec.Environment) {
+		launch.Env = append(launch.Env, key+"="+spec.Environment[key])
+	}
+	return launch, nil
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// splitShellWords splits s into words like a POSIX shell would, honouring
+// single quotes, double quotes and backslash escapes. Nothing is expanded.
+func splitShellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			inWord = true
+			if i+1 < len(s) {
+				i++
+				if s[i] != '\n' {
+					word.WriteByte(s[i])
+				}
+			}
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			inWord = true
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				// Inside double quotes a backslash only escapes these.
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`\n", s[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, errors.New("unterminated double quote")
+			}
+		default:
+			inWord = true
+			word.WriteByte(c)
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// quoteShellWord quotes word so that splitShellWords, or a shell, reads it
+// back unchanged.
+func quoteShellWord(word string) string {
+	if word == "" {
+		return "''"
+	}
+	safe := true
+	for _, c := range word {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_./:=+,%@", c)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+// parseKeyValueLines reads one KEY=value pair per line, blank lines are
+// ignored.
+func parseKeyValueLines(text string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("expected KEY=value, got %q", line)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+func keyValueLines(values map[string]string) string {
+	var lines strings.Builder
+	for _, key := range sortedKeys(values) {
+		lines.WriteString(key + "=" + values[key] + "\n")
+	}
+	return lines.String()
+}
+
+func LaunchSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+
+	err := Instances.Update(r.FormValue("instance"), func(config *InstanceConfig) error {
+		spec := config.Launch
+		if _, ok := r.Form["java_path"]; ok {
+			spec.JavaPath = strings.TrimSpace(r.FormValue("java_path"))
+		}
+		if _, ok := r.Form["gc_preset"]; ok {
+			preset := r.FormValue("gc_preset")
+			if !validGcPreset(preset) {
+				return fmt.Errorf("Unknown GC preset %s", preset)
+			}
+			spec.GcPreset = preset
+		}
+		if _, ok := r.Form["jvm_flags"]; ok {
+			flags, err := splitShellWords(r.FormValue("jvm_flags"))
+			if err != nil {
+				return fmt.Errorf("jvm_flags: %w", err)
+			}
+			spec.JvmFlags = flags
+		}
+		if _, ok := r.Form["system_properties"]; ok {
+			properties, err := parseKeyValueLines(r.FormValue("system_properties"))
+			if err != nil {
+				return fmt.Errorf("system_properties: %w", err)
+			}
+			spec.SystemProperties = properties
+		}
+		if _, ok := r.Form["environment"]; ok {
+			environment, err := parseKeyValueLines(r.FormValue("environment"))
+			if err != nil {
+				return fmt.Errorf("environment: %w", err)
+			}
+			spec.Environment = environment
+		}
+
+		updated := *config
+		updated.Launch = spec
+		if _, ok := r.Form["arguments"]; ok {
+			updated.OthersCommandArguments = r.FormValue("arguments")
+		}
+		if _, err := BuildLaunchCommand(updated); err != nil {
+			return err
+		}
+		*config = updated
+		return nil
+	})
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/instances/launch/view?instance="+url.QueryEscape(r.FormValue("instance")), http.StatusSeeOther)
+}
+
+func LaunchSettingsViewHandler(w http.ResponseWriter, r *http.Request) {
+	var launchTemplate = template.Must(template.New("launch.html").ParseFiles("./frontend/templates/launch.html"))
+
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+	config := mcServer.Config()
+
+	flags := make([]string, len(config.Launch.JvmFlags))
+	for i, flag := range config.Launch.JvmFlags {
+		flags[i] = quoteShellWord(flag)
+	}
+	data := map[string]interface{}{
+		"Instance":         config.ID,
+		"JavaPath":         config.Launch.JavaPath,
+		"GcPreset":         config.Launch.GcPreset,
+		"JvmFlags":         strings.Join(flags, " "),
+		"Arguments":        config.OthersCommandArguments,
+		"SystemProperties": keyValueLines(config.Launch.SystemProperties),
+		"Environment":      keyValueLines(config.Launch.Environment),
+		"MinecraftVersion": config.MinecraftVersion,
+		"RequiredJava":     config.RequiredJavaMajor,
+		"Runtimes":         JavaRuntimes.List(),
+	}
+	if launch, err := LaunchCommandFor(config); err != nil {
+		data["Error"] = err.Error()
+	} else {
+		data["Preview"] = launch.String()
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	launchTemplate.ExecuteTemplate(w, "launch.html", data)
+}
+
+// LaunchPreviewHandler shows the command line the instance would run with.
+func LaunchPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	launch, err := LaunchCommandFor(mcServer.Config())
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"command": launch.String(),
+		"path":    launch.Path,
+		"args":    launch.Args,
+		"env":     launch.Env,
+	})
+}
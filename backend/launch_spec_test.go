@@ -0,0 +1,122 @@
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitShellWords(t *testing.T) {
+	cases := map[string][]string{
+		"":                            nil,
+		"nogui":                       {"nogui"},
+		"  --port  25566 nogui ":      {"--port", "25566", "nogui"},
+		`--world 'My World' nogui`:    {"--world", "My World", "nogui"},
+		`--motd "say \"hi\" \n"`:      {"--motd", `say "hi" \n`},
+		`a\ b c''d "" ''`:             {"a b", "cd", "", ""},
+		`--name="it's ok"`:            {"--name=it's ok"},
+		"first\\\nsecond\tthird":      {"firstsecond", "third"},
+		`--path=/srv/mc/'with space'`: {"--path=/srv/mc/with space"},
+	}
+	for input, expected := range cases {
+		words, err := splitShellWords(input)
+		if err != nil {
+			t.Errorf("splitShellWords(%q): %v", input, err)
+			continue
+		}
+		if !reflect.DeepEqual(words, expected) {
+			t.Errorf("splitShellWords(%q) = %q, expected %q", input, words, expected)
+		}
+	}
+}
+
+func TestSplitShellWordsUnterminated(t *testing.T) {
+	for _, input := range []string{`'open`, `"open`, `a "b\"`} {
+		if _, err := splitShellWords(input); err == nil {
+			t.Errorf("splitShellWords(%q) should fail", input)
+		}
+	}
+}
+
+func TestQuoteShellWordRoundTrip(t *testing.T) {
+	for _, word := range []string{"nogui", "", "My World", "it's", `a"b`, "-Dx=$HOME"} {
+		words, err := splitShellWords(quoteShellWord(word))
+		if err != nil || len(words) != 1 || words[0] != word {
+			t.Errorf("%q quoted as %q reads back as %q", word, quoteShellWord(word), words)
+		}
+	}
+}
+
+func TestBuildLaunchCommand(t *testing.T) {
+	config := InstanceConfig{
+		ServerJarName:          "paper.jar",
+		MaxAllowedRam:          "4G",
+		MinAllowedRam:          "1024M",
+		OthersCommandArguments: `--world "My World" nogui`,
+		Launch: LaunchSpec{
+			JavaPath:         "/opt/jdk-21/bin/java",
+			JvmFlags:         []string{"-XX:+UseZGC"},
+			SystemProperties: map[string]string{"file.encoding": "UTF-8", "com.mojang.eula.agree": "true"},
+			Environment:      map[string]string{"TZ": "Europe/Paris"},
+		},
+	}
+
+	launch, err := BuildLaunchCommand(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"-Xms1024M", "-Xmx4G", "-XX:+UseZGC",
+		"-Dcom.mojang.eula.agree=true", "-Dfile.encoding=UTF-8",
+		"-jar", "paper.jar", "--world", "My World", "nogui",
+	}
+	if launch.Path != "/opt/jdk-21/bin/java" || !reflect.DeepEqual(launch.Args, expected) {
+		t.Errorf("unexpected command %s %q", launch.Path, launch.Args)
+	}
+	if !reflect.DeepEqual(launch.Env, []string{"TZ=Europe/Paris"}) {
+		t.Errorf("unexpected environment %q", launch.Env)
+	}
+	if command := launch.String(); command != "TZ=Europe/Paris /opt/jdk-21/bin/java -Xms1024M -Xmx4G -XX:+UseZGC -Dcom.mojang.eula.agree=true -Dfile.encoding=UTF-8 -jar paper.jar --world 'My World' nogui" {
+		t.Errorf("unexpected preview %s", command)
+	}
+}
+
+func TestBuildLaunchCommandAikar(t *testing.T) {
+	config := InstanceConfig{ServerJarName: "server.jar", MaxAllowedRam: "16G", MinAllowedRam: "16G"}
+	config.Launch.GcPreset = GcPresetAikar
+
+	launch, err := BuildLaunchCommand(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if launch.Path != DEFAULT_JAVA_PATH || launch.Args[2] != "-XX:+UseG1GC" {
+		t.Errorf("unexpected command %s %q", launch.Path, launch.Args)
+	}
+	found := false
+	for _, arg := range launch.Args {
+		if arg == "-XX:G1HeapRegionSize=16M" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("heaps above 12G should use the large heap flags: %q", launch.Args)
+	}
+}
+
+func TestBuildLaunchCommandErrors(t *testing.T) {
+	valid := InstanceConfig{ServerJarName: "server.jar", MaxAllowedRam: "2G", MinAllowedRam: "1G"}
+
+	invalid := []func(*InstanceConfig){
+		func(c *InstanceConfig) { c.MaxAllowedRam = "lots" },
+		func(c *InstanceConfig) { c.MinAllowedRam = "" },
+		func(c *InstanceConfig) { c.ServerJarName = "" },
+		func(c *InstanceConfig) { c.Launch.GcPreset = "cms" },
+		func(c *InstanceConfig) { c.OthersCommandArguments = `"nogui` },
+	}
+	for i, change := range invalid {
+		config := valid
+		change(&config)
+		if _, err := BuildLaunchCommand(config); err == nil {
+			t.Errorf("case %d should fail", i)
+		}
+	}
+}
@@ -6,11 +6,12 @@ type PageState int
 
 const (
 	ServerManagement PageState = iota
+	InstanceList
 )
 
-var CurrentPage PageState = ServerManagement
+var CurrentPage PageState = InstanceList
 
 func CurrentPageHandler(w http.ResponseWriter, r *http.Request) {
-	address := []string{"/templates/server_managing.html"}[CurrentPage]
+	address := []string{"/instances/manage?instance=" + DEFAULT_INSTANCE_ID, "/instances/view"}[CurrentPage]
 	http.Redirect(w, r, address, http.StatusSeeOther)
 }
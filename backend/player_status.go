@@ -0,0 +1,180 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	DEFAULT_SERVER_PORT = "25565"
+	// Matches the two seconds between points of the charts.
+	playersPollInterval = 2 * time.Second
+	playersHistorySize  = 30
+)
+
+// PlayersStatus is the last known player count of an instance, sent to
+// WebSocket clients as a "players" message. Source tells where it came
+// from: "query", "ping", or "console" when neither protocol answered and
+// the count comes from the join and leave lines.
+type PlayersStatus struct {
+	Type      string    `json:"type"`
+	Instance  string    `json:"instance"`
+	Online    int       `json:"online"`
+	Max       int       `json:"max,omitempty"`
+	Players   []string  `json:"players"`
+	MOTD      string    `json:"motd,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	Protocol  int       `json:"protocol,omitempty"`
+	LatencyMs int64     `json:"latency_ms,omitempty"`
+	Source    string    `json:"source"`
+	PolledAt  time.Time `json:"polled_at,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// statusSettings reads where an instance answers Server List Pings and,
+// when enable-query is set, queries, from its server.properties.
+func statusSettings(directory string) (pingAddress string, queryAddress string, queryEnabled bool) {
+	properties, err := readServerPropertiesFile(directory)
+	if err != nil {
+		properties = map[string]string{}
+	}
+	host := properties["server-ip"]
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	port := properties["server-port"]
+	if port == "" {
+		port = DEFAULT_SERVER_PORT
+	}
+	queryPort := properties["query.port"]
+	if queryPort == "" {
+		queryPort = port
+	}
+	return net.JoinHostPort(host, port), net.JoinHostPort(host, queryPort), properties["enable-query"] == "true"
+}
+
+// pollPlayers polls the player count while the server runs, until the
+// process behind exited is gone.
+func (mc *McServer) pollPlayers(exited chan struct{}) {
+	ticker := time.NewTicker(playersPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exited:
+			return
+		case <-ticker.C:
+		}
+		if mc.State() == StateRunning {
+			mc.PollPlayers()
+		}
+	}
+}
+
+// PollPlayers asks the server for its players, over the query protocol
+// when enabled and with a Server List Ping, records the count in the
+// players history and sends it to the clients.
+func (mc *McServer) PollPlayers() PlayersStatus {
+	pingAddress, queryAddress, queryEnabled := statusSettings(mc.Config().Directory)
+	status := PlayersStatus{Type: "players", Instance: mc.ID(), PolledAt: time.Now()}
+
+	var queryErr error
+	queried := false
+	if queryEnabled {
+		var query QueryResult
+		query, queryErr = QueryServer(queryAddress)
+		if queryErr == nil {
+			queried = true
+			status.Source = "query"
+			status.Online = query.Online
+			status.Max = query.Max
+			status.Players = query.Players
+			status.MOTD = query.MOTD
+			status.Version = query.Version
+		}
+	}
+
+	ping, pingErr := PingServer(pingAddress)
+	if pingErr == nil {
+		if !queried {
+			status.Source = "ping"
+			status.Online = ping.Online
+			status.Max = ping.Max
+			// Vanilla samples at most 12 players.
+			status.Players = []string{}
+			for _, player := range ping.Sample {
+				status.Players = append(status.Players, player.Name)
+			}
+		}
+		status.MOTD = ping.MOTD
+		status.Version = ping.Version
+		status.Protocol = ping.Protocol
+		status.LatencyMs = ping.Latency.Milliseconds()
+	}
+
+	if !queried && pingErr != nil {
+		status.Source = "console"
+		status.Error = pingErr.Error()
+		if queryErr != nil {
+			status.Error = fmt.Sprintf("query: %v, ping: %v", queryErr, pingErr)
+		}
+	}
+
+	mc.players.mu.Lock()
+	if status.Source == "console" {
+		status.Players = append([]string{}, mc.players.playersNames...)
+		status.Online = len(status.Players)
+		status.Max = mc.players.last.Max
+	} else if queried || len(status.Players) == status.Online {
+		// A partial sample would drop players the console told us about.
+		mc.players.playersNames = append([]string{}, status.Players...)
+	}
+	mc.players.playersNumbers = append(mc.players.playersNumbers, status.Online)
+	if len(mc.players.playersNumbers) > playersHistorySize {
+		mc.players.playersNumbers = mc.players.playersNumbers[1:]
+	}
+	mc.players.last = status
+	mc.players.mu.Unlock()
+
+	mc.hub.BroadcastJSON(status)
+	return status
+}
+
+// PlayersStatus returns the result of the last poll, with the players the
+// console reported since.
+func (mc *McServer) PlayersStatus() PlayersStatus {
+	mc.players.mu.Lock()
+	defer mc.players.mu.Unlock()
+
+	status := mc.players.last
+	status.Type = "players"
+	status.Instance = mc.ID()
+	status.Players = append([]string{}, mc.players.playersNames...)
+	if status.Source == "" {
+		status.Source = "console"
+		status.Online = len(status.Players)
+	}
+	return status
+}
+
+// PlayersHandler returns the players of an instance, polled again first
+// with refresh=true.
+func PlayersHandler(w http.ResponseWriter, r *http.Request) {
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	var status PlayersStatus
+	if r.URL.Query().Get("refresh") == "true" && mcServer.State() == StateRunning {
+		status = mcServer.PollPlayers()
+	} else {
+		status = mcServer.PlayersStatus()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,123 @@
+package backend
+
+import (
+	"Skyfield1888/WebMine/backend/internal/fakeserver"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// statusInstance starts a fake server answering Server List Pings, and
+// queries when query is set, on free ports.
+func statusInstance(t *testing.T, query bool) *McServer {
+	mc := fakeInstance(t, InstanceConfig{}, map[string]string{
+		"motd":         "§aWebMine §rtest",
+		"server-port":  fakeserver.FreePort(t, "tcp"),
+		"query.port":   fakeserver.FreePort(t, "udp"),
+		"enable-query": fmt.Sprint(query),
+	})
+	mc.Start()
+	waitState(t, mc, StateRunning)
+	return mc
+}
+
+func TestPingServer(t *testing.T) {
+	mc := statusInstance(t, false)
+	mc.SendCommand("join Alex")
+	mc.SendCommand("list")
+	waitConsoleLine(t, mc, "There are 1 of a max")
+
+	address, _, _ := statusSettings(mc.Config().Directory)
+	result, err := PingServer(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Version != "1.21.10" || result.Online != 1 || result.Max != 20 || result.MOTD != "WebMine test" {
+		t.Errorf("unexpected ping result %+v", result)
+	}
+	if len(result.Sample) != 1 || result.Sample[0].Name != "Alex" {
+		t.Errorf("unexpected sample %+v", result.Sample)
+	}
+}
+
+func TestQueryServer(t *testing.T) {
+	mc := statusInstance(t, true)
+	waitConsoleLine(t, mc, "Query running on")
+	mc.SendCommand("join Alex")
+	mc.SendCommand("join Steve")
+	mc.SendCommand("list")
+	waitConsoleLine(t, mc, "There are 2 of a max")
+
+	_, address, enabled := statusSettings(mc.Config().Directory)
+	if !enabled {
+		t.Fatal("query not enabled")
+	}
+	result, err := QueryServer(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Online != 2 || result.Max != 20 || result.Version != "1.21.10" || result.MOTD != "WebMine test" {
+		t.Errorf("unexpected query result %+v", result)
+	}
+	if !reflect.DeepEqual(result.Players, []string{"Alex", "Steve"}) {
+		t.Errorf("players %v", result.Players)
+	}
+}
+
+func TestPollPlayersCorrectsTheConsole(t *testing.T) {
+	mc := statusInstance(t, true)
+	waitConsoleLine(t, mc, "Query running on")
+	mc.SendCommand("join Alex")
+	// Nothing in the console tells about this one.
+	mc.SendCommand("sneak Steve")
+	mc.SendCommand("list")
+	waitConsoleLine(t, mc, "There are 2 of a max")
+	if status := mc.PlayersStatus(); status.Source != "console" || status.Online != 1 {
+		t.Errorf("before polling got %+v", status)
+	}
+
+	status := mc.PollPlayers()
+	if status.Source != "query" || status.Online != 2 || status.Max != 20 || !reflect.DeepEqual(status.Players, []string{"Alex", "Steve"}) {
+		t.Errorf("unexpected poll %+v", status)
+	}
+	if status.Protocol == 0 || status.MOTD != "WebMine test" {
+		t.Errorf("the ping wasn't used for %+v", status)
+	}
+	if status := mc.PlayersStatus(); status.Online != 2 || len(status.Players) != 2 {
+		t.Errorf("the poll wasn't recorded: %+v", status)
+	}
+
+	mc.players.mu.Lock()
+	history := append([]int{}, mc.players.playersNumbers...)
+	mc.players.mu.Unlock()
+	if len(history) == 0 || history[len(history)-1] != 2 {
+		t.Errorf("players history %v", history)
+	}
+
+	mc.StopAndWait()
+	if status := mc.PlayersStatus(); status.Source != "console" || status.Online != 0 || len(status.Players) != 0 {
+		t.Errorf("after the server stopped got %+v", status)
+	}
+	mc.players.mu.Lock()
+	history = append([]int{}, mc.players.playersNumbers...)
+	mc.players.mu.Unlock()
+	if len(history) != 0 {
+		t.Errorf("players history %v after the server stopped", history)
+	}
+}
+
+func TestPollPlayersFallsBackToTheConsole(t *testing.T) {
+	mc := fakeInstance(t, InstanceConfig{}, nil)
+	mc.Start()
+	waitState(t, mc, StateRunning)
+	// Nothing listens there.
+	fakeserver.WriteProperties(t, mc.Config().Directory, map[string]string{"server-port": fakeserver.FreePort(t, "tcp")})
+	mc.SendCommand("join Alex")
+	mc.SendCommand("list")
+	waitConsoleLine(t, mc, "There are 1 of a max")
+
+	status := mc.PollPlayers()
+	if status.Source != "console" || status.Online != 1 || status.Error == "" {
+		t.Errorf("unexpected poll %+v", status)
+	}
+}
@@ -5,14 +5,14 @@ import (
 	"errors"
 	"html/template"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 )
 
-var ServerProperties = make(map[string]string)
-
 func GetPropertyType(value string) string {
 	if value == "true" || value == "false" {
 		return "bool"
@@ -47,11 +47,13 @@ func checkStrType(s string, initialValue string) error {
 	return nil
 }
 
-func readServerPropertiesFile() map[string]string {
-	path := SavedAppConfig.MinecraftServerConfig.PathToMcServers + "server.properties"
+func readServerPropertiesFile(path string) (map[string]string, error) {
+	path = filepath.Join(path, "server.properties")
 
 	f, err := os.Open(path)
-	Check(err)
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
 
 	properties := make(map[string]string)
@@ -73,14 +75,33 @@ func readServerPropertiesFile() map[string]string {
 		}
 	}
 
-	Check(scanner.Err())
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return properties, nil
+}
 
-	return properties
+// WorldDirectories returns the world folders found in an instance
+// directory: level-name from server.properties, "world" by default, and
+// the _nether and _the_end folders Bukkit based servers add.
+func WorldDirectories(directory string) []string {
+	levelName := "world"
+	if properties, err := readServerPropertiesFile(directory); err == nil && properties["level-name"] != "" {
+		levelName = properties["level-name"]
+	}
 
+	worlds := []string{}
+	for _, name := range []string{levelName, levelName + "_nether", levelName + "_the_end"} {
+		if info, err := os.Stat(filepath.Join(directory, name)); err == nil && info.IsDir() {
+			worlds = append(worlds, name)
+		}
+	}
+	return worlds
 }
 
 func writeServerPropertiesFile(properties map[string]string, path string) error {
-	path = path + "server.properties"
+	path = filepath.Join(path, "server.properties")
 	f, err := os.Create(path)
 	if err != nil {
 		return err
@@ -107,6 +128,12 @@ func writeServerPropertiesFile(properties map[string]string, path string) error
 func ChangePropertiesHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 
+	mc, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
 	property := r.FormValue("property")
 	value := r.FormValue("value")
 
@@ -115,32 +142,50 @@ func ChangePropertiesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := checkStrType(value, ServerProperties[property])
+	directory := mc.Config().Directory
+	serverProperties, err := readServerPropertiesFile(directory)
 	if err != nil {
 		HtmlDetailedError(w, err)
 		return
 	}
 
-	ServerProperties[property] = value
-	writeServerPropertiesFile(ServerProperties, SavedAppConfig.MinecraftServerConfig.PathToMcServers)
-	http.Redirect(w, r, "/properties/view", http.StatusSeeOther)
-}
-
+	err = checkStrType(value, serverProperties[property])
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
 
+	serverProperties[property] = value
+	writeServerPropertiesFile(serverProperties, directory)
+	http.Redirect(w, r, "/properties/view?instance="+url.QueryEscape(mc.ID()), http.StatusSeeOther)
+}
 
 func PropertiesTableHandler(w http.ResponseWriter, r *http.Request) {
 	var propertiesTemplate = template.Must(template.New("properties.html").ParseFiles("./frontend/templates/properties.html"))
-	
+
+	mc, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/html")
-	ServerProperties = readServerPropertiesFile()
+	serverProperties, err := readServerPropertiesFile(mc.Config().Directory)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
 
 	properties := make(map[string]map[string]string)
-	for key, value := range ServerProperties {
+	for key, value := range serverProperties {
 		properties[key] = map[string]string{
 			"value": value,
 			"type":  GetPropertyType(value),
 		}
 	}
 
-	propertiesTemplate.ExecuteTemplate(w, "properties.html", properties)
+	propertiesTemplate.ExecuteTemplate(w, "properties.html", map[string]interface{}{
+		"Instance":   mc.ID(),
+		"Properties": properties,
+	})
 }
@@ -0,0 +1,28 @@
+//go:build linux
+
+package backend
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+// startOnPty starts cmd with a new pseudo-terminal as its stdin, stdout and
+// stderr, and returns the master side.
+func startOnPty(cmd *exec.Cmd) (*os.File, error) {
+	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: ptyRows, Cols: ptyColumns})
+	if err != nil {
+		return nil, err
+	}
+
+	// Commands we type would otherwise be echoed back into the console.
+	termios, err := unix.IoctlGetTermios(int(ptmx.Fd()), unix.TCGETS)
+	if err == nil {
+		termios.Lflag &^= unix.ECHO
+		unix.IoctlSetTermios(int(ptmx.Fd()), unix.TCSETS, termios)
+	}
+	return ptmx, nil
+}
@@ -0,0 +1,72 @@
+package backend
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"syscall"
+)
+
+// Wide enough that the server never wraps its own log lines.
+const (
+	ptyRows    = 50
+	ptyColumns = 500
+)
+
+// isPtyClosed tells whether err is how Linux reports that the other side of
+// a pseudo-terminal went away.
+func isPtyClosed(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, io.EOF)
+}
+
+// startPty runs cmd on a pseudo-terminal. Output goes through the same
+// console handling as the pipes, commands are written to the terminal.
+func (mc *McServer) startPty(cmd *exec.Cmd, exited chan struct{}) error {
+	ptmx, err := startOnPty(cmd)
+	if err != nil {
+		fmt.Printf("\nError starting server on a pty: %v", err)
+		mc.startFailed(exited)
+		return err
+	}
+
+	mc.mu.Lock()
+	mc.cmd = cmd
+	mc.process = cmd.Process
+	mc.stdin = bufio.NewWriter(ptmx)
+	mc.launchFinished()
+	mc.mu.Unlock()
+
+	fmt.Println("Minecraft server process started successfully (pty)")
+
+	go mc.sampleStats(int32(cmd.Process.Pid))
+	go mc.pollPlayers(exited)
+
+	drained := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(ptmx)
+		for scanner.Scan() {
+			mc.handleConsoleLine(scanner.Text())
+		}
+		if err := scanner.Err(); err != nil && !isPtyClosed(err) {
+			fmt.Printf("\nError reading pty: %v", err)
+		}
+		close(drained)
+	}()
+
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			fmt.Printf("\nServer process exited with error: %v", err)
+		} else {
+			fmt.Println("Server process exited normally")
+		}
+		// The master still holds whatever the server printed last.
+		<-drained
+		ptmx.Close()
+		mc.processExited(cmd.ProcessState.ExitCode(), exited)
+	}()
+
+	return nil
+}
@@ -0,0 +1,43 @@
+//go:build linux
+
+package backend
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestPtyServer(t *testing.T) {
+	mc := fakeInstance(t, InstanceConfig{Pty: true}, nil)
+	if err := mc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, mc, StateRunning)
+	if line := waitConsoleLine(t, mc, "OFFLINE/INSECURE MODE"); line.Level != "warn" {
+		t.Errorf("warning logged as %s", line.Level)
+	}
+
+	seq := mc.ConsoleSeq()
+	if err := mc.SendCommand("say hello over the pty"); err != nil {
+		t.Fatal(err)
+	}
+	waitConsoleLineAfter(t, mc, seq, "[Server] hello over the pty")
+	for _, line := range mc.console.Before(math.MaxUint64, consoleBufferSize) {
+		if strings.Contains(line.Text, "say hello") {
+			t.Errorf("the command was echoed: %q", line.Text)
+		}
+		if strings.ContainsAny(line.Text, "\r\x1b") {
+			t.Errorf("terminal characters left in %q", line.Text)
+		}
+	}
+
+	if err := mc.StopAndWait(); err != nil {
+		t.Fatal(err)
+	}
+	// The last lines are read from the terminal before the exit.
+	waitConsoleLine(t, mc, "All dimensions are saved")
+	if exit := mc.Status().LastExit; exit == nil || exit.Reason != ExitStopped {
+		t.Errorf("unexpected exit %+v", exit)
+	}
+}
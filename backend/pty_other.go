@@ -0,0 +1,13 @@
+//go:build !linux
+
+package backend
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+func startOnPty(cmd *exec.Cmd) (*os.File, error) {
+	return nil, errors.New("running servers on a pseudo-terminal is only supported on linux")
+}
@@ -0,0 +1,162 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Packet types of the Source RCON protocol. Requests and auth responses
+// share the value 2.
+const (
+	rconTypeResponse     = 0
+	rconTypeCommand      = 2
+	rconTypeAuthResponse = 2
+	rconTypeAuth         = 3
+	// Servers answer unknown types with "Unknown request", which marks the
+	// end of the response to the command sent before it.
+	rconTypeEnd = 200
+)
+
+const (
+	rconTimeout = 10 * time.Second
+	// The longest command vanilla accepts, its packets are 1460 bytes.
+	rconMaxCommand = 1446
+	// Responses are split in packets of 4096 bytes, anything much bigger
+	// isn't an RCON packet.
+	rconMaxPacket = 4096 + 1024
+)
+
+var ErrRconAuth = errors.New("RCON password refused")
+
+// RconClient runs commands on a server over RCON. Commands are sent one at
+// a time, so a response is never mixed with another.
+type RconClient struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	nextID int32
+}
+
+// DialRcon connects to address and logs in with password.
+func DialRcon(address string, password string) (*RconClient, error) {
+	conn, err := net.DialTimeout("tcp", address, rconTimeout)
+	if err != nil {
+		return nil, err
+	}
+	client := &RconClient{conn: conn, reader: bufio.NewReader(conn)}
+
+	conn.SetDeadline(time.Now().Add(rconTimeout))
+	id := client.newID()
+	if err := client.write(id, rconTypeAuth, password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for {
+		responseID, kind, _, err := client.read()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		// Source servers send an empty response before the auth result.
+		if kind != rconTypeAuthResponse {
+			continue
+		}
+		if responseID == -1 {
+			conn.Close()
+			return nil, ErrRconAuth
+		}
+		if responseID == id {
+			return client, nil
+		}
+	}
+}
+
+// Execute runs command and returns its whole output, which may span
+// several packets.
+func (client *RconClient) Execute(command string) (string, error) {
+	if len(command) > rconMaxCommand {
+		return "", fmt.Errorf("command longer than %d bytes", rconMaxCommand)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.conn.SetDeadline(time.Now().Add(rconTimeout))
+	id := client.newID()
+	end := client.newID()
+	if err := client.write(id, rconTypeCommand, command); err != nil {
+		return "", err
+	}
+	if err := client.write(end, rconTypeEnd, ""); err != nil {
+		return "", err
+	}
+
+	output := []byte{}
+	answered := false
+	for {
+		responseID, _, body, err := client.read()
+		if err != nil {
+			// "stop" is answered, then the server goes away without
+			// reading the end marker.
+			if answered && !errors.Is(err, os.ErrDeadlineExceeded) {
+				return string(output), nil
+			}
+			return "", err
+		}
+		switch responseID {
+		case id:
+			answered = true
+			output = append(output, body...)
+		case end:
+			return string(output), nil
+		case -1:
+			return "", ErrRconAuth
+		}
+	}
+}
+
+func (client *RconClient) Close() error {
+	return client.conn.Close()
+}
+
+func (client *RconClient) newID() int32 {
+	client.nextID++
+	return client.nextID
+}
+
+// write sends a packet: its length, request id and type as little endian
+// int32, then the body and two null bytes.
+func (client *RconClient) write(id int32, kind int32, body string) error {
+	packet := make([]byte, 12, 14+len(body))
+	binary.LittleEndian.PutUint32(packet[0:4], uint32(10+len(body)))
+	binary.LittleEndian.PutUint32(packet[4:8], uint32(id))
+	binary.LittleEndian.PutUint32(packet[8:12], uint32(kind))
+	packet = append(packet, body...)
+	packet = append(packet, 0, 0)
+	_, err := client.conn.Write(packet)
+	return err
+}
+
+func (client *RconClient) read() (int32, int32, []byte, error) {
+	var length int32
+	if err := binary.Read(client.reader, binary.LittleEndian, &length); err != nil {
+		return 0, 0, nil, err
+	}
+	if length < 10 || length > rconMaxPacket {
+		return 0, 0, nil, fmt.Errorf("invalid RCON packet of %d bytes", length)
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(client.reader, packet); err != nil {
+		return 0, 0, nil, err
+	}
+	id := int32(binary.LittleEndian.Uint32(packet[0:4]))
+	kind := int32(binary.LittleEndian.Uint32(packet[4:8]))
+	return id, kind, packet[8 : length-2], nil
+}
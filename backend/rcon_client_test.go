@@ -0,0 +1,134 @@
+package backend
+
+import (
+	"Skyfield1888/WebMine/backend/internal/fakeserver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// rconInstance starts a fake server with RCON enabled on a free port.
+func rconInstance(t *testing.T, password string) (*McServer, string) {
+	port := fakeserver.FreePort(t, "tcp")
+	mc := fakeInstance(t, InstanceConfig{}, map[string]string{
+		"enable-rcon":   "true",
+		"rcon.port":     port,
+		"rcon.password": password,
+	})
+	mc.Start()
+	waitState(t, mc, StateRunning)
+	waitConsoleLine(t, mc, "RCON running on")
+	return mc, "127.0.0.1:" + port
+}
+
+func TestRconClient(t *testing.T) {
+	_, address := rconInstance(t, "secret")
+
+	if _, err := DialRcon(address, "wrong"); !errors.Is(err, ErrRconAuth) {
+		t.Errorf("expected the password to be refused, got %v", err)
+	}
+
+	client, err := DialRcon(address, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	output, err := client.Execute("whitelist add Steve")
+	if err != nil || output != "Added Steve to the whitelist" {
+		t.Errorf("got %q, %v", output, err)
+	}
+
+	// About 20KB, split in several packets.
+	output, err = client.Execute("lines 1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(output, "\n")
+	if len(lines) != 1000 || lines[999] != "line 1000 of 1000" {
+		t.Errorf("got %d lines, the last one %q", len(lines), lines[len(lines)-1])
+	}
+
+	if _, err := client.Execute(strings.Repeat("x", 2000)); err == nil {
+		t.Error("commands over the RCON limit should be refused")
+	}
+}
+
+func TestRunCommandOverRcon(t *testing.T) {
+	mc, _ := rconInstance(t, "secret")
+
+	result, err := mc.RunCommand("list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Transport != "rcon" || result.Output != "There are 0 of a max of 20 players online: " {
+		t.Errorf("unexpected result %+v", result)
+	}
+	waitConsoleLine(t, mc, "> list")
+
+	// A new server process, the connection is made again.
+	mc.StopAndWait()
+	restarted := waitConsoleLine(t, mc, "Saving worlds")
+	mc.Start()
+	waitState(t, mc, StateRunning)
+	waitConsoleLineAfter(t, mc, restarted.Seq, "RCON running on")
+	if result, err := mc.RunCommand("save-all"); err != nil || result.Output != "Saving the game (this may take a moment!)\nSaved the game" {
+		t.Errorf("after a restart got %+v, %v", result, err)
+	}
+
+	result, err = mc.RunCommand("stop")
+	if err != nil || result.Transport != "rcon" {
+		t.Fatalf("got %+v, %v", result, err)
+	}
+	waitState(t, mc, StateStopped)
+	if exit := mc.Status().LastExit; exit == nil || exit.Reason != ExitStopped {
+		t.Errorf("stop over RCON ended with %+v", exit)
+	}
+}
+
+func TestStopOverRconEscalates(t *testing.T) {
+	port := fakeserver.FreePort(t, "tcp")
+	config := InstanceConfig{}
+	config.Supervisor = SupervisorConfig{StopTimeoutSeconds: 1, KillTimeoutSeconds: 1}
+	mc := fakeInstance(t, config, map[string]string{
+		"enable-rcon":   "true",
+		"rcon.port":     port,
+		"rcon.password": "secret",
+	}, "-ignore-stop")
+	mc.Start()
+	waitState(t, mc, StateRunning)
+	waitConsoleLine(t, mc, "RCON running on")
+
+	result, err := mc.RunCommand("stop")
+	if err != nil || result.Transport != "rcon" {
+		t.Fatalf("got %+v, %v", result, err)
+	}
+	if state := mc.State(); state != StateStopping {
+		t.Errorf("state %s after a stop over RCON", state)
+	}
+	waitConsoleLine(t, mc, "did not stop within 1s, sending SIGTERM")
+	waitState(t, mc, StateStopped)
+	if exit := mc.Status().LastExit; exit == nil || exit.Reason != ExitTerminated {
+		t.Errorf("unexpected exit %+v", exit)
+	}
+}
+
+func TestRunCommandFallsBackToStdin(t *testing.T) {
+	mc := fakeInstance(t, InstanceConfig{}, nil)
+	mc.Start()
+	waitState(t, mc, StateRunning)
+
+	result, err := mc.RunCommand("say without rcon")
+	if err != nil || result.Transport != "stdin" || result.RconError != "" {
+		t.Errorf("got %+v, %v", result, err)
+	}
+	waitConsoleLine(t, mc, "[Server] without rcon")
+
+	bad, _ := rconInstance(t, "secret")
+	fakeserver.WriteProperties(t, bad.Config().Directory, map[string]string{"enable-rcon": "true", "rcon.port": "1", "rcon.password": "secret"})
+	result, err = bad.RunCommand("say rcon is down")
+	if err != nil || result.Transport != "stdin" || result.RconError == "" {
+		t.Errorf("got %+v, %v", result, err)
+	}
+	waitConsoleLine(t, bad, "[Server] rcon is down")
+}
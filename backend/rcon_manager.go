@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const DEFAULT_RCON_PORT = "25575"
+
+// CommandResult is what running a console command gave back. Output is
+// only known when the command went through RCON, commands written to the
+// server's stdin answer in the console.
+type CommandResult struct {
+	Command   string `json:"command"`
+	Output    string `json:"output"`
+	Transport string `json:"transport"`
+	// Why RCON wasn't used although server.properties enables it.
+	RconError string `json:"rcon_error,omitempty"`
+}
+
+// rconSettings reads the RCON address and password of an instance from
+// its server.properties, enabled is false when RCON is off or has no
+// password.
+func rconSettings(directory string) (address string, password string, enabled bool) {
+	properties, err := readServerPropertiesFile(directory)
+	if err != nil || properties["enable-rcon"] != "true" || properties["rcon.password"] == "" {
+		return "", "", false
+	}
+	host := properties["server-ip"]
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	port := properties["rcon.port"]
+	if port == "" {
+		port = DEFAULT_RCON_PORT
+	}
+	return net.JoinHostPort(host, port), properties["rcon.password"], true
+}
+
+// RunCommand runs a console command over RCON when the instance enables
+// it and returns its output, and falls back to the server's stdin.
+func (mc *McServer) RunCommand(command string) (CommandResult, error) {
+	command = strings.TrimSpace(command)
+	if command == "" {
+		return CommandResult{}, errors.New("empty command")
+	}
+	result := CommandResult{Command: command, Transport: "stdin"}
+
+	address, password, enabled := rconSettings(mc.Config().Directory)
+	if enabled && mc.State() == StateRunning {
+		if command == "stop" {
+			// Marked before it is sent, the server may be gone before
+			// the answer.
+			mc.mu.Lock()
+			if mc.state.IsAlive() {
+				mc.markStopping()
+			}
+			mc.mu.Unlock()
+		}
+		output, err := mc.rconExecute(address, password, command)
+		if err == nil {
+			result.Output = output
+			result.Transport = "rcon"
+			mc.logMessage("rcon", "> "+command)
+			for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+				if line != "" {
+					mc.logMessage("rcon", line)
+				}
+			}
+			return result, nil
+		}
+		fmt.Printf("\nRCON command failed on %s, using stdin: %v", mc.ID(), err)
+		result.RconError = err.Error()
+	}
+
+	return result, mc.SendCommand(command)
+}
+
+// rconExecute sends command on the instance's RCON connection, connecting
+// again once if the server was restarted since.
+func (mc *McServer) rconExecute(address string, password string, command string) (string, error) {
+	mc.rconMu.Lock()
+	defer mc.rconMu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if mc.rcon == nil {
+			mc.rcon, err = DialRcon(address, password)
+			if err != nil {
+				return "", err
+			}
+		}
+		var output string
+		output, err = mc.rcon.Execute(command)
+		if err == nil {
+			return output, nil
+		}
+		mc.rcon.Close()
+		mc.rcon = nil
+		if errors.Is(err, ErrRconAuth) {
+			break
+		}
+	}
+	return "", err
+}
+
+// ConsoleCommandHandler runs the command form value on an instance and
+// answers with its output when RCON is enabled.
+func ConsoleCommandHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+	fmt.Printf("\nCommand from %s to %s: %s", r.RemoteAddr, mcServer.ID(), r.FormValue("command"))
+
+	result, err := mcServer.RunCommand(r.FormValue("command"))
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":     "success",
+		"command":    result.Command,
+		"output":     result.Output,
+		"transport":  result.Transport,
+		"rcon_error": result.RconError,
+	})
+}
@@ -0,0 +1,240 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	pingTimeout = 3 * time.Second
+	// Status responses carry a base64 favicon, they stay well under this.
+	pingMaxPacket = 1 << 20
+	// By convention, a client that doesn't know the server's version
+	// pings with -1.
+	pingProtocolVersion = -1
+)
+
+// PingResult is what a server answers to a Server List Ping, the request
+// clients send to fill their server list.
+type PingResult struct {
+	Version  string
+	Protocol int
+	Online   int
+	Max      int
+	Sample   []PingPlayer
+	MOTD     string
+	Latency  time.Duration
+}
+
+type PingPlayer struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+}
+
+type pingStatus struct {
+	Version struct {
+		Name     string `json:"name"`
+		Protocol int    `json:"protocol"`
+	} `json:"version"`
+	Players struct {
+		Max    int          `json:"max"`
+		Online int          `json:"online"`
+		Sample []PingPlayer `json:"sample"`
+	} `json:"players"`
+	Description json.RawMessage `json:"description"`
+}
+
+// PingServer runs a Server List Ping against address: a handshake asking
+// for the status, the status JSON, then a ping whose round trip is the
+// latency.
+func PingServer(address string) (PingResult, error) {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return PingResult{}, err
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return PingResult{}, fmt.Errorf("invalid port %q", portText)
+	}
+
+	conn, err := net.DialTimeout("tcp", address, pingTimeout)
+	if err != nil {
+		return PingResult{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(pingTimeout))
+	reader := bufio.NewReader(conn)
+
+	handshake := appendVarint(nil, pingProtocolVersion)
+	handshake = appendPingString(handshake, host)
+	handshake = binary.BigEndian.AppendUint16(handshake, uint16(port))
+	handshake = appendVarint(handshake, 1)
+	if err := writePingPacket(conn, 0x00, handshake); err != nil {
+		return PingResult{}, err
+	}
+	if err := writePingPacket(conn, 0x00, nil); err != nil {
+		return PingResult{}, err
+	}
+
+	id, payload, err := readPingPacket(reader)
+	if err != nil {
+		return PingResult{}, err
+	}
+	if id != 0x00 {
+		return PingResult{}, fmt.Errorf("unexpected packet 0x%02x instead of the status", id)
+	}
+	body, err := readPingString(payload)
+	if err != nil {
+		return PingResult{}, err
+	}
+	var status pingStatus
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		return PingResult{}, fmt.Errorf("invalid status JSON: %w", err)
+	}
+	result := PingResult{
+		Version:  status.Version.Name,
+		Protocol: status.Version.Protocol,
+		Online:   status.Players.Online,
+		Max:      status.Players.Max,
+		Sample:   status.Players.Sample,
+		MOTD:     chatText(status.Description),
+	}
+
+	sent := time.Now()
+	payload = binary.BigEndian.AppendUint64(nil, uint64(sent.UnixMilli()))
+	if err := writePingPacket(conn, 0x01, payload); err != nil {
+		return PingResult{}, err
+	}
+	id, pong, err := readPingPacket(reader)
+	if err != nil {
+		return PingResult{}, err
+	}
+	if id != 0x01 || !bytes.Equal(pong, payload) {
+		return PingResult{}, errors.New("the server answered the ping with something else")
+	}
+	result.Latency = time.Since(sent)
+	return result, nil
+}
+
+// chatText flattens a chat component, or a plain string, to its text
+// without formatting.
+func chatText(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return stripFormatting(text)
+	}
+	var component struct {
+		Text  string            `json:"text"`
+		Extra []json.RawMessage `json:"extra"`
+	}
+	if json.Unmarshal(raw, &component) != nil {
+		return ""
+	}
+	var builder strings.Builder
+	builder.WriteString(component.Text)
+	for _, extra := range component.Extra {
+		builder.WriteString(chatText(extra))
+	}
+	return stripFormatting(builder.String())
+}
+
+// stripFormatting removes the § color and style codes of legacy MOTDs.
+func stripFormatting(text string) string {
+	var builder strings.Builder
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] == '§' {
+			i++
+			continue
+		}
+		builder.WriteRune(runes[i])
+	}
+	return builder.String()
+}
+
+// writePingPacket sends a packet: its length and id as varints, then the
+// payload.
+func writePingPacket(writer io.Writer, id int32, payload []byte) error {
+	body := appendVarint(nil, id)
+	body = append(body, payload...)
+	packet := appendVarint(nil, int32(len(body)))
+	packet = append(packet, body...)
+	_, err := writer.Write(packet)
+	return err
+}
+
+func readPingPacket(reader *bufio.Reader) (int32, []byte, error) {
+	length, err := readVarint(reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length < 1 || length > pingMaxPacket {
+		return 0, nil, fmt.Errorf("invalid packet of %d bytes", length)
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(reader, packet); err != nil {
+		return 0, nil, err
+	}
+	packetReader := bytes.NewReader(packet)
+	id, err := readVarint(packetReader)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, packet[len(packet)-packetReader.Len():], nil
+}
+
+// appendVarint appends value in the protocol's variable length encoding,
+// 7 bits per byte, least significant group first.
+func appendVarint(buffer []byte, value int32) []byte {
+	unsigned := uint32(value)
+	for unsigned >= 0x80 {
+		buffer = append(buffer, byte(unsigned)|0x80)
+		unsigned >>= 7
+	}
+	return append(buffer, byte(unsigned))
+}
+
+func readVarint(reader io.ByteReader) (int32, error) {
+	var value uint32
+	for shift := 0; shift < 35; shift += 7 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return int32(value), nil
+		}
+	}
+	return 0, errors.New("varint longer than 5 bytes")
+}
+
+func appendPingString(buffer []byte, text string) []byte {
+	buffer = appendVarint(buffer, int32(len(text)))
+	return append(buffer, text...)
+}
+
+func readPingString(payload []byte) (string, error) {
+	reader := bytes.NewReader(payload)
+	length, err := readVarint(reader)
+	if err != nil {
+		return "", err
+	}
+	if length < 0 || int(length) > reader.Len() {
+		return "", fmt.Errorf("invalid string of %d bytes", length)
+	}
+	start := len(payload) - reader.Len()
+	return string(payload[start : start+int(length)]), nil
+}
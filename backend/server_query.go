@@ -0,0 +1,151 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+const queryTimeout = 3 * time.Second
+
+// Packet types of the GameSpy4 query protocol.
+const (
+	queryTypeStat      = 0x00
+	queryTypeHandshake = 0x09
+)
+
+var queryMagic = []byte{0xFE, 0xFD}
+
+// The full stat response starts with "splitnum" and a few constant bytes,
+// and separates the key values from the player list with "player_".
+var (
+	queryStatPadding   = []byte("splitnum\x00\x80\x00")
+	queryPlayerPadding = []byte("\x01player_\x00\x00")
+)
+
+// QueryResult is the full stat a server with enable-query answers. Unlike
+// the Server List Ping, it lists every player.
+type QueryResult struct {
+	MOTD     string
+	GameType string
+	Version  string
+	Plugins  string
+	Map      string
+	Online   int
+	Max      int
+	Players  []string
+}
+
+// QueryServer asks address for its full stat over UDP: a handshake that
+// returns a challenge token, then the stat request carrying it.
+func QueryServer(address string) (QueryResult, error) {
+	conn, err := net.DialTimeout("udp", address, queryTimeout)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(queryTimeout))
+
+	// Servers only keep the low 4 bits of each byte of the session id.
+	session := rand.Int31() & 0x0F0F0F0F
+
+	response, err := queryExchange(conn, queryTypeHandshake, session, nil)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	token, err := strconv.ParseInt(string(bytes.TrimRight(response, "\x00")), 10, 32)
+	if err != nil {
+		return QueryResult{}, fmt.Errorf("invalid challenge token %q", response)
+	}
+
+	// The padding asks for the full stat instead of the basic one.
+	request := binary.BigEndian.AppendUint32(nil, uint32(token))
+	request = append(request, 0, 0, 0, 0)
+	response, err = queryExchange(conn, queryTypeStat, session, request)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	return parseFullStat(response)
+}
+
+// queryExchange sends a request and returns the payload of its answer,
+// after the type and session id.
+func queryExchange(conn net.Conn, kind byte, session int32, payload []byte) ([]byte, error) {
+	packet := append([]byte{}, queryMagic...)
+	packet = append(packet, kind)
+	packet = binary.BigEndian.AppendUint32(packet, uint32(session))
+	packet = append(packet, payload...)
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		// Late answers to a previous request are skipped.
+		if n < 5 || buffer[0] != kind || int32(binary.BigEndian.Uint32(buffer[1:5])) != session {
+			continue
+		}
+		return append([]byte{}, buffer[5:n]...), nil
+	}
+}
+
+func parseFullStat(payload []byte) (QueryResult, error) {
+	if !bytes.HasPrefix(payload, queryStatPadding) {
+		return QueryResult{}, errors.New("not a full stat response")
+	}
+	payload = payload[len(queryStatPadding):]
+
+	values := map[string]string{}
+	for {
+		key, rest, found := bytes.Cut(payload, []byte{0})
+		if !found {
+			return QueryResult{}, errors.New("truncated full stat response")
+		}
+		payload = rest
+		if len(key) == 0 {
+			break
+		}
+		value, rest, found := bytes.Cut(payload, []byte{0})
+		if !found {
+			return QueryResult{}, errors.New("truncated full stat response")
+		}
+		payload = rest
+		values[string(key)] = string(value)
+	}
+
+	if !bytes.HasPrefix(payload, queryPlayerPadding) {
+		return QueryResult{}, errors.New("full stat response without a player list")
+	}
+	payload = payload[len(queryPlayerPadding):]
+	players := []string{}
+	for {
+		name, rest, found := bytes.Cut(payload, []byte{0})
+		if !found || len(name) == 0 {
+			break
+		}
+		players = append(players, string(name))
+		payload = rest
+	}
+
+	online, _ := strconv.Atoi(values["numplayers"])
+	max, _ := strconv.Atoi(values["maxplayers"])
+	return QueryResult{
+		MOTD:     stripFormatting(values["hostname"]),
+		GameType: values["gametype"],
+		Version:  values["version"],
+		Plugins:  values["plugins"],
+		Map:      values["map"],
+		Online:   online,
+		Max:      max,
+		Players:  players,
+	}, nil
+}
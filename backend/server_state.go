@@ -0,0 +1,123 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// ServerState is where an instance is in its lifecycle. Every change is
+// pushed to WebSocket clients as a "state" message.
+type ServerState string
+
+const (
+	StateStopped  ServerState = "stopped"
+	StateStarting ServerState = "starting"
+	StateRunning  ServerState = "running"
+	StateStopping ServerState = "stopping"
+	StateCrashed  ServerState = "crashed"
+	// Waiting out the backoff before an automatic restart.
+	StateRestarting ServerState = "restarting"
+	// Too many crashes in the supervisor window, no more automatic restarts.
+	StateCrashLoop ServerState = "crash_loop"
+)
+
+// IsAlive tells whether a server process exists in this state.
+func (state ServerState) IsAlive() bool {
+	return state == StateStarting || state == StateRunning || state == StateStopping
+}
+
+// Printed by vanilla and most forks once the world is loaded.
+var doneLine = regexp.MustCompile(`Done \(\d+(\.\d+)?s\)! For help`)
+
+type ServerStatus struct {
+	Type          string      `json:"type"`
+	Instance      string      `json:"instance"`
+	State         ServerState `json:"state"`
+	PID           int         `json:"pid,omitempty"`
+	UptimeSeconds int64       `json:"uptime_seconds"`
+	LastExit      *ExitInfo   `json:"last_exit,omitempty"`
+	EulaRequired  bool        `json:"eula_required,omitempty"`
+}
+
+// setState moves the instance to state and notifies clients.
+// Callers hold mc.mu.
+func (mc *McServer) setState(state ServerState) {
+	if mc.state == state {
+		return
+	}
+	if state == StateStarting {
+		mc.startedAt = time.Now()
+	}
+	mc.state = state
+	close(mc.stateChanged)
+	mc.stateChanged = make(chan struct{})
+	mc.hub.BroadcastJSON(mc.status())
+}
+
+// status snapshots the lifecycle of the instance. Callers hold mc.mu.
+func (mc *McServer) status() ServerStatus {
+	status := ServerStatus{
+		Type:         "state",
+		Instance:     mc.config.ID,
+		State:        mc.state,
+		EulaRequired: mc.eulaRequired,
+	}
+	if mc.state.IsAlive() {
+		if mc.process != nil {
+			status.PID = mc.process.Pid
+		}
+		status.UptimeSeconds = int64(time.Since(mc.startedAt).Seconds())
+	}
+	if !mc.lastExit.Time.IsZero() {
+		lastExit := mc.lastExit
+		status.LastExit = &lastExit
+	}
+	return status
+}
+
+func (mc *McServer) Status() ServerStatus {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.status()
+}
+
+func (mc *McServer) State() ServerState {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.state
+}
+
+// WaitState blocks until the instance is in one of states and returns it,
+// or until ctx ends.
+func (mc *McServer) WaitState(ctx context.Context, states ...ServerState) (ServerState, error) {
+	for {
+		mc.mu.Lock()
+		state, changed := mc.state, mc.stateChanged
+		mc.mu.Unlock()
+
+		for _, wanted := range states {
+			if state == wanted {
+				return state, nil
+			}
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return state, ctx.Err()
+		}
+	}
+}
+
+func StatusHandler(w http.ResponseWriter, r *http.Request) {
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mcServer.Status())
+}
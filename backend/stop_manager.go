@@ -0,0 +1,170 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultStopTimeoutSeconds = 60
+	defaultKillTimeoutSeconds = 15
+)
+
+const (
+	ExitStopped    = "stopped"
+	ExitExited     = "exited"
+	ExitCrashed    = "crashed"
+	ExitTerminated = "terminated"
+	ExitKilled     = "killed"
+)
+
+// ExitInfo describes how the last server process ended.
+type ExitInfo struct {
+	Reason string    `json:"reason"`
+	Code   int       `json:"code"`
+	Time   time.Time `json:"time"`
+}
+
+func (exit ExitInfo) Text() string {
+	switch exit.Reason {
+	case ExitStopped:
+		return "Server stopped"
+	case ExitTerminated:
+		return "Server did not stop in time and was terminated (SIGTERM)"
+	case ExitKilled:
+		return "Server was killed (SIGKILL)"
+	case ExitCrashed:
+		return fmt.Sprintf("Server stopped with error: exit code %d", exit.Code)
+	}
+	return "Server exited on its own"
+}
+
+// describeExit works out why the process ended. code is -1 when the
+// process was killed by a signal or its status is unknown, forcedSignal is
+// the signal the panel sent, if any.
+func describeExit(code int, forcedSignal syscall.Signal, stopRequested bool) ExitInfo {
+	exit := ExitInfo{Code: code, Time: time.Now()}
+
+	switch {
+	case forcedSignal == syscall.SIGKILL:
+		exit.Reason = ExitKilled
+	case forcedSignal == syscall.SIGTERM:
+		exit.Reason = ExitTerminated
+	case stopRequested:
+		exit.Reason = ExitStopped
+	case exit.Code == 0:
+		exit.Reason = ExitExited
+	default:
+		exit.Reason = ExitCrashed
+	}
+	return exit
+}
+
+// markStopping records a stop the user asked for once "stop" was sent,
+// from the stop button or the console, and escalates it if the server
+// doesn't exit. mc.mu must be held.
+func (mc *McServer) markStopping() {
+	mc.setState(StateStopping)
+	mc.stopRequested = true
+	if !mc.stopping {
+		mc.stopping = true
+		go mc.escalateStop(mc.exited, mc.config.Supervisor.withDefaults())
+	}
+}
+
+// escalateStop gives the server StopTimeoutSeconds to exit after "stop",
+// then sends SIGTERM, then SIGKILL after KillTimeoutSeconds more.
+func (mc *McServer) escalateStop(exited chan struct{}, config SupervisorConfig) {
+	select {
+	case <-exited:
+		return
+	case <-time.After(time.Duration(config.StopTimeoutSeconds) * time.Second):
+	}
+
+	mc.logMessage("warn", fmt.Sprintf("Server did not stop within %ds, sending SIGTERM", config.StopTimeoutSeconds))
+	if err := mc.signal(syscall.SIGTERM); err != nil {
+		fmt.Printf("\nError sending SIGTERM: %v", err)
+	}
+
+	select {
+	case <-exited:
+		return
+	case <-time.After(time.Duration(config.KillTimeoutSeconds) * time.Second):
+	}
+
+	mc.logMessage("warn", fmt.Sprintf("Server still running %ds after SIGTERM, killing it", config.KillTimeoutSeconds))
+	if err := mc.signal(syscall.SIGKILL); err != nil {
+		fmt.Printf("\nError killing server: %v", err)
+	}
+}
+
+func (mc *McServer) signal(sig syscall.Signal) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if !mc.state.IsAlive() || mc.process == nil {
+		return errors.New("server not running")
+	}
+	mc.forcedSignal = sig
+	if sig == syscall.SIGKILL {
+		return mc.process.Kill()
+	}
+	return mc.process.Signal(sig)
+}
+
+// Kill ends the server immediately without letting it save.
+func (mc *McServer) Kill() error {
+	mc.mu.Lock()
+	mc.cancelRestart()
+	mc.stopRequested = true
+	mc.mu.Unlock()
+
+	fmt.Println("Killing Minecraft server...")
+	return mc.signal(syscall.SIGKILL)
+}
+
+// StopAndWait stops the server and blocks until the process is gone,
+// escalating to signals if needed.
+func (mc *McServer) StopAndWait() error {
+	mc.mu.Lock()
+	exited := mc.exited
+	mc.mu.Unlock()
+
+	if err := mc.Stop(); err != nil {
+		return err
+	}
+	<-exited
+	return nil
+}
+
+func KillHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("\nKill server request from %s", r.RemoteAddr)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mcServer, err := instanceFromRequest(r)
+	if err != nil {
+		HtmlDetailedError(w, err)
+		return
+	}
+
+	if err := mcServer.Kill(); err != nil {
+		fmt.Printf("\nFailed to kill server: %v", err)
+		http.Error(w, fmt.Sprintf("Error: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": "Minecraft server killed",
+	})
+}
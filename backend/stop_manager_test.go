@@ -0,0 +1,107 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// stuckInstance starts a fake server with flags that ignores "stop",
+// with one second to stop and one more after SIGTERM.
+func stuckInstance(t *testing.T, flags ...string) *McServer {
+	config := InstanceConfig{}
+	config.Supervisor = SupervisorConfig{StopTimeoutSeconds: 1, KillTimeoutSeconds: 1}
+	mc := fakeInstance(t, config, nil, append([]string{"-ignore-stop"}, flags...)...)
+	mc.Start()
+	waitState(t, mc, StateRunning)
+	return mc
+}
+
+func TestStopEscalatesToSigterm(t *testing.T) {
+	mc := stuckInstance(t)
+
+	begin := time.Now()
+	if err := mc.StopAndWait(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(begin); elapsed < time.Second || elapsed > 2*time.Second {
+		t.Errorf("stopped after %s, expected SIGTERM after 1s", elapsed)
+	}
+	waitConsoleLine(t, mc, "did not stop within 1s, sending SIGTERM")
+	if exit := mc.Status().LastExit; exit == nil || exit.Reason != ExitTerminated {
+		t.Errorf("unexpected exit %+v", exit)
+	}
+}
+
+func TestStopEscalatesToSigkill(t *testing.T) {
+	mc := stuckInstance(t, "-ignore-sigterm")
+
+	begin := time.Now()
+	if err := mc.StopAndWait(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(begin); elapsed < 2*time.Second || elapsed > 3*time.Second {
+		t.Errorf("stopped after %s, expected SIGKILL after 2s", elapsed)
+	}
+	sigterm := waitConsoleLine(t, mc, "sending SIGTERM")
+	waitConsoleLineAfter(t, mc, sigterm.Seq, "still running 1s after SIGTERM, killing it")
+	if exit := mc.Status().LastExit; exit == nil || exit.Reason != ExitKilled {
+		t.Errorf("unexpected exit %+v", exit)
+	}
+}
+
+func TestStopCommandEscalates(t *testing.T) {
+	mc := stuckInstance(t)
+
+	if err := mc.SendCommand("stop"); err != nil {
+		t.Fatal(err)
+	}
+	if state := mc.State(); state != StateStopping {
+		t.Errorf("state %s after a typed stop", state)
+	}
+	waitConsoleLine(t, mc, "did not stop within 1s, sending SIGTERM")
+	waitState(t, mc, StateStopped)
+	if exit := mc.Status().LastExit; exit == nil || exit.Reason != ExitTerminated {
+		t.Errorf("unexpected exit %+v", exit)
+	}
+}
+
+func TestKillHandler(t *testing.T) {
+	mc := stuckInstance(t, "-ignore-sigterm")
+	Instances.mu.Lock()
+	Instances.servers[mc.ID()] = mc
+	Instances.mu.Unlock()
+	t.Cleanup(func() {
+		Instances.mu.Lock()
+		delete(Instances.servers, mc.ID())
+		Instances.mu.Unlock()
+	})
+
+	recorder := httptest.NewRecorder()
+	KillHandler(recorder, httptest.NewRequest(http.MethodGet, "/console/kill?instance="+mc.ID(), nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET answered %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	KillHandler(recorder, httptest.NewRequest(http.MethodPost, "/console/kill?instance="+mc.ID(), nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("kill answered %d: %s", recorder.Code, recorder.Body)
+	}
+	var response map[string]string
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || response["status"] != "success" {
+		t.Errorf("unexpected response %v, %v", response, err)
+	}
+	waitState(t, mc, StateStopped)
+	if exit := mc.Status().LastExit; exit == nil || exit.Reason != ExitKilled {
+		t.Errorf("unexpected exit %+v", exit)
+	}
+
+	recorder = httptest.NewRecorder()
+	KillHandler(recorder, httptest.NewRequest(http.MethodPost, "/console/kill?instance="+mc.ID(), nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("killing a stopped server answered %d", recorder.Code)
+	}
+}
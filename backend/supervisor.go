@@ -0,0 +1,161 @@
+package backend
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// SupervisorConfig decides what happens when a server exits without the
+// user asking for it, and how long a stop may take before the process is
+// signalled. Zero values fall back to the defaults.
+type SupervisorConfig struct {
+	RestartPolicy      string
+	MaxRestarts        int
+	WindowSeconds      int
+	BackoffSeconds     int
+	MaxBackoffSeconds  int
+	StopTimeoutSeconds int
+	KillTimeoutSeconds int
+}
+
+const (
+	defaultMaxRestarts       = 5
+	defaultWindowSeconds     = 600
+	defaultBackoffSeconds    = 5
+	defaultMaxBackoffSeconds = 300
+)
+
+func (config SupervisorConfig) withDefaults() SupervisorConfig {
+	if config.RestartPolicy == "" {
+		config.RestartPolicy = RestartNever
+	}
+	if config.MaxRestarts <= 0 {
+		config.MaxRestarts = defaultMaxRestarts
+	}
+	if config.WindowSeconds <= 0 {
+		config.WindowSeconds = defaultWindowSeconds
+	}
+	if config.BackoffSeconds <= 0 {
+		config.BackoffSeconds = defaultBackoffSeconds
+	}
+	if config.MaxBackoffSeconds <= 0 {
+		config.MaxBackoffSeconds = defaultMaxBackoffSeconds
+	}
+	if config.StopTimeoutSeconds <= 0 {
+		config.StopTimeoutSeconds = defaultStopTimeoutSeconds
+	}
+	if config.KillTimeoutSeconds <= 0 {
+		config.KillTimeoutSeconds = defaultKillTimeoutSeconds
+	}
+	return config
+}
+
+func validRestartPolicy(policy string) bool {
+	switch policy {
+	case "", RestartNever, RestartOnFailure, RestartAlways:
+		return true
+	}
+	return false
+}
+
+// supervisorState tracks automatic restarts of one instance. It is guarded
+// by McServer.mu.
+type supervisorState struct {
+	restarts []time.Time
+	pending  *time.Timer
+}
+
+// cancelRestart drops any scheduled restart and leaves the crash loop,
+// which is what the user means by a manual start or stop. It reports
+// whether there was anything to cancel. Callers hold mc.mu.
+func (mc *McServer) cancelRestart() bool {
+	if mc.supervisor.pending != nil {
+		mc.supervisor.pending.Stop()
+		mc.supervisor.pending = nil
+	}
+	if mc.state == StateRestarting || mc.state == StateCrashLoop {
+		mc.setState(StateStopped)
+		return true
+	}
+	return false
+}
+
+// superviseExit is called once the server process is gone, or could not be
+// started. stopRequested tells whether the user asked for the stop.
+func (mc *McServer) superviseExit(exit ExitInfo, stopRequested bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	config := mc.config.Supervisor.withDefaults()
+	switch {
+	case stopRequested:
+		mc.supervisor.restarts = nil
+		return
+	case config.RestartPolicy == RestartNever:
+		return
+	case mc.eulaRequired:
+		// It would exit again until the EULA is accepted.
+		return
+	case config.RestartPolicy == RestartOnFailure && exit.Reason != ExitCrashed:
+		return
+	}
+
+	now := time.Now()
+	window := time.Duration(config.WindowSeconds) * time.Second
+	recent := mc.supervisor.restarts[:0]
+	for _, restart := range mc.supervisor.restarts {
+		if now.Sub(restart) < window {
+			recent = append(recent, restart)
+		}
+	}
+	mc.supervisor.restarts = recent
+
+	if len(recent) >= config.MaxRestarts {
+		mc.setState(StateCrashLoop)
+		text := fmt.Sprintf("Server crashed %d times in %s, giving up until it is started manually", len(recent), window)
+		fmt.Printf("\n[%s] %s", mc.config.ID, text)
+		mc.logMessage("crash_loop", text)
+		return
+	}
+
+	backoff := time.Duration(config.BackoffSeconds) * time.Second
+	maxBackoff := time.Duration(config.MaxBackoffSeconds) * time.Second
+	for i := 0; i < len(recent) && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	mc.setState(StateRestarting)
+	mc.supervisor.restarts = append(mc.supervisor.restarts, now)
+	attempt := len(mc.supervisor.restarts)
+
+	text := fmt.Sprintf("Server exited unexpectedly, restarting in %s (attempt %d/%d)", backoff, attempt, config.MaxRestarts)
+	fmt.Printf("\n[%s] %s", mc.config.ID, text)
+	mc.logMessage("restarting", text)
+
+	var timer *time.Timer
+	timer = time.AfterFunc(backoff, func() {
+		mc.mu.Lock()
+		if mc.supervisor.pending != timer {
+			// Cancelled by a manual start or stop.
+			mc.mu.Unlock()
+			return
+		}
+		mc.supervisor.pending = nil
+		mc.mu.Unlock()
+
+		if err := mc.start(); err != nil {
+			fmt.Printf("\n[%s] Automatic restart failed: %v", mc.ID(), err)
+			mc.superviseExit(ExitInfo{Reason: ExitCrashed, Code: -1, Time: time.Now()}, false)
+		}
+	})
+	mc.supervisor.pending = timer
+}
@@ -0,0 +1,63 @@
+package backend
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countStarts tells how many times the fake server started.
+func countStarts(mc *McServer) int {
+	count := 0
+	for _, line := range mc.console.Before(math.MaxUint64, consoleBufferSize) {
+		if strings.Contains(line.Text, "Starting minecraft server version") {
+			count++
+		}
+	}
+	return count
+}
+
+func TestSupervisorGivesUpInACrashLoop(t *testing.T) {
+	config := InstanceConfig{}
+	config.Supervisor = SupervisorConfig{RestartPolicy: RestartOnFailure, MaxRestarts: 2, WindowSeconds: 10, BackoffSeconds: 1, MaxBackoffSeconds: 1}
+	mc := fakeInstance(t, config, nil, "-crash")
+	mc.Start()
+
+	waitState(t, mc, StateCrashLoop)
+	waitConsoleLine(t, mc, "Server crashed 2 times in 10s, giving up")
+	// The first start and two restarts.
+	if starts := countStarts(mc); starts != 3 {
+		t.Errorf("started %d times, expected 3", starts)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if state := mc.State(); state != StateCrashLoop {
+		t.Errorf("instance %s after giving up", state)
+	}
+	if starts := countStarts(mc); starts != 3 {
+		t.Errorf("restarted after giving up, %d starts", starts)
+	}
+}
+
+func TestSupervisorForgetsCrashesOutsideTheWindow(t *testing.T) {
+	config := InstanceConfig{}
+	config.Supervisor = SupervisorConfig{RestartPolicy: RestartOnFailure, MaxRestarts: 1, WindowSeconds: 1, BackoffSeconds: 1, MaxBackoffSeconds: 1}
+	mc := fakeInstance(t, config, nil, "-crash")
+	mc.Start()
+
+	// Every restart is a backoff of 1s after the previous one, so the
+	// window never holds more than the current one.
+	deadline := time.Now().Add(10 * time.Second)
+	for countStarts(mc) < 3 && time.Now().Before(deadline) {
+		if state := mc.State(); state == StateCrashLoop {
+			t.Fatal("crashes older than the window counted")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if starts := countStarts(mc); starts < 3 {
+		t.Errorf("only %d starts", starts)
+	}
+	// Cancels the next restart.
+	mc.Stop()
+}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"Skyfield1888/WebMine/backend"
+	"Skyfield1888/WebMine/backend/backups"
 	filesdownload "Skyfield1888/WebMine/backend/files_download"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == backend.SUPERVISE_COMMAND {
+		os.Exit(backend.RunDetachedSupervisor(os.Args[2:]))
+	}
+
 	backend.DecodeConfig()
 
 	err := filesdownload.CheckFolderStructure()
@@ -16,17 +22,71 @@ func main() {
 		log.Fatal(err)
 	}
 
+	err = backend.Instances.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	backend.ServerInstaller = filesdownload.StartInstall
+
 	log.Println("Starting Minecraft server WebSocket controller")
 	//Console
 	http.HandleFunc("/console/ws", backend.WsHandler)
 	http.HandleFunc("/console/start", backend.StartHandler)
 	http.HandleFunc("/console/stop", backend.StopHandler)
 	http.HandleFunc("/console/restart", backend.RestartHandler)
+	http.HandleFunc("/console/kill", backend.KillHandler)
+	http.HandleFunc("/console/status", backend.StatusHandler)
+	http.HandleFunc("/console/command", backend.ConsoleCommandHandler)
+	http.HandleFunc("/console/players", backend.PlayersHandler)
 	http.HandleFunc("/console/view", backend.ConsoleHandler)
 	//Properties Handeler
 	http.HandleFunc("/properties/set", backend.ChangePropertiesHandler)
 	http.HandleFunc("/properties/view", backend.PropertiesTableHandler)
 
+	//Instances Handeler
+	http.HandleFunc("/instances/view", backend.InstancesTableHandler)
+	http.HandleFunc("/instances/create", backend.CreateInstanceHandler)
+	http.HandleFunc("/instances/delete", backend.DeleteInstanceHandler)
+	http.HandleFunc("/instances/manage", backend.ManageInstanceHandler)
+	http.HandleFunc("/instances/supervisor", backend.SupervisorSettingsHandler)
+	http.HandleFunc("/instances/launch", backend.LaunchSettingsHandler)
+	http.HandleFunc("/instances/launch/view", backend.LaunchSettingsViewHandler)
+	http.HandleFunc("/instances/launch/preview", backend.LaunchPreviewHandler)
+	http.HandleFunc("/instances/install", filesdownload.InstallServerHandler)
+	http.HandleFunc("/instances/upgrade", filesdownload.UpgradeServerHandler)
+	http.HandleFunc("/instances/eula", backend.EulaHandler)
+	http.HandleFunc("/instances/eula/accept", backend.AcceptEulaHandler)
+	http.HandleFunc("/instances/eula/view", backend.EulaViewHandler)
+
+	//Downloads Handeler
+	http.HandleFunc("/downloads", filesdownload.DownloadsHandler)
+	http.HandleFunc("/downloads/cancel", filesdownload.CancelDownloadHandler)
+	http.HandleFunc("/downloads/ws", filesdownload.DownloadsWsHandler)
+	http.HandleFunc("/downloads/view", filesdownload.DownloadsViewHandler)
+	http.HandleFunc("/versions", filesdownload.VersionsHandler)
+	http.HandleFunc("/cache", filesdownload.CacheHandler)
+	http.HandleFunc("/cache/prune", filesdownload.CachePruneHandler)
+
+	//Backups Handeler
+	http.HandleFunc("/backups", backups.BackupsHandler)
+	http.HandleFunc("GET /backups/retention", backups.RetentionHandler)
+	http.HandleFunc("POST /backups/retention", backups.RetentionHandler)
+	http.HandleFunc("GET /backups/prune", backups.PruneHandler)
+	http.HandleFunc("POST /backups/prune", backups.PruneHandler)
+	http.HandleFunc("/backups/repository/verify", backups.VerifyRepositoryHandler)
+	http.HandleFunc("/backups/repository/gc", backups.GarbageCollectHandler)
+	http.HandleFunc("GET /backups/targets", backups.TargetsHandler)
+	http.HandleFunc("GET /backups/remote", backups.RemoteBackupsHandler)
+	http.HandleFunc("GET /backups/{id}/download", backups.BackupDownloadHandler)
+	http.HandleFunc("DELETE /backups/{id}", backups.DeleteBackupHandler)
+	http.HandleFunc("POST /backups/{id}/restore", backups.RestoreBackupHandler)
+	http.HandleFunc("POST /backups/{id}/pin", backups.PinBackupHandler)
+	http.HandleFunc("POST /backups/{id}/upload", backups.UploadBackupHandler)
+
+	//Java runtimes Handeler
+	http.HandleFunc("/java/runtimes", backend.JavaRuntimesHandler)
+	http.HandleFunc("/java/search_paths", backend.JavaSearchPathsHandler)
+
 	//App Setting Handeler
 	http.HandleFunc("/settings/set", backend.ChangeAppSettingsHandler)
 	http.HandleFunc("/settings/view", backend.AppSettingsTableHandler)